@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var aggregateInterval = flag.Duration("aggregate-interval", 0, "Sum the byte and packet counters in memory and add them to the metrics this often, e.g. 1s, 0 adds every flow right away")
+
+// set in main with -aggregate-interval
+var aggregator *Aggregator
+
+type aggregateEntry struct {
+	labels prometheus.Labels
+	value  float64
+	// of the last flow, nil without -exemplars
+	exemplar prometheus.Labels
+}
+
+// Aggregator sums what flows add to each series and adds the sums to the
+// counters on Flush, one With per series and interval instead of per flow.
+// Scrapes see the counters up to one interval late.
+type Aggregator struct {
+	mu   sync.Mutex
+	sums map[*prometheus.CounterVec]map[string]*aggregateEntry
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{sums: make(map[*prometheus.CounterVec]map[string]*aggregateEntry)}
+}
+
+// Add sums value for the series of vec with labels, which must not change
+// afterwards. The exemplar of the last Add is kept.
+func (a *Aggregator) Add(vec *prometheus.CounterVec, labels prometheus.Labels, value float64, exemplar prometheus.Labels) {
+	key := seriesKey(labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries, ok := a.sums[vec]
+	if !ok {
+		entries = make(map[string]*aggregateEntry)
+		a.sums[vec] = entries
+	}
+	if entry, ok := entries[key]; ok {
+		entry.value += value
+		entry.exemplar = exemplar
+		return
+	}
+	entries[key] = &aggregateEntry{labels: labels, value: value, exemplar: exemplar}
+}
+
+// Flush adds the sums to the counters and starts over
+func (a *Aggregator) Flush() {
+	a.mu.Lock()
+	sums := a.sums
+	a.sums = make(map[*prometheus.CounterVec]map[string]*aggregateEntry, len(sums))
+	a.mu.Unlock()
+
+	for vec, entries := range sums {
+		for _, entry := range entries {
+			addWithExemplar(vec.With(entry.labels), entry.value, entry.exemplar)
+		}
+	}
+}
+
+// Run flushes every interval until stop is closed. The sums of the last
+// interval are left to a final Flush once the input is done.
+func (a *Aggregator) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// addCounter adds value to the series of vec, through the aggregator with
+// -aggregate-interval. A nil exemplar adds none.
+func addCounter(vec *prometheus.CounterVec, labels prometheus.Labels, value float64, exemplar prometheus.Labels) {
+	if aggregator != nil {
+		aggregator.Add(vec, labels, value, exemplar)
+		return
+	}
+	addWithExemplar(vec.With(labels), value, exemplar)
+}
+
+func addWithExemplar(counter prometheus.Counter, value float64, exemplar prometheus.Labels) {
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		adder.AddWithExemplar(value, exemplar)
+		return
+	}
+	counter.Add(value)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var (
+	asnGroupsFile  = flag.String("asn-groups", "", `JSON file of ASN groups, e.g. {"google": [15169, 36040]}, adds the network_group label`)
+	asnGroupsOther = flag.Bool("asn-groups-other", false, "Label ungrouped ASNs network_group=other instead of their number")
+)
+
+// ASNGroups maps ASNs to a group name
+type ASNGroups map[string]string
+
+var asnGroups ASNGroups
+
+func LoadASNGroups(path string) (ASNGroups, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]uint32
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	groups := make(ASNGroups)
+	for group, asns := range raw {
+		for _, asn := range asns {
+			key := strconv.FormatUint(uint64(asn), 10)
+			if other, ok := groups[key]; ok && other != group {
+				return nil, fmt.Errorf("%s: AS%s is in both %s and %s", path, key, other, group)
+			}
+			groups[key] = group
+		}
+	}
+	return groups, nil
+}
+
+// Group returns the group of asn, for ungrouped ones the asn itself or
+// other
+func (g ASNGroups) Group(asn string, other bool) string {
+	if group, ok := g[asn]; ok {
+		return group
+	}
+	if other {
+		return "other"
+	}
+	return geoLabel(asn)
+}
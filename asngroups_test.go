@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestASNGroups(t *testing.T) {
+	groups, err := LoadASNGroups(writeTestFile(t, "groups.json", `{"google": [15169, 36040], "amazon": [16509]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		asn   string
+		other bool
+		want  string
+	}{
+		{"15169", false, "google"},
+		{"36040", true, "google"},
+		{"16509", false, "amazon"},
+		{"3320", false, "3320"},
+		{"3320", true, "other"},
+		{"", false, "unknown"},
+	}
+	for _, test := range tests {
+		if got := groups.Group(test.asn, test.other); got != test.want {
+			t.Errorf("AS%q other %v: %s, want %s", test.asn, test.other, got, test.want)
+		}
+	}
+
+	if _, err := LoadASNGroups(writeTestFile(t, "conflict.json", `{"a": [15169], "b": [15169]}`)); err == nil {
+		t.Error("an ASN in two groups loaded")
+	}
+}
+
+func TestLogPrometheusNetworkGroup(t *testing.T) {
+	path := writeTestFile(t, "groups.json", `{"google": [15169, 36040]}`)
+	setFlags(t, map[string]string{"asn-groups": path, "labels": "direction"})
+	defer func(saved ASNGroups) { asnGroups = saved }(asnGroups)
+	var err error
+	if asnGroups, err = LoadASNGroups(path); err != nil {
+		t.Fatal(err)
+	}
+	registry := setupTestMetrics(t)
+
+	for i, asn := range []string{"15169", "36040", "3320"} {
+		remote := &Peer{Ip: netaddr.MustParseIP(fmt.Sprintf("192.0.2.%d", i+1)), Asn: asn}
+		LogPrometheus(&Flow{Direction: "out", IpDst: remote.Ip, Bytes: 100, Packages: 1,
+			Source: &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}, Destination: remote})
+	}
+
+	got := map[string]float64{}
+	for key, value := range gatheredFrom(t, registry) {
+		if strings.HasPrefix(key, "flow_direction_bytes{") {
+			got[key] = value
+		}
+	}
+	assertGathered(t, got, map[string]float64{
+		`flow_direction_bytes{direction="out",network_group="google"}`: 200,
+		`flow_direction_bytes{direction="out",network_group="3320"}`:   100,
+	})
+}
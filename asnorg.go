@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	normalizeASNOrg = flag.Bool("normalize-asnorg", false, "Uppercase asn_org and strip legal suffixes like LLC or Inc., so spellings of one organization share a series")
+	asnOrgMapFile   = flag.String("asnorg-map", "", `JSON file renaming normalized asn_org values, e.g. {"GOOGLE": "Google"}, implies -normalize-asnorg`)
+)
+
+// legal forms stripped from the end of organization names, compared
+// uppercased and without dots
+var asnOrgSuffixes = map[string]bool{
+	"AB": true, "AG": true, "AS": true, "BV": true, "CO": true, "CORP": true,
+	"CORPORATION": true, "GMBH": true, "INC": true, "LIMITED": true, "LLC": true,
+	"LP": true, "LTD": true, "NV": true, "OY": true, "PLC": true, "PTY": true,
+	"SA": true, "SAS": true, "SL": true, "SPA": true, "SRL": true,
+}
+
+// -asnorg-map
+var asnOrgMap map[string]string
+
+func LoadASNOrgMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// keys may be written in any spelling
+	names := make(map[string]string, len(raw))
+	for from, to := range raw {
+		names[NormalizeASNOrg(from, nil)] = to
+	}
+	return names, nil
+}
+
+// NormalizeASNOrg uppercases org, collapses spaces and commas and strips
+// trailing legal forms, e.g. "Google LLC" and "Google, Inc." are both
+// GOOGLE. names then renames the result.
+func NormalizeASNOrg(org string, names map[string]string) string {
+	words := strings.Fields(strings.ReplaceAll(strings.ToUpper(org), ",", " "))
+	// a name that is nothing but a legal form is left alone
+	for len(words) > 1 && asnOrgSuffixes[strings.ReplaceAll(words[len(words)-1], ".", "")] {
+		words = words[:len(words)-1]
+	}
+	for i, word := range words {
+		words[i] = strings.TrimSuffix(word, ".")
+	}
+	org = strings.Join(words, " ")
+	if name, ok := names[org]; ok {
+		return name
+	}
+	return org
+}
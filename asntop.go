@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var topASNFlag = flag.Int("top-asn", 0, "Keep only the N ASNs with the most bytes in the last -top-window as asn labels, the rest becomes other, 0 disables")
+
+// how often the -top-asn set is recomputed
+const topASNInterval = time.Minute
+
+// nil unless -top-asn
+var topASN *TopASN
+
+// TopASN bounds the asn label to the ASNs with the most bytes. Bytes are
+// summed per window, the set is computed from the current and the previous
+// window, so it covers between one and two windows of traffic.
+type TopASN struct {
+	n int
+
+	mu       sync.Mutex
+	current  *TopN
+	previous *TopN
+	top      map[string]bool
+}
+
+func NewTopASN(n, maxTracked int) *TopASN {
+	return &TopASN{
+		n:        n,
+		current:  NewTopN(maxTracked),
+		previous: NewTopN(maxTracked),
+		top:      make(map[string]bool),
+	}
+}
+
+// Observe counts bytes of an ASN, unknown ones are one series anyway
+func (t *TopASN) Observe(asn string, bytes float64) {
+	if asn == "" {
+		return
+	}
+	t.mu.Lock()
+	current := t.current
+	t.mu.Unlock()
+	current.Add(asn, bytes)
+}
+
+// Keep reports whether asn is in the top set, unknown ones always are
+func (t *TopASN) Keep(asn string) bool {
+	if asn == "" {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.top[asn]
+}
+
+// Recompute takes the n ASNs with the most bytes over both windows
+func (t *TopASN) Recompute() {
+	t.mu.Lock()
+	current, previous := t.current, t.previous
+	t.mu.Unlock()
+
+	totals := make(map[string]float64)
+	for _, store := range []*TopN{previous, current} {
+		entries, _ := store.Top(store.Len())
+		for _, e := range entries {
+			totals[e.Key] += e.Value
+		}
+	}
+	merged := NewTopN(len(totals))
+	for key, value := range totals {
+		merged.Add(key, value)
+	}
+	entries, _ := merged.Top(t.n)
+
+	top := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		top[e.Key] = true
+	}
+	t.mu.Lock()
+	t.top = top
+	t.mu.Unlock()
+}
+
+// Rotate starts a new window, the current one becomes the previous
+func (t *TopASN) Rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.previous.Reset()
+	t.previous, t.current = t.current, t.previous
+}
+
+// Run recomputes the set every topASNInterval and rotates the windows every
+// window until stop is closed
+func (t *TopASN) Run(window time.Duration, stop <-chan struct{}) {
+	recompute := time.NewTicker(topASNInterval)
+	defer recompute.Stop()
+	rotate := time.NewTicker(window)
+	defer rotate.Stop()
+	for {
+		select {
+		case <-recompute.C:
+			t.Recompute()
+		case <-rotate.C:
+			t.Rotate()
+		case <-stop:
+			return
+		}
+	}
+}
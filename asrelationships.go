@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var asRelationshipsFile = flag.String("as-relationships", "", `JSON file of the ASNs that are your customers, peers and providers, e.g. {"provider": [3356], "peer": [13335]}, adds the relationship label`)
+
+// ASRelationships maps ASNs to their relationship with the own network
+type ASRelationships map[string]string
+
+var asRelationships ASRelationships
+
+var relationshipClasses = map[string]bool{"customer": true, "peer": true, "provider": true}
+
+func LoadASRelationships(path string) (ASRelationships, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]uint32
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	relationships := make(ASRelationships)
+	for class, asns := range raw {
+		if !relationshipClasses[class] {
+			return nil, fmt.Errorf("%s: unknown relationship %q, want customer, peer or provider", path, class)
+		}
+		for _, asn := range asns {
+			key := strconv.FormatUint(uint64(asn), 10)
+			if other, ok := relationships[key]; ok && other != class {
+				return nil, fmt.Errorf("%s: AS%s is both %s and %s", path, key, other, class)
+			}
+			relationships[key] = class
+		}
+	}
+	return relationships, nil
+}
+
+// Relationship returns the class of asn, other if it has none
+func (r ASRelationships) Relationship(asn string) string {
+	if class, ok := r[asn]; ok {
+		return class
+	}
+	return "other"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestASRelationships(t *testing.T) {
+	relationships, err := LoadASRelationships(writeTestFile(t, "relationships.json",
+		`{"customer": [64500, 64501], "peer": [13335], "provider": [3356]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for asn, want := range map[string]string{
+		"64500": "customer",
+		"64501": "customer",
+		"13335": "peer",
+		"3356":  "provider",
+		"15169": "other",
+		"":      "other",
+	} {
+		if got := relationships.Relationship(asn); got != want {
+			t.Errorf("AS%q: %s, want %s", asn, got, want)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unknown class": `{"sibling": [64500]}`,
+		"two classes":   `{"peer": [13335], "provider": [13335]}`,
+		"not an asn":    `{"peer": ["cloudflare"]}`,
+	} {
+		if _, err := LoadASRelationships(writeTestFile(t, "bad.json", content)); err == nil {
+			t.Errorf("%s loaded", name)
+		}
+	}
+}
+
+func TestLogPrometheusRelationship(t *testing.T) {
+	path := writeTestFile(t, "relationships.json", `{"customer": [64500], "peer": [13335], "provider": [3356]}`)
+	setFlags(t, map[string]string{"as-relationships": path, "labels": "direction"})
+	defer func(saved ASRelationships) { asRelationships = saved }(asRelationships)
+	var err error
+	if asRelationships, err = LoadASRelationships(path); err != nil {
+		t.Fatal(err)
+	}
+	registry := setupTestMetrics(t)
+
+	for i, asn := range []string{"64500", "13335", "3356", "15169", "3356"} {
+		remote := &Peer{Ip: netaddr.MustParseIP(fmt.Sprintf("192.0.2.%d", i+1)), Asn: asn}
+		LogPrometheus(&Flow{Direction: "out", IpDst: remote.Ip, Bytes: 100, Packages: 1,
+			Source: &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}, Destination: remote})
+	}
+
+	got := map[string]float64{}
+	for key, value := range gatheredFrom(t, registry) {
+		if strings.HasPrefix(key, "flow_direction_bytes{") {
+			got[key] = value
+		}
+	}
+	assertGathered(t, got, map[string]float64{
+		`flow_direction_bytes{direction="out",relationship="customer"}`: 100,
+		`flow_direction_bytes{direction="out",relationship="peer"}`:     100,
+		`flow_direction_bytes{direction="out",relationship="provider"}`: 200,
+		`flow_direction_bytes{direction="out",relationship="other"}`:    100,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	billingPeriodFlag = flag.String("billing-period", "", "Expose flow_billing_period_bytes per period: month, or a duration like 720h counted from -billing-anchor")
+	billingDay        = flag.Int("billing-day", 1, "Day of month a month billing period starts on (1-28)")
+	billingAnchor     = flag.String("billing-anchor", "2021-01-01T00:00:00Z", "RFC3339 start of the first billing period for duration periods")
+	billingState      = flag.String("billing-state", "", "File keeping the billing period totals across restarts")
+)
+
+var (
+	flowBillingBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "flow_billing_period_bytes",
+			Help: "Bytes in the current billing period, resets at the period boundary",
+		},
+		[]string{"direction"},
+	)
+	flowBillingStart = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flow_billing_period_start_timestamp_seconds",
+			Help: "Start of the current billing period",
+		},
+	)
+)
+
+// BillingPeriod is either a calendar month starting on a given day or a
+// fixed length repeating from an anchor
+type BillingPeriod struct {
+	Monthly bool
+	Day     int
+	Length  time.Duration
+	Anchor  time.Time
+}
+
+func ParseBillingPeriod(period string, day int, anchor string) (BillingPeriod, error) {
+	if period == "month" {
+		if day < 1 || day > 28 {
+			return BillingPeriod{}, fmt.Errorf("-billing-day must be between 1 and 28, got %d", day)
+		}
+		return BillingPeriod{Monthly: true, Day: day}, nil
+	}
+	length, err := time.ParseDuration(period)
+	if err != nil || length <= 0 {
+		return BillingPeriod{}, fmt.Errorf("-billing-period must be month or a positive duration, got %q", period)
+	}
+	start, err := time.Parse(time.RFC3339, anchor)
+	if err != nil {
+		return BillingPeriod{}, fmt.Errorf("-billing-anchor: %w", err)
+	}
+	return BillingPeriod{Length: length, Anchor: start}, nil
+}
+
+// Start returns the start of the period containing t
+func (p BillingPeriod) Start(t time.Time) time.Time {
+	if p.Monthly {
+		start := time.Date(t.Year(), t.Month(), p.Day, 0, 0, 0, 0, t.Location())
+		if t.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	n := t.Sub(p.Anchor) / p.Length
+	if t.Before(p.Anchor) {
+		n--
+	}
+	return p.Anchor.Add(n * p.Length)
+}
+
+type billingSnapshot struct {
+	Start time.Time          `json:"start"`
+	Bytes map[string]float64 `json:"bytes"`
+}
+
+// Billing sums bytes per direction within the current billing period
+type Billing struct {
+	period BillingPeriod
+	state  string
+
+	mu    sync.Mutex
+	start time.Time
+	bytes map[string]float64
+}
+
+func NewBilling(period BillingPeriod, state string, now time.Time) *Billing {
+	b := &Billing{
+		period: period,
+		state:  state,
+		start:  period.Start(now),
+		bytes:  make(map[string]float64),
+	}
+	flowBillingStart.Set(float64(b.start.Unix()))
+	return b
+}
+
+// Load restores the totals from the state file if they are of the current period
+func (b *Billing) Load() error {
+	data, err := os.ReadFile(b.state)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot billingSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("%s: %w", b.state, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !snapshot.Start.Equal(b.start) {
+		return nil
+	}
+	for direction, bytes := range snapshot.Bytes {
+		b.bytes[direction] = bytes
+		flowBillingBytes.With(prometheus.Labels{"direction": direction}).Set(bytes)
+	}
+	return nil
+}
+
+func (b *Billing) Save() error {
+	b.mu.Lock()
+	snapshot := billingSnapshot{Start: b.start, Bytes: make(map[string]float64, len(b.bytes))}
+	for direction, bytes := range b.bytes {
+		snapshot.Bytes[direction] = bytes
+	}
+	b.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.state, data)
+}
+
+// rollover starts a new period if now is past the current one, b.mu held
+func (b *Billing) rollover(now time.Time) {
+	start := b.period.Start(now)
+	if start.Equal(b.start) {
+		return
+	}
+	b.start = start
+	b.bytes = make(map[string]float64)
+	flowBillingBytes.Reset()
+	flowBillingStart.Set(float64(start.Unix()))
+}
+
+func (b *Billing) Add(flow *Flow, now time.Time) {
+	if flow.Direction != "in" && flow.Direction != "out" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(now)
+	b.bytes[flow.Direction] += float64(flow.Bytes)
+	flowBillingBytes.With(prometheus.Labels{"direction": flow.Direction}).Set(b.bytes[flow.Direction])
+}
+
+// Run rolls idle periods over and saves the state file every interval
+// until stop is closed
+func (b *Billing) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			b.mu.Lock()
+			b.rollover(now)
+			b.mu.Unlock()
+			if b.state != "" {
+				if err := b.Save(); err != nil {
+					slog.Error("saving billing state", "err", err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data without readers ever seeing a
+// partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestBillingPeriodStart(t *testing.T) {
+	monthly, err := ParseBillingPeriod("month", 15, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thirtyDays, err := ParseBillingPeriod("720h", 1, "2021-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		period BillingPeriod
+		at     string
+		start  string
+	}{
+		{monthly, "2023-03-20T10:00:00Z", "2023-03-15T00:00:00Z"},
+		{monthly, "2023-03-15T00:00:00Z", "2023-03-15T00:00:00Z"},
+		{monthly, "2023-03-14T23:59:59Z", "2023-02-15T00:00:00Z"},
+		// across the year
+		{monthly, "2023-01-02T00:00:00Z", "2022-12-15T00:00:00Z"},
+		{thirtyDays, "2021-01-30T23:59:59Z", "2021-01-01T00:00:00Z"},
+		{thirtyDays, "2021-01-31T00:00:00Z", "2021-01-31T00:00:00Z"},
+		{thirtyDays, "2020-12-31T00:00:00Z", "2020-12-02T00:00:00Z"},
+	}
+	for _, test := range tests {
+		if got := test.period.Start(date(test.at)); !got.Equal(date(test.start)) {
+			t.Errorf("%+v at %s: %s, want %s", test.period, test.at, got.Format(time.RFC3339), test.start)
+		}
+	}
+}
+
+func TestParseBillingPeriodInvalid(t *testing.T) {
+	tests := []struct {
+		period string
+		day    int
+		anchor string
+	}{
+		{"month", 29, ""},
+		{"week", 1, ""},
+		{"-24h", 1, ""},
+		{"720h", 1, "yesterday"},
+	}
+	for _, test := range tests {
+		if _, err := ParseBillingPeriod(test.period, test.day, test.anchor); err == nil {
+			t.Errorf("%+v accepted", test)
+		}
+	}
+}
+
+func TestBillingRollover(t *testing.T) {
+	period, _ := ParseBillingPeriod("month", 1, "")
+	b := NewBilling(period, "", date("2023-03-30T00:00:00Z"))
+	in := flowBillingBytes.With(prometheus.Labels{"direction": "in"})
+
+	b.Add(&Flow{Direction: "in", Bytes: 100}, date("2023-03-30T00:00:00Z"))
+	b.Add(&Flow{Direction: "in", Bytes: 50}, date("2023-03-31T23:00:00Z"))
+	b.Add(&Flow{Direction: "unknown", Bytes: 1000}, date("2023-03-31T23:00:00Z"))
+	if got := testutil.ToFloat64(in); got != 150 {
+		t.Errorf("in %v, want 150", got)
+	}
+
+	b.Add(&Flow{Direction: "in", Bytes: 7}, date("2023-04-01T00:00:01Z"))
+	in = flowBillingBytes.With(prometheus.Labels{"direction": "in"})
+	if got := testutil.ToFloat64(in); got != 7 {
+		t.Errorf("in %v after the rollover, want 7", got)
+	}
+	if got := testutil.ToFloat64(flowBillingStart); got != float64(date("2023-04-01T00:00:00Z").Unix()) {
+		t.Errorf("period start %v", got)
+	}
+}
+
+func TestBillingRestart(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "billing.json")
+	period, _ := ParseBillingPeriod("month", 1, "")
+
+	b := NewBilling(period, state, date("2023-03-10T00:00:00Z"))
+	b.Add(&Flow{Direction: "out", Bytes: 4000}, date("2023-03-10T00:00:00Z"))
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted in the same period, the total goes on
+	restarted := NewBilling(period, state, date("2023-03-20T00:00:00Z"))
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Add(&Flow{Direction: "out", Bytes: 1000}, date("2023-03-20T00:00:00Z"))
+	if got := testutil.ToFloat64(flowBillingBytes.With(prometheus.Labels{"direction": "out"})); got != 5000 {
+		t.Errorf("out %v after the restart, want 5000", got)
+	}
+
+	// restarted in the next period, the saved total is of the old one
+	flowBillingBytes.Reset()
+	next := NewBilling(period, state, date("2023-04-02T00:00:00Z"))
+	if err := next.Load(); err != nil {
+		t.Fatal(err)
+	}
+	next.Add(&Flow{Direction: "out", Bytes: 1}, date("2023-04-02T00:00:00Z"))
+	if got := testutil.ToFloat64(flowBillingBytes.With(prometheus.Labels{"direction": "out"})); got != 1 {
+		t.Errorf("out %v in the next period, want 1", got)
+	}
+}
+
+func TestBillingLoadMissingState(t *testing.T) {
+	period, _ := ParseBillingPeriod("month", 1, "")
+	b := NewBilling(period, filepath.Join(t.TempDir(), "missing.json"), time.Now())
+	if err := b.Load(); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+var (
+	binaryOut   = flag.String("binary-out", "", "File flows are appended to in a compact binary format, see -replay")
+	replayFile  = flag.String("replay", "", "Read flows from -binary-out files (comma separated) instead of running pmacctd, exits when done")
+	replayLabel = flag.Bool("replay-label-file", false, "Add the name of the -replay file a flow came from as source_file label")
+)
+
+// a record is the uvarint length of its payload followed by the payload:
+//
+//	version byte, timestamp (varint unix ns, 0 if unknown),
+//	ip_src, ip_dst (length byte and 4 or 16 bytes),
+//	port_src, port_dst, packets, bytes (uvarint),
+//	proto, label, peer_ip_src, domain (uvarint length and bytes),
+//	since version 2: fragmented (byte 0 or 1), event_type (uvarint length
+//	and bytes)
+//
+// Only what pmacct reported is stored, replay enriches the flows again.
+// Records of version 1 are still read, without fragmented and event_type.
+const binaryFlowVersion = 2
+
+// maxBinaryRecord guards against reading garbage as a huge length
+const maxBinaryRecord = 64 << 10
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendIP(b []byte, raw string) []byte {
+	ip, err := netaddr.ParseIP(raw)
+	switch {
+	case err != nil:
+		return append(b, 0)
+	case ip.Is4():
+		a := ip.As4()
+		return append(append(b, 4), a[:]...)
+	}
+	a := ip.As16()
+	return append(append(b, 16), a[:]...)
+}
+
+// EncodeBinaryFlow appends the record of f to b
+func EncodeBinaryFlow(b []byte, f *Flow) []byte {
+	var p []byte
+	p = append(p, binaryFlowVersion)
+	var ts int64
+	if !f.Timestamp.IsZero() {
+		ts = f.Timestamp.UnixNano()
+	}
+	p = appendVarint(p, ts)
+	p = appendIP(p, f.IpSrcRaw)
+	p = appendIP(p, f.IpDstRaw)
+	p = appendUvarint(p, uint64(f.SrcPort))
+	p = appendUvarint(p, uint64(f.DstPort))
+	p = appendUvarint(p, uint64(f.Packages))
+	p = appendUvarint(p, uint64(f.Bytes))
+	p = appendString(p, f.Proto)
+	p = appendString(p, f.Label)
+	p = appendString(p, f.ExporterRaw)
+	p = appendString(p, f.Domain)
+	var fragmented byte
+	if f.Fragmented {
+		fragmented = 1
+	}
+	p = append(p, fragmented)
+	p = appendString(p, f.EventType)
+	return append(appendUvarint(b, uint64(len(p))), p...)
+}
+
+var (
+	errShortRecord = errors.New("binary flow: short record")
+	// a record that can't be decoded, the ones after it are still readable
+	errBadRecord = errors.New("binary flow: bad record")
+)
+
+type recordDecoder struct {
+	p   []byte
+	err error
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		d.err = errShortRecord
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *recordDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.err = errShortRecord
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *recordDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.p) < n {
+		d.err = errShortRecord
+		return nil
+	}
+	b := d.p[:n]
+	d.p = d.p[n:]
+	return b
+}
+
+func (d *recordDecoder) string() string {
+	return string(d.bytes(int(d.uvarint())))
+}
+
+func (d *recordDecoder) ip() string {
+	n := d.bytes(1)
+	if d.err != nil {
+		return ""
+	}
+	switch n[0] {
+	case 0:
+		return ""
+	case 4:
+		var a [4]byte
+		copy(a[:], d.bytes(4))
+		return netaddr.IPFrom4(a).String()
+	case 16:
+		var a [16]byte
+		copy(a[:], d.bytes(16))
+		return netaddr.IPFrom16(a).String()
+	}
+	d.err = fmt.Errorf("binary flow: bad ip length %d", n[0])
+	return ""
+}
+
+// DecodeBinaryFlow turns a record payload back into a flow as MakeFlow has
+// it before the pipeline runs
+func DecodeBinaryFlow(p []byte) (*Flow, error) {
+	if len(p) == 0 || p[0] < 1 || p[0] > binaryFlowVersion {
+		return nil, fmt.Errorf("binary flow: unknown version")
+	}
+	version := p[0]
+	d := &recordDecoder{p: p[1:]}
+	f := &Flow{}
+	if ts := d.varint(); ts != 0 {
+		f.Timestamp = time.Unix(0, ts)
+	}
+	f.IpSrcRaw = d.ip()
+	f.IpDstRaw = d.ip()
+	f.SrcPort = int(d.uvarint())
+	f.DstPort = int(d.uvarint())
+	f.Packages = int(d.uvarint())
+	f.Bytes = int(d.uvarint())
+	f.Proto = d.string()
+	f.Label = d.string()
+	f.ExporterRaw = d.string()
+	f.Domain = d.string()
+	if version >= 2 {
+		if fragmented := d.bytes(1); d.err == nil {
+			f.Fragmented = fragmented[0] != 0
+		}
+		f.EventType = d.string()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return f, nil
+}
+
+// BinaryWriter appends flow records to a file
+type BinaryWriter struct {
+	mu      sync.Mutex
+	out     *os.File
+	buf     *bufio.Writer
+	scratch []byte
+}
+
+func NewBinaryWriter(path string) (*BinaryWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryWriter{out: file, buf: bufio.NewWriter(file)}, nil
+}
+
+func (w *BinaryWriter) Write(f *Flow) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.scratch = EncodeBinaryFlow(w.scratch[:0], f)
+	_, err := w.buf.Write(w.scratch)
+	return err
+}
+
+func (w *BinaryWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Flush()
+}
+
+// Run flushes every interval until stop is closed
+func (w *BinaryWriter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *BinaryWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.out.Close()
+}
+
+// BinaryReader reads the records of a -binary-out file
+type BinaryReader struct {
+	in *bufio.Reader
+}
+
+func NewBinaryReader(r io.Reader) *BinaryReader {
+	return &BinaryReader{in: bufio.NewReader(r)}
+}
+
+// Next returns the next flow, io.EOF after the last one. A record that
+// doesn't decode is an errBadRecord, reading can go on after it.
+func (r *BinaryReader) Next() (*Flow, error) {
+	n, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBinaryRecord {
+		return nil, fmt.Errorf("binary flow: record of %d bytes", n)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r.in, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	flow, err := DecodeBinaryFlow(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRecord, err)
+	}
+	return flow, nil
+}
+
+// Replay runs the flows of r through pipeline and hands the kept ones to
+// handle, returning the number of records read and of those skipped. A
+// record that doesn't decode or fails the pipeline is skipped and counted
+// as parse_error in flow_events_total, like a bad line from pmacct. Flows
+// get file as SourceFile. It stops early without error once ctx is
+// cancelled.
+func Replay(ctx context.Context, r *BinaryReader, file string, pipeline Pipeline, handle func(*Flow)) (n, skipped int, err error) {
+	for ctx.Err() == nil {
+		flow, err := r.Next()
+		if err == io.EOF {
+			return n, skipped, nil
+		}
+		if err != nil && !errors.Is(err, errBadRecord) {
+			return n, skipped, err
+		}
+		n++
+		if err == nil {
+			flow.SourceFile = file
+			var keep bool
+			if keep, err = pipeline.Run(flow); err == nil && keep {
+				handle(flow)
+			}
+		}
+		if err != nil {
+			slog.Debug("skipping replayed flow", "err", err, "file", file, "record", n)
+			flowEvents.With(prometheus.Labels{"status": "parse_error"}).Inc()
+			skipped++
+		}
+	}
+	return n, skipped, nil
+}
+
+// ReplayFiles replays comma separated files one after another
+func ReplayFiles(ctx context.Context, files string, pipeline Pipeline, handle func(*Flow)) error {
+	for _, path := range strings.Split(files, ",") {
+		if ctx.Err() != nil {
+			return nil
+		}
+		path = strings.TrimSpace(path)
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		in, err := maybeGunzip(file)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		n, skipped, err := Replay(ctx, NewBinaryReader(in), filepath.Base(path), pipeline, handle)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		slog.Info("replayed", "flows", n, "skipped", skipped, "file", path)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var binaryTestFlows = []*Flow{
+	{
+		Timestamp: time.Unix(1614834367, 250000000),
+		IpSrcRaw:  "10.0.0.1", IpDstRaw: "8.8.8.8", SrcPort: 50000, DstPort: 53,
+		Packages: 2, Bytes: 140, Proto: "udp", Label: "7", ExporterRaw: "192.0.2.1", Domain: "dns.google",
+		Fragmented: true, EventType: "purge",
+	},
+	{IpSrcRaw: "2001:db8::1", IpDstRaw: "2001:db8::2", Packages: 1, Bytes: 1 << 40, Proto: "tcp"},
+	// what pmacct prints for an empty address
+	{IpSrcRaw: "", IpDstRaw: "8.8.8.8"},
+}
+
+func TestBinaryFlowRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.bin")
+	w, err := NewBinaryWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range binaryTestFlows {
+		if err := w.Write(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []*Flow
+	err = ReplayFiles(context.Background(), path, nil, func(f *Flow) { replayed = append(replayed, f) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(binaryTestFlows) {
+		t.Fatalf("replayed %d flows, want %d", len(replayed), len(binaryTestFlows))
+	}
+	for i, f := range replayed {
+		if f.SourceFile != "flows.bin" {
+			t.Errorf("flow %d from %q", i, f.SourceFile)
+		}
+		f.SourceFile = ""
+		if !f.Timestamp.Equal(binaryTestFlows[i].Timestamp) {
+			t.Errorf("flow %d at %v, want %v", i, f.Timestamp, binaryTestFlows[i].Timestamp)
+		}
+		f.Timestamp = binaryTestFlows[i].Timestamp
+		if !reflect.DeepEqual(f, binaryTestFlows[i]) {
+			t.Errorf("flow %d replayed as %+v, want %+v", i, f, binaryTestFlows[i])
+		}
+	}
+}
+
+func TestReplayRunsPipeline(t *testing.T) {
+	var buf []byte
+	for _, f := range binaryTestFlows {
+		buf = EncodeBinaryFlow(buf, f)
+	}
+	onlyUDP := Pipeline{{"filter", func(f *Flow) (bool, error) { return f.Proto == "udp", nil }}}
+
+	var kept int
+	n, skipped, err := Replay(context.Background(), NewBinaryReader(bytes.NewReader(buf)), "", onlyUDP, func(*Flow) { kept++ })
+	if err != nil || n != 3 || skipped != 0 || kept != 1 {
+		t.Errorf("read %d, skipped %d, kept %d, err %v", n, skipped, kept, err)
+	}
+}
+
+func TestReplaySkipsFailingRecords(t *testing.T) {
+	buf := EncodeBinaryFlow(nil, binaryTestFlows[0])
+	// a record of a future version
+	buf = append(appendUvarint(buf, 2), 9, 0)
+	buf = EncodeBinaryFlow(buf, binaryTestFlows[1])
+	buf = EncodeBinaryFlow(buf, binaryTestFlows[2])
+	noEmptyAddress := Pipeline{{"enrich", func(f *Flow) (bool, error) {
+		if f.IpSrcRaw == "" {
+			return false, errors.New("empty ip_src")
+		}
+		return true, nil
+	}}}
+
+	parseErrors := flowEvents.With(prometheus.Labels{"status": "parse_error"})
+	before := testutil.ToFloat64(parseErrors)
+	var kept []*Flow
+	n, skipped, err := Replay(context.Background(), NewBinaryReader(bytes.NewReader(buf)), "", noEmptyAddress, func(f *Flow) { kept = append(kept, f) })
+	if err != nil || n != 4 || skipped != 2 || len(kept) != 2 {
+		t.Fatalf("read %d, skipped %d, kept %d, err %v", n, skipped, len(kept), err)
+	}
+	if kept[1].IpSrcRaw != binaryTestFlows[1].IpSrcRaw {
+		t.Errorf("replayed %s after the bad record, want %s", kept[1].IpSrcRaw, binaryTestFlows[1].IpSrcRaw)
+	}
+	if got := testutil.ToFloat64(parseErrors) - before; got != 2 {
+		t.Errorf("flow_events_total{status=\"parse_error\"} grew by %v, want 2", got)
+	}
+}
+
+func TestDecodeBinaryFlowVersion1(t *testing.T) {
+	f := *binaryTestFlows[1]
+	// version 1 ends before fragmented and event_type, a zero byte each here
+	v2 := EncodeBinaryFlow(nil, &f)[1:]
+	v1 := append([]byte{1}, v2[1:len(v2)-2]...)
+	got, err := DecodeBinaryFlow(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, &f) {
+		t.Errorf("version 1 record decoded as %+v, want %+v", got, &f)
+	}
+}
+
+func TestBinaryReaderTruncated(t *testing.T) {
+	buf := EncodeBinaryFlow(nil, binaryTestFlows[0])
+	r := NewBinaryReader(bytes.NewReader(buf[:len(buf)-3]))
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated record: %v", err)
+	}
+
+	if _, err := NewBinaryReader(bytes.NewReader(nil)).Next(); err != io.EOF {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestBinaryWriterAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.bin")
+	for i := 0; i < 2; i++ {
+		w, err := NewBinaryWriter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(binaryTestFlows[1])
+		w.Close()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := EncodeBinaryFlow(EncodeBinaryFlow(nil, binaryTestFlows[1]), binaryTestFlows[1]); !bytes.Equal(data, want) {
+		t.Errorf("restarted writer didn't append")
+	}
+}
+
+func TestReplaySourceFileLabel(t *testing.T) {
+	setFlags(t, map[string]string{"replay-label-file": "true", "labels": "direction"})
+	registry := setupTestMetrics(t)
+
+	dir := t.TempDir()
+	var paths []string
+	for name, bytes := range map[string]int{"monday.bin": 100, "tuesday.bin": 700} {
+		path := filepath.Join(dir, name)
+		w, err := NewBinaryWriter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			w.Write(&Flow{IpSrcRaw: "8.8.8.8", IpDstRaw: "10.0.0.1", Bytes: bytes, Packages: 1})
+		}
+		w.Close()
+		paths = append(paths, path)
+	}
+
+	classify := Pipeline{{"classify", func(f *Flow) (bool, error) {
+		f.Direction, f.Source, f.Destination = "in", &Peer{}, &Peer{}
+		return true, nil
+	}}}
+	if err := ReplayFiles(context.Background(), strings.Join(paths, ", "), classify, LogPrometheus); err != nil {
+		t.Fatal(err)
+	}
+
+	got := gatheredFrom(t, registry)
+	for key, want := range map[string]float64{
+		`flow_direction_bytes{direction="in",source_file="monday.bin"}`:  200,
+		`flow_direction_bytes{direction="in",source_file="tuesday.bin"}`: 1400,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cardinalityEnabled = flag.Bool("cardinality", false, "Estimate distinct values per label of the byte counter, exposed as flow_label_cardinality and on /cardinality")
+
+// set in main with -cardinality
+var cardinality *CardinalityTracker
+
+// CardinalityTracker estimates the distinct values of every label and the
+// series of the byte counter. Counter series are never deleted, so these
+// are the series exported since startup.
+type CardinalityTracker struct {
+	mu     sync.Mutex
+	labels map[string]*hyperLogLog
+	series hyperLogLog
+
+	labelDesc  *prometheus.Desc
+	seriesDesc *prometheus.Desc
+}
+
+func NewCardinalityTracker() *CardinalityTracker {
+	return &CardinalityTracker{
+		labels: make(map[string]*hyperLogLog),
+		labelDesc: prometheus.NewDesc(
+			"flow_label_cardinality",
+			"Estimated distinct values of a label of the byte counter",
+			[]string{"label"}, nil,
+		),
+		seriesDesc: prometheus.NewDesc(
+			"flow_series_cardinality",
+			"Estimated series of the byte counter",
+			nil, nil,
+		),
+	}
+}
+
+func (c *CardinalityTracker) Observe(labels prometheus.Labels) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		hll, ok := c.labels[name]
+		if !ok {
+			hll = &hyperLogLog{}
+			c.labels[name] = hll
+		}
+		hll.Add(labels[name])
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+	c.series.Add(key.String())
+}
+
+// Estimates returns the distinct values per label and the series count
+func (c *CardinalityTracker) Estimates() (map[string]uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make(map[string]uint64, len(c.labels))
+	for name, hll := range c.labels {
+		labels[name] = hll.Estimate()
+	}
+	return labels, c.series.Estimate()
+}
+
+func (c *CardinalityTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.labelDesc
+	ch <- c.seriesDesc
+}
+
+func (c *CardinalityTracker) Collect(ch chan<- prometheus.Metric) {
+	labels, series := c.Estimates()
+	for name, n := range labels {
+		ch <- prometheus.MustNewConstMetric(c.labelDesc, prometheus.GaugeValue, float64(n), name)
+	}
+	ch <- prometheus.MustNewConstMetric(c.seriesDesc, prometheus.GaugeValue, float64(series))
+}
+
+func (c *CardinalityTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels, series := c.Estimates()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Labels map[string]uint64 `json:"labels"`
+		Series uint64            `json:"series"`
+	}{labels, series})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestCardinalityTracker(t *testing.T) {
+	c := NewCardinalityTracker()
+	for i := 0; i < 1000; i++ {
+		// 200 distinct series, each seen 5 times
+		n := i % 200
+		c.Observe(map[string]string{
+			"direction": []string{"in", "out"}[n%2],
+			"country":   fmt.Sprintf("country-%d", n%5),
+			"asn":       fmt.Sprint(64500 + n),
+		})
+	}
+
+	labels, series := c.Estimates()
+	if labels["direction"] != 2 || labels["country"] != 5 {
+		t.Errorf("estimated %d directions and %d countries, want 2 and 5", labels["direction"], labels["country"])
+	}
+	for name, got := range map[string]uint64{"asn": labels["asn"], "series": series} {
+		if got < 194 || got > 206 {
+			t.Errorf("estimated %d for %s, want about 200", got, name)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	c.ServeHTTP(recorder, httptest.NewRequest("GET", "/cardinality", nil))
+	var view struct {
+		Labels map[string]uint64 `json:"labels"`
+		Series uint64            `json:"series"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Series != series || len(view.Labels) != 3 || view.Labels["country"] != 5 {
+		t.Errorf("/cardinality %+v", view)
+	}
+
+	got := gathered(t, c)
+	if got[`flow_label_cardinality{label="country"}`] != 5 || got[`flow_series_cardinality`] != float64(series) {
+		t.Errorf("exported %v", got)
+	}
+}
+
+func TestLogPrometheusCardinality(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction,country"})
+	setupTestMetrics(t)
+	defer func(saved *CardinalityTracker) { cardinality = saved }(cardinality)
+	cardinality = NewCardinalityTracker()
+
+	for _, country := range []string{"Germany", "France", "Germany"} {
+		remote := &Peer{Ip: netaddr.MustParseIP("192.0.2.1"), Country: country}
+		LogPrometheus(&Flow{Direction: "in", IpSrc: remote.Ip, Bytes: 1, Packages: 1,
+			Source: remote, Destination: &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}})
+	}
+	labels, series := cardinality.Estimates()
+	if labels["country"] != 2 || labels["direction"] != 1 || series != 2 {
+		t.Errorf("labels %v, series %d", labels, series)
+	}
+}
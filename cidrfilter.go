@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+
+	"github.com/patte/go-pmacct/flow"
+)
+
+var (
+	includeCIDRFlag stringList
+	excludeCIDRFlag stringList
+
+	// -include-cidr and -exclude-cidr, empty counts every flow
+	includeCIDRs []netaddr.IPPrefix
+	excludeCIDRs []netaddr.IPPrefix
+)
+
+var flowsCIDRFiltered = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flows_cidr_filtered_total",
+		Help: "Flows skipped by -include-cidr or -exclude-cidr, by which of the two",
+	},
+	[]string{"filter"},
+)
+
+func init() {
+	flag.Var(&includeCIDRFlag, "include-cidr", "Only count flows with src or dst in these CIDRs (repeatable, comma separated)")
+	flag.Var(&excludeCIDRFlag, "exclude-cidr", "Skip flows with src or dst in these CIDRs, e.g. the management network (repeatable, comma separated)")
+}
+
+// cidrStage drops flows with no endpoint in include, if set, and flows with
+// any endpoint in exclude. An address that doesn't parse matches nothing.
+func cidrStage(include, exclude []netaddr.IPPrefix) func(*Flow) (bool, error) {
+	return func(f *Flow) (bool, error) {
+		src, _ := netaddr.ParseIP(f.IpSrcRaw)
+		dst, _ := netaddr.ParseIP(f.IpDstRaw)
+		if len(include) > 0 && !flow.ContainsPrefix(include, src) && !flow.ContainsPrefix(include, dst) {
+			flowsCIDRFiltered.With(prometheus.Labels{"filter": "include"}).Inc()
+			return false, nil
+		}
+		if flow.ContainsPrefix(exclude, src) || flow.ContainsPrefix(exclude, dst) {
+			flowsCIDRFiltered.With(prometheus.Labels{"filter": "exclude"}).Inc()
+			return false, nil
+		}
+		return true, nil
+	}
+}
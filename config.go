@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "YAML file of flag values, keys are flag names without the dash, flags on the command line win")
+
+// configEntry is one key of a config file, a list sets a repeatable flag
+// once per item
+type configEntry struct {
+	key    string
+	values []string
+	line   int
+}
+
+// LoadConfig sets the flags of fs from the YAML file at path, except those
+// already set on the command line. Only flat YAML is read: key: value pairs,
+// and lists as [a, b] or as indented "- item" lines.
+func LoadConfig(path string, fs *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, entry := range entries {
+		if entry.key == "config" || fs.Lookup(entry.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", path, entry.line, entry.key)
+		}
+		if explicit[entry.key] {
+			continue
+		}
+		for _, value := range entry.values {
+			if err := fs.Set(entry.key, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %w", path, entry.line, entry.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseConfig(data []byte) ([]configEntry, error) {
+	var entries []configEntry
+	seen := make(map[string]bool)
+	// the key whose value is a block list, until a line is not an item
+	var list *configEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if list != nil && strings.HasPrefix(trimmed, "-") && line != strings.TrimLeft(line, " \t") {
+			value, err := configScalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			list.values = append(list.values, value)
+			continue
+		}
+		list = nil
+
+		if line != strings.TrimLeft(line, " \t") {
+			return nil, fmt.Errorf("line %d: nested values are not supported", n)
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		key, raw := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		seen[key] = true
+
+		entry := configEntry{key: key, line: n}
+		switch {
+		case raw == "":
+			entries = append(entries, entry)
+			list = &entries[len(entries)-1]
+			continue
+		case strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]"):
+			if inner := strings.TrimSpace(raw[1 : len(raw)-1]); inner != "" {
+				for _, item := range strings.Split(inner, ",") {
+					value, err := configScalar(strings.TrimSpace(item))
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %w", n, err)
+					}
+					entry.values = append(entry.values, value)
+				}
+			}
+		default:
+			value, err := configScalar(raw)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			entry.values = []string{value}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// stripComment cuts a # comment that is not inside quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configScalar unquotes a YAML scalar, plain ones are taken as written
+func configScalar(raw string) (string, error) {
+	switch {
+	case len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"':
+		return strconv.Unquote(raw)
+	case len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'':
+		return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	csvOut      = flag.String("csv-out", "", "Directory to append talkers.csv and countries.csv to every -csv-interval, for reporting without Prometheus")
+	csvInterval = flag.Duration("csv-interval", time.Hour, "Window summed into one set of -csv-out rows")
+	csvTop      = flag.Int("csv-top-talkers", 20, "Remote ips per window in talkers.csv, the rest as other")
+)
+
+var (
+	csvTalkersHeader   = []string{"window_end", "ip", "bytes"}
+	csvCountriesHeader = []string{"window_end", "country", "direction", "bytes"}
+)
+
+// CSVExporter sums the bytes of each window per remote ip and per country
+// and direction, and appends them to CSV files when the window ends
+type CSVExporter struct {
+	dir       string
+	n         int
+	talkers   *TopN
+	countries *TopN
+}
+
+func NewCSVExporter(dir string, n int, maxTracked int) *CSVExporter {
+	return &CSVExporter{
+		dir:       dir,
+		n:         n,
+		talkers:   NewTopN(maxTracked),
+		countries: NewTopN(maxTracked),
+	}
+}
+
+func (c *CSVExporter) Observe(flow *Flow) {
+	peer := flow.RemotePeer()
+	if peer == nil {
+		return
+	}
+	c.talkers.Add(AggregateIP(peer.Ip, *v6AggLen), float64(flow.Bytes))
+	c.countries.Add(geoLabel(peer.Country)+"\x00"+flow.Direction, float64(flow.Bytes))
+}
+
+// Rows returns the rows of the window ending at end and starts the next one
+func (c *CSVExporter) Rows(end time.Time) (talkers [][]string, countries [][]string) {
+	stamp := end.UTC().Format(time.RFC3339)
+
+	top, other := c.talkers.Take(c.n)
+	for _, e := range top {
+		talkers = append(talkers, []string{stamp, e.Key, formatBytes(e.Value)})
+	}
+	if other > 0 {
+		talkers = append(talkers, []string{stamp, "other", formatBytes(other)})
+	}
+
+	all, overflow := c.countries.Take(c.countries.maxKeys)
+	for _, e := range all {
+		key := strings.SplitN(e.Key, "\x00", 2)
+		countries = append(countries, []string{stamp, key[0], key[1], formatBytes(e.Value)})
+	}
+	if overflow > 0 {
+		countries = append(countries, []string{stamp, "other", "", formatBytes(overflow)})
+	}
+	return talkers, countries
+}
+
+func formatBytes(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Flush appends the rows of the window ending at end
+func (c *CSVExporter) Flush(end time.Time) error {
+	talkers, countries := c.Rows(end)
+	if err := appendCSV(filepath.Join(c.dir, "talkers.csv"), csvTalkersHeader, talkers); err != nil {
+		return err
+	}
+	return appendCSV(filepath.Join(c.dir, "countries.csv"), csvCountriesHeader, countries)
+}
+
+// appendCSV appends rows to path in a single write. The header is written
+// with the first rows of a new file.
+func appendCSV(path string, header []string, rows [][]string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if info.Size() == 0 {
+		w.Write(header)
+	}
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Run flushes every interval until stop is closed. The partial last window
+// is flushed by main once the input is done.
+func (c *CSVExporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := c.Flush(now); err != nil {
+				slog.Error("writing -csv-out", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCSVExporterFlush(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCSVExporter(dir, 2, 100)
+	withCountry := func(f *Flow, country string) *Flow {
+		f.Destination.Country = country
+		return f
+	}
+
+	c.Observe(withCountry(outFlow("1.1.1.1", 443, 5000), "Australia"))
+	c.Observe(withCountry(outFlow("8.8.8.8", 53, 300), "United States"))
+	c.Observe(withCountry(outFlow("9.9.9.9", 53, 200), "Switzerland"))
+	c.Observe(withCountry(outFlow("1.1.1.1", 443, 1000), "Australia"))
+	// no remote peer
+	c.Observe(&Flow{Direction: "unknown", Bytes: 1 << 20})
+	if err := c.Flush(time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second window only holds what came after the first flush
+	c.Observe(withCountry(outFlow("8.8.8.8", 53, 70), "United States"))
+	if err := c.Flush(time.Date(2026, 1, 1, 14, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	// an empty window adds nothing
+	if err := c.Flush(time.Date(2026, 1, 1, 15, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"talkers.csv": "window_end,ip,bytes\n" +
+			"2026-01-01T13:00:00Z,1.1.1.1,6000\n" +
+			"2026-01-01T13:00:00Z,8.8.8.8,300\n" +
+			"2026-01-01T13:00:00Z,other,200\n" +
+			"2026-01-01T14:00:00Z,8.8.8.8,70\n",
+		"countries.csv": "window_end,country,direction,bytes\n" +
+			"2026-01-01T13:00:00Z,Australia,out,6000\n" +
+			"2026-01-01T13:00:00Z,United States,out,300\n" +
+			"2026-01-01T13:00:00Z,Switzerland,out,200\n" +
+			"2026-01-01T14:00:00Z,United States,out,70\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+}
+
+func TestCSVExporterExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "talkers.csv")
+	existing := "window_end,ip,bytes\n2025-12-31T23:00:00Z,8.8.8.8,10\n"
+	if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCSVExporter(dir, 5, 100)
+	c.Observe(outFlow("1.1.1.1", 443, 40))
+	if err := c.Flush(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// appended after the old rows, no second header
+	if want := existing + "2026-01-01T00:00:00Z,1.1.1.1,40\n"; string(got) != want {
+		t.Errorf("talkers.csv:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+)
+
+var (
+	debugFlows     = flag.Bool("debug", false, "Serve the last -debug-flows enriched flows as JSON on /debug/flows")
+	debugFlowsSize = flag.Int("debug-flows", 100, "Flows /debug/flows keeps")
+)
+
+// RecentFlows is a ring buffer of the last flows handed to the outputs
+type RecentFlows struct {
+	mu    sync.Mutex
+	flows []Flow
+	// where the next flow goes, the oldest once the buffer is full
+	next int
+	full bool
+}
+
+func NewRecentFlows(size int) *RecentFlows {
+	return &RecentFlows{flows: make([]Flow, size)}
+}
+
+// Add copies flow and its peers, the outputs may still change them
+func (r *RecentFlows) Add(flow *Flow) {
+	f := *flow
+	if f.Source != nil {
+		source := *f.Source
+		f.Source = &source
+	}
+	if f.Destination != nil {
+		destination := *f.Destination
+		f.Destination = &destination
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flows[r.next] = f
+	if r.next++; r.next == len(r.flows) {
+		r.next, r.full = 0, true
+	}
+}
+
+// Flows returns the kept flows, oldest first
+func (r *RecentFlows) Flows() []Flow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Flow{}, r.flows[:r.next]...)
+	}
+	return append(append([]Flow{}, r.flows[r.next:]...), r.flows[:r.next]...)
+}
+
+func (r *RecentFlows) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Flows())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+var directionCacheSize = flag.Int("direction-cache", 0, "Remember the direction of this many recent src,dst pairs, only pays off with many local addresses, 0 disables")
+
+// set in main with -direction-cache
+var directionCache *DirectionCache
+
+type directionKey struct {
+	src netaddr.IP
+	dst netaddr.IP
+}
+
+type directionEntry struct {
+	key       directionKey
+	direction string
+	method    string
+}
+
+// DirectionCache is an LRU of ResolveDirection results per address pair
+type DirectionCache struct {
+	max int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[directionKey]*list.Element
+}
+
+func NewDirectionCache(max int) *DirectionCache {
+	return &DirectionCache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[directionKey]*list.Element),
+	}
+}
+
+func (c *DirectionCache) Get(src, dst netaddr.IP) (direction, method string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[directionKey{src, dst}]
+	if !ok {
+		return "", "", false
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*directionEntry)
+	return entry.direction, entry.method, true
+}
+
+func (c *DirectionCache) Put(src, dst netaddr.IP, direction, method string) {
+	key := directionKey{src, dst}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*directionEntry)
+		entry.direction, entry.method = direction, method
+		return
+	}
+	if c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*directionEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&directionEntry{key, direction, method})
+}
+
+// Reset forgets every pair, to be called when what decides the direction
+// changes
+func (c *DirectionCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[directionKey]*list.Element)
+}
+
+func (c *DirectionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestDirectionCacheLRU(t *testing.T) {
+	c := NewDirectionCache(2)
+	a, b, x := netaddr.MustParseIP("10.0.0.1"), netaddr.MustParseIP("10.0.0.2"), netaddr.MustParseIP("8.8.8.8")
+	c.Put(a, x, "out", "ip")
+	c.Put(b, x, "out", "ip")
+	// a is used again, b becomes the oldest
+	if direction, method, ok := c.Get(a, x); !ok || direction != "out" || method != "ip" {
+		t.Errorf("hit %q %q %v", direction, method, ok)
+	}
+	c.Put(x, a, "in", "ip")
+
+	if _, _, ok := c.Get(b, x); ok {
+		t.Error("least recently used pair kept")
+	}
+	if _, _, ok := c.Get(a, x); !ok {
+		t.Error("recently used pair evicted")
+	}
+	// the reverse pair is its own entry
+	if direction, _, ok := c.Get(x, a); !ok || direction != "in" {
+		t.Errorf("reverse pair %q %v", direction, ok)
+	}
+	if c.Len() != 2 {
+		t.Errorf("%d entries, want 2", c.Len())
+	}
+
+	c.Put(a, x, "unknown", "default-unknown")
+	if direction, method, _ := c.Get(a, x); direction != "unknown" || method != "default-unknown" || c.Len() != 2 {
+		t.Errorf("updated to %q %q, %d entries", direction, method, c.Len())
+	}
+}
+
+func TestDirectionCacheReload(t *testing.T) {
+	cache := NewDirectionCache(16)
+	f := func() *Flow {
+		return &Flow{IpSrc: netaddr.MustParseIP("198.51.100.1"), IpDst: netaddr.MustParseIP("8.8.8.8")}
+	}
+
+	before := f()
+	classifyStage([]netaddr.IP{netaddr.MustParseIP("198.51.100.1")}, cache)(before)
+	if before.Direction != "out" {
+		t.Fatalf("direction %q, want out", before.Direction)
+	}
+
+	// the address is no longer local, the cached answer is stale until reset
+	classify := classifyStage(nil, cache)
+	stale := f()
+	classify(stale)
+	if stale.Direction != "out" {
+		t.Errorf("cache miss, direction %q", stale.Direction)
+	}
+	cache.Reset()
+	if cache.Len() != 0 {
+		t.Errorf("%d entries after reset", cache.Len())
+	}
+	fresh := f()
+	classify(fresh)
+	if fresh.Direction != "unknown" {
+		t.Errorf("direction after reset %q, want unknown", fresh.Direction)
+	}
+}
+
+func benchmarkClassify(b *testing.B, cache *DirectionCache) {
+	var localIps []netaddr.IP
+	for i := 0; i < 256; i++ {
+		localIps = append(localIps, netaddr.MustParseIP(fmt.Sprintf("198.51.100.%d", i)))
+	}
+	classify := classifyStage(localIps, cache)
+	// steady traffic of a few pairs
+	flows := make([]*Flow, 16)
+	for i := range flows {
+		flows[i] = &Flow{IpSrc: netaddr.MustParseIP(fmt.Sprintf("198.51.100.%d", 200+i)), IpDst: netaddr.MustParseIP("8.8.8.8")}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		classify(flows[i%len(flows)])
+	}
+}
+
+func BenchmarkClassify(b *testing.B) {
+	benchmarkClassify(b, nil)
+}
+
+func BenchmarkClassifyCached(b *testing.B) {
+	benchmarkClassify(b, NewDirectionCache(1024))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	dnsAnomaly         = flag.Bool("dns-anomaly", false, "Count DNS flows that look like tunneling in flow_dns_anomaly_bytes")
+	dnsMaxBytesPerFlow = flag.Int("dns-max-bytes-per-flow", 4096, "Bytes above which a single DNS flow counts as anomalous")
+	dnsResolverFlag    stringList
+)
+
+func init() {
+	flag.Var(&dnsResolverFlag, "dns-resolver", "Expected DNS resolver IP or CIDR, public DNS flows to others count as anomalous (repeatable, comma separated)")
+}
+
+var flowDNSAnomalyBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flow_dns_anomaly_bytes",
+		Help: "Bytes of DNS flows that are large (large) or use a resolver outside -dns-resolver (unexpected_resolver)",
+	},
+	[]string{"reason", "direction"},
+)
+
+// DNSAnomalyDetector flags port 53 flows moving more bytes than a query and
+// its answer would, or going to a resolver nobody configured. Both are
+// typical for DNS tunnels.
+type DNSAnomalyDetector struct {
+	maxBytes int
+	// empty disables the resolver check
+	resolvers []netaddr.IPPrefix
+}
+
+func NewDNSAnomalyDetector(maxBytes int, resolvers []netaddr.IPPrefix) *DNSAnomalyDetector {
+	return &DNSAnomalyDetector{maxBytes: maxBytes, resolvers: resolvers}
+}
+
+// dnsServer returns the port 53 end of a udp or tcp flow
+func dnsServer(flow *Flow) (netaddr.IP, bool) {
+	switch NormalizeProto(flow.Proto) {
+	case "udp", "tcp":
+	default:
+		return netaddr.IP{}, false
+	}
+	switch {
+	case flow.DstPort == 53:
+		return flow.IpDst, true
+	case flow.SrcPort == 53:
+		return flow.IpSrc, true
+	}
+	return netaddr.IP{}, false
+}
+
+// Classify returns why flow is anomalous, empty for benign or non DNS flows.
+// A flow that is both counts as unexpected_resolver.
+func (d *DNSAnomalyDetector) Classify(flow *Flow) string {
+	server, ok := dnsServer(flow)
+	if !ok {
+		return ""
+	}
+	// local resolvers, e.g. the router, are always expected
+	if len(d.resolvers) > 0 && !flow.Private && !containsPrefix(d.resolvers, server) {
+		return "unexpected_resolver"
+	}
+	if flow.Bytes > d.maxBytes {
+		return "large"
+	}
+	return ""
+}
+
+func (d *DNSAnomalyDetector) Observe(flow *Flow) {
+	if reason := d.Classify(flow); reason != "" {
+		flowDNSAnomalyBytes.With(prometheus.Labels{"reason": reason, "direction": flow.Direction}).Add(float64(flow.Bytes))
+	}
+}
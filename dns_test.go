@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestDNSAnomalyClassify(t *testing.T) {
+	d := NewDNSAnomalyDetector(4096, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("9.9.9.9/32"),
+		netaddr.MustParseIPPrefix("1.1.1.0/24"),
+	})
+	dns := func(proto, src string, srcPort int, dst string, dstPort int, bytes int) *Flow {
+		return &Flow{Proto: proto, IpSrc: netaddr.MustParseIP(src), SrcPort: srcPort,
+			IpDst: netaddr.MustParseIP(dst), DstPort: dstPort, Bytes: bytes}
+	}
+
+	tests := []struct {
+		name string
+		flow *Flow
+		want string
+	}{
+		{"query", dns("udp", "192.168.1.5", 50000, "9.9.9.9", 53, 80), ""},
+		{"answer", dns("17", "1.1.1.1", 53, "192.168.1.5", 50000, 512), ""},
+		{"zone transfer size over tcp", dns("tcp", "192.168.1.5", 50000, "9.9.9.9", 53, 64000), "large"},
+		{"tunnel to an allowed resolver", dns("udp", "192.168.1.5", 50000, "1.1.1.1", 53, 4097), "large"},
+		{"unexpected resolver", dns("udp", "192.168.1.5", 50000, "203.0.113.53", 53, 80), "unexpected_resolver"},
+		{"large to unexpected resolver", dns("udp", "203.0.113.53", 53, "192.168.1.5", 50000, 90000), "unexpected_resolver"},
+		{"at the limit", dns("udp", "192.168.1.5", 50000, "9.9.9.9", 53, 4096), ""},
+		{"not dns", dns("udp", "192.168.1.5", 50000, "203.0.113.53", 443, 90000), ""},
+		{"icmp", dns("icmp", "192.168.1.5", 0, "203.0.113.53", 53, 90000), ""},
+	}
+	for _, test := range tests {
+		if got := d.Classify(test.flow); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// the local router resolving for the LAN
+	router := dns("udp", "192.168.1.5", 50000, "192.168.1.1", 53, 100)
+	router.Private = true
+	if got := d.Classify(router); got != "" {
+		t.Errorf("local resolver: %q", got)
+	}
+}
+
+func TestDNSAnomalyObserve(t *testing.T) {
+	// no allow-list, only the size matters
+	d := NewDNSAnomalyDetector(1000, nil)
+	large := flowDNSAnomalyBytes.With(prometheus.Labels{"reason": "large", "direction": "out"})
+	before := testutil.ToFloat64(large)
+
+	for _, bytes := range []int{60, 900, 1200, 30000} {
+		d.Observe(&Flow{Proto: "udp", Direction: "out", IpSrc: netaddr.MustParseIP("192.168.1.5"),
+			IpDst: netaddr.MustParseIP("203.0.113.53"), DstPort: 53, Bytes: bytes})
+	}
+	if got := testutil.ToFloat64(large) - before; got != 31200 {
+		t.Errorf("flow_dns_anomaly_bytes{reason=large} grew by %v, want 31200", got)
+	}
+}
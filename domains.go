@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	domainGroupsFile = flag.String("domain-groups", "", `JSON file of domain groups, e.g. {"streaming": ["netflix.com", "nflxvideo.net"]}, adds the domain_group label`)
+	domainField      = flag.String("domain-field", "sni", "pmacct custom primitive holding the SNI or domain of a flow")
+)
+
+// DomainGroups maps domain suffixes to a group name
+type DomainGroups map[string]string
+
+var domainGroups DomainGroups
+
+func LoadDomainGroups(path string) (DomainGroups, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	groups := make(DomainGroups)
+	for group, domains := range raw {
+		for _, domain := range domains {
+			domain = normalizeDomain(domain)
+			if other, ok := groups[domain]; ok && other != group {
+				return nil, fmt.Errorf("%s: %s is in both %s and %s", path, domain, other, group)
+			}
+			groups[domain] = group
+		}
+	}
+	return groups, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Match returns the group of the longest configured suffix of domain, on
+// label boundaries, or other
+func (g DomainGroups) Match(domain string) string {
+	domain = normalizeDomain(domain)
+	for domain != "" {
+		if group, ok := g[domain]; ok {
+			return group
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return "other"
+}
+
+// domainStage sets the domain group of a flow
+func domainStage(groups DomainGroups) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		flow.DomainGroup = groups.Match(flow.Domain)
+		return true, nil
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestDomainGroupsMatch(t *testing.T) {
+	groups, err := LoadDomainGroups(writeTestFile(t, "domains.json", `{
+		"streaming": ["netflix.com", "nflxvideo.net", "video.example.com"],
+		"social": ["example.com"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		group  string
+	}{
+		{"netflix.com", "streaming"},
+		{"www.netflix.com", "streaming"},
+		{"ipv4-c001.1.nflxvideo.net", "streaming"},
+		{"WWW.Netflix.COM.", "streaming"},
+		// the longest suffix wins
+		{"cdn.video.example.com", "streaming"},
+		{"www.example.com", "social"},
+		// only on label boundaries
+		{"notnetflix.com", "other"},
+		{"netflix.com.evil.org", "other"},
+		{"com", "other"},
+		// no SNI in the flow
+		{"", "other"},
+	}
+	for _, test := range tests {
+		if got := groups.Match(test.domain); got != test.group {
+			t.Errorf("%q: %s, want %s", test.domain, got, test.group)
+		}
+	}
+}
+
+func TestLoadDomainGroupsConflict(t *testing.T) {
+	_, err := LoadDomainGroups(writeTestFile(t, "domains.json", `{"a": ["example.com"], "b": ["Example.com."]}`))
+	if err == nil {
+		t.Error("a domain in two groups loaded")
+	}
+}
+
+func TestDomainStage(t *testing.T) {
+	stage := domainStage(DomainGroups{"netflix.com": "streaming"})
+	for domain, group := range map[string]string{"www.netflix.com": "streaming", "example.org": "other"} {
+		f := &Flow{Domain: domain}
+		if keep, _ := stage(f); !keep || f.DomainGroup != group {
+			t.Errorf("%s: kept %v in group %q, want %s", domain, keep, f.DomainGroup, group)
+		}
+	}
+}
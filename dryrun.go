@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	dryRun      = flag.Bool("dry-run", false, "Print what becomes of each input line, the enriched flow or why it was skipped, instead of serving metrics")
+	dryRunLines = flag.Int("dry-run-lines", 10, "Lines -dry-run reads before exiting, 0 reads until the end of the input")
+)
+
+// DryRun hands the lines of source to PrintDryRun until it ends or maxLines
+// lines are read
+func DryRun(ctx context.Context, source FlowSource, pipeline Pipeline, w io.Writer, maxLines int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := 0
+	return source.Run(ctx, func(text string) {
+		// pmacctd prints its purge after being stopped
+		if ctx.Err() != nil {
+			return
+		}
+		n++
+		PrintDryRun(w, n, text, pipeline)
+		if maxLines > 0 && n >= maxLines {
+			cancel()
+		}
+	})
+}
+
+// PrintDryRun writes the nth input line and the flow MakeFlow makes of it,
+// with both peers as looked up, or why there is none
+func PrintDryRun(w io.Writer, n int, text string, pipeline Pipeline) {
+	fmt.Fprintf(w, "line %d: %s\n", n, text)
+	if !strings.HasPrefix(text, "{") {
+		fmt.Fprintln(w, "  not a flow")
+		return
+	}
+	flow, err := MakeFlow(text, pipeline)
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "  skipped: %v\n", err)
+		return
+	case flow == nil:
+		fmt.Fprintln(w, "  dropped by the pipeline")
+		return
+	}
+	out, err := json.MarshalIndent(flow, "  ", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "  %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "  %s\n", out)
+}
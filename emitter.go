@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	emitterRetries         = flag.Int("emitter-retries", 3, "Retries of a failed batch before an external emitter drops it")
+	emitterBackoff         = flag.Duration("emitter-backoff", time.Second, "Wait before the first retry, doubled on every further one")
+	emitterBackoffMax      = flag.Duration("emitter-backoff-max", 30*time.Second, "Max wait between retries")
+	emitterBreakerFailures = flag.Int("emitter-breaker-failures", 5, "Dropped batches in a row after which an emitter stops trying for -emitter-breaker-cooldown")
+	emitterBreakerCooldown = flag.Duration("emitter-breaker-cooldown", time.Minute, "How long an open breaker drops flows before the next attempt")
+)
+
+// failed writes an emitter logs per second, the first one right away
+const emitterWarnRate = 0.1
+
+// breaker states, the value of emitter_breaker_state
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+var (
+	emitterQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "emitter_queue_depth",
+			Help: "Items waiting to be sent by an external emitter",
+		},
+		[]string{"emitter"},
+	)
+	emitterDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emitter_dropped_total",
+			Help: "Items an external emitter dropped, by reason: queue_full, breaker_open or write",
+		},
+		[]string{"emitter", "reason"},
+	)
+	emitterRetriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "emitter_retries_total",
+			Help: "Retried batches of an external emitter",
+		},
+		[]string{"emitter"},
+	)
+	emitterBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "emitter_breaker_state",
+			Help: "Circuit breaker of an external emitter: 0 closed, 1 open, 2 half-open",
+		},
+		[]string{"emitter"},
+	)
+)
+
+// EmitterConfig holds the batching, retry and breaker settings of an
+// AsyncEmitter
+type EmitterConfig struct {
+	Queue           int
+	Batch           int
+	Flush           time.Duration
+	Retries         int
+	Backoff         time.Duration
+	BackoffMax      time.Duration
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// NewEmitterConfig takes the retry and breaker settings from the -emitter
+// flags
+func NewEmitterConfig(batch int, flush time.Duration) EmitterConfig {
+	return EmitterConfig{
+		Queue:           batch * 4,
+		Batch:           batch,
+		Flush:           flush,
+		Retries:         *emitterRetries,
+		Backoff:         *emitterBackoff,
+		BackoffMax:      *emitterBackoffMax,
+		BreakerFailures: *emitterBreakerFailures,
+		BreakerCooldown: *emitterBreakerCooldown,
+	}
+}
+
+// BackoffFor returns the wait before retry attempt (1 based)
+func (c EmitterConfig) BackoffFor(attempt int) time.Duration {
+	wait := c.Backoff
+	for i := 1; i < attempt && wait < c.BackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > c.BackoffMax {
+		wait = c.BackoffMax
+	}
+	return wait
+}
+
+// Breaker opens after a number of failures in a row and lets one attempt
+// through once the cooldown is over
+type Breaker struct {
+	failures int
+	cooldown time.Duration
+	onChange func(state int)
+
+	mu        sync.Mutex
+	state     int
+	failed    int
+	openUntil time.Time
+}
+
+func NewBreaker(failures int, cooldown time.Duration, onChange func(state int)) *Breaker {
+	return &Breaker{failures: failures, cooldown: cooldown, onChange: onChange}
+}
+
+func (b *Breaker) set(state int) {
+	if b.state != state {
+		b.state = state
+		if b.onChange != nil {
+			b.onChange(state)
+		}
+	}
+}
+
+// Allow reports whether an attempt may be made at now
+func (b *Breaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.set(breakerHalfOpen)
+	}
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed = 0
+	b.set(breakerClosed)
+}
+
+func (b *Breaker) Failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed++
+	if b.state == breakerHalfOpen || (b.failures > 0 && b.failed >= b.failures) {
+		b.openUntil = now.Add(b.cooldown)
+		b.set(breakerOpen)
+	}
+}
+
+func (b *Breaker) State() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// AsyncEmitter batches items for an external backend in the background.
+// Its queue is bounded and Enqueue never blocks: items are dropped when the
+// queue is full, while the breaker is open, or when a batch still fails
+// after all retries.
+type AsyncEmitter struct {
+	name   string
+	config EmitterConfig
+	send   func(batch []interface{}) error
+
+	breaker *Breaker
+	depth   prometheus.Gauge
+	// failed writes are logged at any level, but not for every retry
+	warnLimit *RateLimiter
+
+	queue   chan interface{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func NewAsyncEmitter(name string, config EmitterConfig, send func(batch []interface{}) error) *AsyncEmitter {
+	state := emitterBreakerState.With(prometheus.Labels{"emitter": name})
+	state.Set(breakerClosed)
+	e := &AsyncEmitter{
+		name:      name,
+		config:    config,
+		send:      send,
+		breaker:   NewBreaker(config.BreakerFailures, config.BreakerCooldown, func(s int) { state.Set(float64(s)) }),
+		depth:     emitterQueueDepth.With(prometheus.Labels{"emitter": name}),
+		warnLimit: NewRateLimiter(emitterWarnRate, time.Now()),
+		queue:     make(chan interface{}, config.Queue),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *AsyncEmitter) drop(reason string, n int) {
+	emitterDropped.With(prometheus.Labels{"emitter": e.name, "reason": reason}).Add(float64(n))
+}
+
+// Enqueue queues item without blocking
+func (e *AsyncEmitter) Enqueue(item interface{}) {
+	if !e.breaker.Allow(time.Now()) {
+		e.drop("breaker_open", 1)
+		return
+	}
+	select {
+	case e.queue <- item:
+		e.depth.Set(float64(len(e.queue)))
+	default:
+		e.drop("queue_full", 1)
+	}
+}
+
+// Close sends what is still queued, without retries, and stops the emitter
+func (e *AsyncEmitter) Close() {
+	close(e.closing)
+	close(e.queue)
+	<-e.done
+}
+
+func (e *AsyncEmitter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.config.Flush)
+	defer ticker.Stop()
+
+	var pending []interface{}
+	flush := func() {
+		if len(pending) > 0 {
+			e.deliver(pending)
+			pending = nil
+		}
+		e.depth.Set(float64(len(e.queue)))
+	}
+
+	for {
+		select {
+		case item, ok := <-e.queue:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, item)
+			if len(pending) >= e.config.Batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// deliver sends a batch, retrying with backoff while the breaker allows it
+func (e *AsyncEmitter) deliver(batch []interface{}) {
+	for attempt := 0; ; attempt++ {
+		if !e.breaker.Allow(time.Now()) {
+			e.drop("breaker_open", len(batch))
+			return
+		}
+		err := e.send(batch)
+		if err == nil {
+			e.breaker.Success()
+			return
+		}
+		if e.warnLimit.Allow(time.Now()) {
+			slog.Warn("write failed", "emitter", e.name, "err", err, "suppressed", e.warnLimit.Suppressed())
+		}
+
+		if attempt >= e.config.Retries || e.breaker.State() == breakerHalfOpen {
+			e.breaker.Failure(time.Now())
+			e.drop("write", len(batch))
+			return
+		}
+		emitterRetriesTotal.With(prometheus.Labels{"emitter": e.name}).Inc()
+		select {
+		case <-time.After(e.config.BackoffFor(attempt + 1)):
+		case <-e.closing:
+			e.drop("write", len(batch))
+			return
+		}
+	}
+}
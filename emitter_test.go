@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackoffFor(t *testing.T) {
+	c := EmitterConfig{Backoff: time.Second, BackoffMax: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if got := c.BackoffFor(attempt); got != want {
+			t.Errorf("attempt %d: %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var states []int
+	b := NewBreaker(2, time.Minute, func(state int) { states = append(states, state) })
+	now := time.Unix(0, 0)
+
+	b.Failure(now)
+	if !b.Allow(now) || b.State() != breakerClosed {
+		t.Fatalf("open after one failure")
+	}
+	// a success starts counting over
+	b.Success()
+	b.Failure(now)
+	if b.State() != breakerClosed {
+		t.Fatalf("failures before a success counted")
+	}
+	b.Failure(now)
+	if b.State() != breakerOpen || b.Allow(now.Add(59*time.Second)) {
+		t.Fatalf("not open after two failures in a row")
+	}
+
+	// one attempt after the cooldown, failing opens it right away
+	if !b.Allow(now.Add(time.Minute)) || b.State() != breakerHalfOpen {
+		t.Fatalf("not half-open after the cooldown")
+	}
+	b.Failure(now.Add(time.Minute))
+	if b.Allow(now.Add(90 * time.Second)) {
+		t.Fatalf("half-open failure didn't open the breaker")
+	}
+
+	b.Allow(now.Add(2 * time.Minute))
+	b.Success()
+	if b.State() != breakerClosed {
+		t.Errorf("not closed after a half-open success")
+	}
+	want := []int{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}
+	if len(states) != len(want) {
+		t.Fatalf("state changes %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("state changes %v, want %v", states, want)
+			break
+		}
+	}
+}
+
+func TestAsyncEmitterDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var sent int
+	e := NewAsyncEmitter("test-full", EmitterConfig{Queue: 2, Batch: 1, Flush: time.Hour}, func(batch []interface{}) error {
+		<-release
+		mu.Lock()
+		sent += len(batch)
+		mu.Unlock()
+		return nil
+	})
+	dropped := emitterDropped.With(prometheus.Labels{"emitter": "test-full", "reason": "queue_full"})
+
+	// the first item is taken into a batch stuck in send
+	e.Enqueue(0)
+	deadline := time.Now().Add(time.Second)
+	for len(e.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= 4; i++ {
+		e.Enqueue(i)
+	}
+	if got := testutil.ToFloat64(dropped); got != 2 {
+		t.Errorf("dropped %v with a full queue, want 2", got)
+	}
+
+	close(release)
+	e.Close()
+	if sent != 3 {
+		t.Errorf("sent %d, want 3", sent)
+	}
+}
+
+func TestAsyncEmitterRetriesAndOpens(t *testing.T) {
+	var attempts int
+	e := NewAsyncEmitter("test-retry", EmitterConfig{
+		Queue: 10, Batch: 1, Flush: time.Hour,
+		Retries: 2, Backoff: time.Millisecond, BackoffMax: time.Millisecond,
+		BreakerFailures: 1, BreakerCooldown: time.Hour,
+	}, func(batch []interface{}) error {
+		attempts++
+		return errors.New("unreachable")
+	})
+
+	e.Enqueue("a")
+	deadline := time.Now().Add(time.Second)
+	for e.breaker.State() != breakerOpen && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// dropped right away while the breaker is open
+	e.Enqueue("b")
+	e.Close()
+
+	if attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+	for reason, want := range map[string]float64{"write": 1, "breaker_open": 1} {
+		got := testutil.ToFloat64(emitterDropped.With(prometheus.Labels{"emitter": "test-retry", "reason": reason}))
+		if got != want {
+			t.Errorf("dropped for %s: %v, want %v", reason, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(emitterRetriesTotal.With(prometheus.Labels{"emitter": "test-retry"})); got != 2 {
+		t.Errorf("%v retries, want 2", got)
+	}
+	if got := testutil.ToFloat64(emitterBreakerState.With(prometheus.Labels{"emitter": "test-retry"})); got != breakerOpen {
+		t.Errorf("emitter_breaker_state %v, want open", got)
+	}
+}
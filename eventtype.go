@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var eventTypesFlag = flag.String("event-types", "purge", "Comma separated pmacct event_type values to count, e.g. purge,log, empty counts every record")
+
+// -event-types, nil counts every record
+var eventTypes map[string]bool
+
+var flowEventTypeSkipped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flow_event_type_skipped_total",
+		Help: "Records skipped by -event-types, by event_type",
+	},
+	[]string{"event_type"},
+)
+
+// ParseEventTypes parses -event-types
+func ParseEventTypes(spec string) map[string]bool {
+	var types map[string]bool
+	for _, value := range strings.Split(spec, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		if types == nil {
+			types = make(map[string]bool)
+		}
+		types[value] = true
+	}
+	return types
+}
+
+// eventStage drops records of other event types, pmacct streams log events
+// next to the purge of the same traffic, counting both doubles its bytes.
+// Records without event_type are kept, not every plugin writes it.
+func eventStage(types map[string]bool) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		if flow.EventType == "" || types[flow.EventType] {
+			return true, nil
+		}
+		flowEventTypeSkipped.With(prometheus.Labels{"event_type": flow.EventType}).Inc()
+		return false, nil
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rateInterval = flag.Duration("rate-interval", 0, "Expose the byte rate per direction computed every interval, e.g. 10s")
+	ewmaAlpha    = flag.Float64("ewma-alpha", 0.3, "Weight of the newest rate in flow_direction_bytes_ewma, 1 means no smoothing")
+)
+
+var (
+	flowDirectionRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "flow_direction_bytes_rate",
+			Help: "Bytes per second over the last -rate-interval",
+		},
+		[]string{"direction"},
+	)
+	flowDirectionEWMA = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "flow_direction_bytes_ewma",
+			Help: "Exponentially weighted moving average of flow_direction_bytes_rate, see -ewma-alpha",
+		},
+		[]string{"direction"},
+	)
+	flowPrivateRatio = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flow_private_ratio",
+			Help: "Fraction of the bytes of the last -rate-interval between private addresses",
+		},
+	)
+)
+
+// EWMA is an exponentially weighted moving average, seeded by its first value
+type EWMA struct {
+	alpha  float64
+	value  float64
+	seeded bool
+}
+
+func (e *EWMA) Update(x float64) float64 {
+	if !e.seeded {
+		e.value = x
+		e.seeded = true
+	} else {
+		e.value = e.alpha*x + (1-e.alpha)*e.value
+	}
+	return e.value
+}
+
+// RateTracker sums bytes per direction and private or public and turns
+// them into rates and the private ratio on every tick
+type RateTracker struct {
+	alpha float64
+
+	mu      sync.Mutex
+	bytes   map[string]float64
+	ewma    map[string]*EWMA
+	private float64
+	public  float64
+}
+
+func NewRateTracker(alpha float64) *RateTracker {
+	return &RateTracker{
+		alpha: alpha,
+		bytes: map[string]float64{"in": 0, "out": 0},
+		ewma:  make(map[string]*EWMA),
+	}
+}
+
+func (r *RateTracker) Observe(flow *Flow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if flow.Private {
+		r.private += float64(flow.Bytes)
+	} else {
+		r.public += float64(flow.Bytes)
+	}
+	if flow.Direction == "in" || flow.Direction == "out" {
+		r.bytes[flow.Direction] += float64(flow.Bytes)
+	}
+}
+
+// Tick updates the gauges with the bytes seen over elapsed
+func (r *RateTracker) Tick(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for direction, bytes := range r.bytes {
+		rate := bytes / elapsed.Seconds()
+		e, ok := r.ewma[direction]
+		if !ok {
+			e = &EWMA{alpha: r.alpha}
+			r.ewma[direction] = e
+		}
+		flowDirectionRate.With(prometheus.Labels{"direction": direction}).Set(rate)
+		flowDirectionEWMA.With(prometheus.Labels{"direction": direction}).Set(e.Update(rate))
+		r.bytes[direction] = 0
+	}
+
+	// an idle interval keeps the last ratio
+	if total := r.private + r.public; total > 0 {
+		flowPrivateRatio.Set(r.private / total)
+	}
+	r.private, r.public = 0, 0
+}
+
+// Run ticks every interval until stop is closed
+func (r *RateTracker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.Tick(now.Sub(last))
+			last = now
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEWMAStepConverges(t *testing.T) {
+	e := &EWMA{alpha: 0.3}
+	if got := e.Update(100); got != 100 {
+		t.Fatalf("seeded with %v, want 100", got)
+	}
+
+	// the rate steps from 100 to 1000, the distance shrinks by 1-alpha per update
+	var got float64
+	for i := 1; i <= 20; i++ {
+		got = e.Update(1000)
+		want := 1000 - 900*math.Pow(0.7, float64(i))
+		if math.Abs(got-want) > 1e-9 {
+			t.Fatalf("update %d: %v, want %v", i, got, want)
+		}
+	}
+	if 1000-got > 1 {
+		t.Errorf("not converged after 20 updates: %v", got)
+	}
+}
+
+func TestEWMAAlphaOne(t *testing.T) {
+	e := &EWMA{alpha: 1}
+	for _, x := range []float64{5, 500, 50} {
+		if got := e.Update(x); got != x {
+			t.Errorf("%v smoothed to %v with alpha 1", x, got)
+		}
+	}
+}
+
+func TestRateTrackerTick(t *testing.T) {
+	r := NewRateTracker(0.5)
+	rate := flowDirectionRate.With(prometheus.Labels{"direction": "in"})
+	ewma := flowDirectionEWMA.With(prometheus.Labels{"direction": "in"})
+
+	steps := []struct {
+		bytes      int
+		rate, ewma float64
+	}{
+		{1000, 100, 100},
+		{5000, 500, 300},
+		{5000, 500, 400},
+		// an idle interval is a rate of 0
+		{0, 0, 200},
+	}
+	for i, step := range steps {
+		if step.bytes > 0 {
+			r.Observe(&Flow{Direction: "in", Bytes: step.bytes})
+		}
+		r.Observe(&Flow{Direction: "unknown", Bytes: 99})
+		r.Tick(10 * time.Second)
+		if got := testutil.ToFloat64(rate); got != step.rate {
+			t.Errorf("tick %d: rate %v, want %v", i, got, step.rate)
+		}
+		if got := testutil.ToFloat64(ewma); got != step.ewma {
+			t.Errorf("tick %d: ewma %v, want %v", i, got, step.ewma)
+		}
+	}
+}
+
+func TestRateTrackerPrivateRatio(t *testing.T) {
+	r := NewRateTracker(1)
+	windows := []struct {
+		flows []*Flow
+		ratio float64
+	}{
+		{[]*Flow{
+			{Direction: "in", Bytes: 300, Private: true},
+			{Direction: "out", Bytes: 100},
+		}, 0.75},
+		// flows of unknown direction count too
+		{[]*Flow{
+			{Direction: "unknown", Bytes: 100, Private: true},
+			{Direction: "in", Bytes: 800},
+			{Direction: "out", Bytes: 100},
+		}, 0.1},
+		{[]*Flow{{Direction: "in", Bytes: 5}}, 0},
+		// an idle window keeps the last ratio
+		{nil, 0},
+		{[]*Flow{{Direction: "unknown", Bytes: 5, Private: true}}, 1},
+	}
+	for i, window := range windows {
+		for _, f := range window.flows {
+			r.Observe(f)
+		}
+		r.Tick(time.Second)
+		if got := testutil.ToFloat64(flowPrivateRatio); got != window.ratio {
+			t.Errorf("window %d: private ratio %v, want %v", i, got, window.ratio)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var fieldMapFile = flag.String("field-map", "", `JSON file renaming fields of the input to those pmacct prints by default, e.g. {"src_host": "ip_src", "packet_count": "packets"}`)
+
+// -field-map, input field name to flow field name
+var fieldMap map[string]string
+
+// flowFields returns the JSON names of the fields a flow line fills in
+func flowFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Flow{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func LoadFieldMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	known := flowFields()
+	mappedTo := make(map[string]string, len(fields))
+	for from, to := range fields {
+		if !known[to] {
+			names := make([]string, 0, len(known))
+			for name := range known {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("%s: %s is mapped to unknown field %q, known are %s", path, from, to, strings.Join(names, ", "))
+		}
+		if other, ok := mappedTo[to]; ok {
+			return nil, fmt.Errorf("%s: both %s and %s are mapped to %s", path, other, from, to)
+		}
+		mappedTo[to] = from
+	}
+	return fields, nil
+}
+
+// inputField returns the name field has in the input, see -field-map
+func inputField(field string) string {
+	for from, to := range fieldMap {
+		if to == field {
+			return from
+		}
+	}
+	return field
+}
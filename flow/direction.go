@@ -0,0 +1,109 @@
+package flow
+
+import "inet.af/netaddr"
+
+// Sense maps a direction to the side that sent the bytes: in is
+// remote_to_local (RX), out is local_to_remote (TX)
+func Sense(direction string) string {
+	switch direction {
+	case "in":
+		return "remote_to_local"
+	case "out":
+		return "local_to_remote"
+	}
+	return direction
+}
+
+func GetDirection(f Flow, localIps []netaddr.IP, localNetworks []netaddr.IPPrefix) string {
+	direction, _ := ResolveDirection(f, localIps, localNetworks)
+	return direction
+}
+
+// ResolveDirection returns the direction and the method that decided it,
+// see flow_direction_resolution_total. Local addresses win over local
+// networks.
+func ResolveDirection(f Flow, localIps []netaddr.IP, localNetworks []netaddr.IPPrefix) (direction string, method string) {
+	if ContainsIP(localIps, f.IpDst) {
+		return "in", "ip"
+	}
+	if ContainsIP(localIps, f.IpSrc) {
+		return "out", "ip"
+	}
+	if ContainsPrefix(localNetworks, f.IpDst) {
+		return "in", "network"
+	}
+	if ContainsPrefix(localNetworks, f.IpSrc) {
+		return "out", "network"
+	}
+	return "unknown", "default-unknown"
+}
+
+// ResolveGatewayDirection decides the direction for an exporter routing
+// between its local networks and the WAN: in enters from the WAN, out
+// leaves to it. The own addresses and the local networks are inside,
+// everything else is behind the WAN. Flows staying on one side are unknown,
+// by method internal or transit.
+func ResolveGatewayDirection(f Flow, localIps []netaddr.IP, localNetworks []netaddr.IPPrefix) (direction string, method string) {
+	srcInside := ContainsIP(localIps, f.IpSrc) || ContainsPrefix(localNetworks, f.IpSrc)
+	dstInside := ContainsIP(localIps, f.IpDst) || ContainsPrefix(localNetworks, f.IpDst)
+	switch {
+	case dstInside && !srcInside:
+		return "in", "gateway"
+	case srcInside && !dstInside:
+		return "out", "gateway"
+	case srcInside:
+		return "unknown", "internal"
+	}
+	return "unknown", "transit"
+}
+
+// ResolveHairpin decides flows with a hairpin NAT address at one end, the
+// public address of a local service. Reached from a private or local
+// address, the flow never left the network: unknown, by method hairpin.
+// From outside the hairpin address is local, the flow is in or out. ok is
+// false for flows without a hairpin address.
+func ResolveHairpin(f Flow, hairpinIps, localIps []netaddr.IP, localNetworks []netaddr.IPPrefix) (direction string, method string, ok bool) {
+	srcHairpin, dstHairpin := ContainsIP(hairpinIps, f.IpSrc), ContainsIP(hairpinIps, f.IpDst)
+	if !srcHairpin && !dstHairpin {
+		return "", "", false
+	}
+	other := f.IpSrc
+	if srcHairpin {
+		other = f.IpDst
+	}
+	if (srcHairpin && dstHairpin) || IsPrivate(other, nil) || ContainsIP(localIps, other) || ContainsPrefix(localNetworks, other) {
+		return "unknown", "hairpin", true
+	}
+	if dstHairpin {
+		return "in", "hairpin", true
+	}
+	return "out", "hairpin", true
+}
+
+// Canonical is the form addresses are compared in: IPv4-mapped IPv6 as
+// plain IPv4 and without an IPv6 zone. pmacct prints fe80::1 where the
+// interface list has fe80::1%eth0, and ::ffff:10.0.0.1 for 10.0.0.1 on dual
+// stack sockets.
+func Canonical(ip netaddr.IP) netaddr.IP {
+	return ip.Unmap().WithZone("")
+}
+
+func ContainsIP(ips []netaddr.IP, ip netaddr.IP) bool {
+	ip = Canonical(ip)
+	for _, ip1 := range ips {
+		if Canonical(ip1) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func ContainsPrefix(prefixes []netaddr.IPPrefix, ip netaddr.IP) bool {
+	ip = Canonical(ip)
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
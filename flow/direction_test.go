@@ -0,0 +1,89 @@
+package flow
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestResolveHairpin(t *testing.T) {
+	hairpin := []netaddr.IP{netaddr.MustParseIP("203.0.113.7")}
+	localIps := []netaddr.IP{netaddr.MustParseIP("198.51.100.1")}
+	localNetworks := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.0/24")}
+
+	tests := []struct {
+		src, dst  string
+		direction string
+		method    string
+		ok        bool
+	}{
+		// LAN client to the local server's public address and back
+		{"192.168.1.20", "203.0.113.7", "unknown", "hairpin", true},
+		{"203.0.113.7", "192.168.1.20", "unknown", "hairpin", true},
+		{"100.64.0.5", "203.0.113.7", "unknown", "hairpin", true},
+		{"198.51.100.1", "203.0.113.7", "unknown", "hairpin", true},
+		// the internet reaching the service
+		{"8.8.8.8", "203.0.113.7", "in", "hairpin", true},
+		{"203.0.113.7", "8.8.8.8", "out", "hairpin", true},
+		{"192.168.1.20", "8.8.8.8", "", "", false},
+	}
+	for _, test := range tests {
+		f := Flow{IpSrc: netaddr.MustParseIP(test.src), IpDst: netaddr.MustParseIP(test.dst)}
+		direction, method, ok := ResolveHairpin(f, hairpin, localIps, localNetworks)
+		if direction != test.direction || method != test.method || ok != test.ok {
+			t.Errorf("%s -> %s: %q %q %v, want %q %q %v", test.src, test.dst,
+				direction, method, ok, test.direction, test.method, test.ok)
+		}
+	}
+}
+
+func TestResolveDirection(t *testing.T) {
+	localIps := []netaddr.IP{netaddr.MustParseIP("198.51.100.1"), netaddr.MustParseIP("2001:db8::1")}
+	localNetworks := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")}
+
+	tests := []struct {
+		src, dst  string
+		direction string
+		method    string
+	}{
+		{"8.8.8.8", "198.51.100.1", "in", "ip"},
+		{"198.51.100.1", "8.8.8.8", "out", "ip"},
+		{"2606:4700::1111", "2001:db8::1", "in", "ip"},
+		{"8.8.8.8", "192.168.1.20", "in", "network"},
+		{"192.168.1.20", "8.8.8.8", "out", "network"},
+		// a local address wins over a local network
+		{"198.51.100.1", "192.168.1.20", "out", "ip"},
+		{"8.8.8.8", "1.1.1.1", "unknown", "default-unknown"},
+		{"192.168.2.1", "10.0.0.1", "unknown", "default-unknown"},
+	}
+	for _, test := range tests {
+		f := Flow{IpSrc: netaddr.MustParseIP(test.src), IpDst: netaddr.MustParseIP(test.dst)}
+		direction, method := ResolveDirection(f, localIps, localNetworks)
+		if direction != test.direction || method != test.method {
+			t.Errorf("%s -> %s: %q %q, want %q %q", test.src, test.dst, direction, method, test.direction, test.method)
+		}
+		if got := GetDirection(f, localIps, localNetworks); got != test.direction {
+			t.Errorf("%s -> %s: GetDirection %q, want %q", test.src, test.dst, got, test.direction)
+		}
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"192.168.1.20", "10.0.0.1", "private"},
+		{"fd00::1", "fe80::1", "private"},
+		{"192.168.1.20", "8.8.8.8", "mixed"},
+		{"2606:4700::1111", "fd00::1", "mixed"},
+		{"8.8.8.8", "1.1.1.1", "public"},
+		{"::ffff:8.8.8.8", "2606:4700::1111", "public"},
+	}
+	for _, test := range tests {
+		src, dst := netaddr.MustParseIP(test.src), netaddr.MustParseIP(test.dst)
+		if got := Privacy(IsPrivate(src, nil), IsPrivate(dst, nil)); got != test.want {
+			t.Errorf("%s -> %s: %q, want %q", test.src, test.dst, got, test.want)
+		}
+	}
+}
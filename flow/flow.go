@@ -0,0 +1,111 @@
+// Package flow holds the pmacct flow types and the parts of parsing and
+// enrichment that depend on nothing but their arguments: MakeFlow and
+// MakePeer, direction, private address classification and geo lookup.
+package flow
+
+import (
+	"encoding/json"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// {"event_type": "purge", "ip_src": "10.0.1.1", "ip_dst": "10.0.2.1", "packets": 2, "bytes": 143}
+type Flow struct {
+	EventType   string `json:"event_type"`
+	IpSrcRaw    string `json:"ip_src"`
+	IpDstRaw    string `json:"ip_dst"`
+	IpSrc       netaddr.IP
+	IpDst       netaddr.IP
+	SrcPort     int    `json:"port_src"`
+	DstPort     int    `json:"port_dst"`
+	Packages    int    `json:"packets"`
+	Bytes       int    `json:"bytes"`
+	Proto       string `json:"proto"`
+	Label       string `json:"label"`
+	ExporterRaw string `json:"peer_ip_src"`
+	Exporter    string
+	Direction   string
+	Private     bool
+	PrivateRaw  string
+	Source      *Peer
+	Destination *Peer
+
+	// raw time fields, parsed into Timestamp according to -timestamp-field
+	TimestampStartRaw JSONScalar `json:"timestamp_start"`
+	TimestampEndRaw   JSONScalar `json:"timestamp_end"`
+	StampInsertedRaw  JSONScalar `json:"stamp_inserted"`
+	StampUpdatedRaw   JSONScalar `json:"stamp_updated"`
+	Timestamp         time.Time
+
+	// -domain-field and its -domain-groups group
+	Domain      string `json:"-"`
+	DomainGroup string `json:"-"`
+
+	// -fragment-field
+	Fragmented bool `json:"-"`
+
+	// -replay file the flow was read from
+	SourceFile string `json:"-"`
+}
+type Peer struct {
+	Ip         netaddr.IP
+	Country    string
+	CountryISO string
+	City       string
+	Asn        string
+	AsnOrg     string
+	Latitude   float64
+	Longitude  float64
+	SpecialUse string
+	// PTR name with -resolve-ptr
+	Hostname string
+
+	// continent name and its two letter code, e.g. Europe and EU
+	Continent     string
+	ContinentCode string
+
+	// from the GeoIP2-ISP and GeoIP2-Connection-Type databases, e.g.
+	// Cablevision and Cable/DSL
+	Isp            string
+	ConnectionType string
+}
+
+// JSONScalar keeps a JSON string or number as text
+type JSONScalar string
+
+func (s *JSONScalar) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = JSONScalar(text)
+		return nil
+	}
+	if string(data) == "null" {
+		*s = ""
+		return nil
+	}
+	*s = JSONScalar(data)
+	return nil
+}
+
+// RemotePeer returns the non local end of an in or out flow, nil otherwise
+func (f *Flow) RemotePeer() *Peer {
+	switch f.Direction {
+	case "in":
+		return f.Source
+	case "out":
+		return f.Destination
+	}
+	return nil
+}
+
+// LocalIP returns the local end of an in or out flow, the zero IP otherwise
+func (f *Flow) LocalIP() netaddr.IP {
+	switch f.Direction {
+	case "in":
+		return f.IpDst
+	case "out":
+		return f.IpSrc
+	}
+	return netaddr.IP{}
+}
@@ -0,0 +1,134 @@
+package flow
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/oschwald/geoip2-golang"
+	"inet.af/netaddr"
+)
+
+// GeoReader looks up addresses, *geoip2.Reader is one
+type GeoReader interface {
+	City(ip net.IP) (*geoip2.City, error)
+	ASN(ip net.IP) (*geoip2.ASN, error)
+	ISP(ip net.IP) (*geoip2.ISP, error)
+	ConnectionType(ip net.IP) (*geoip2.ConnectionType, error)
+}
+
+// Databases are what Locate looks up in, every one may be nil
+type Databases struct {
+	City           GeoReader
+	ASN            GeoReader
+	ISP            GeoReader
+	ConnectionType GeoReader
+}
+
+// Lookup tells how locating a peer went
+type Lookup struct {
+	// lookups that returned an error
+	Failed int
+	// an answer for an address that is not global was thrown away
+	Discarded bool
+}
+
+// MakePeer parses ipRaw and locates it in dbs with names in lang
+func MakePeer(ipRaw string, dbs Databases, lang string) (*Peer, Lookup, error) {
+	ip, err := netaddr.ParseIP(ipRaw)
+	if err != nil {
+		return nil, Lookup{}, err
+	}
+	ip = Canonical(ip)
+
+	p := &Peer{Ip: ip, SpecialUse: SpecialUseName(ip)}
+	var lookup Lookup
+	lookup.Failed, lookup.Discarded = Locate(p, dbs, lang)
+	return p, lookup, nil
+}
+
+// Name picks the name in lang from localized names, else the English one,
+// else the first by language code
+func Name(names map[string]string, lang string) string {
+	if name, ok := names[lang]; ok {
+		return name
+	}
+	if name, ok := names["en"]; ok {
+		return name
+	}
+	langs := make([]string, 0, len(names))
+	for l := range names {
+		langs = append(langs, l)
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	sort.Strings(langs)
+	return names[langs[0]]
+}
+
+// Locate fills in the location, ASN, ISP and connection type of p.Ip from
+// dbs, with names in lang. It returns how many lookups failed, and whether
+// an answer for an address that is not global was thrown away.
+func Locate(p *Peer, dbs Databases, lang string) (failed int, discarded bool) {
+	// the databases key IPv4 by its plain form, ::ffff:a.b.c.d misses
+	lookup := p.Ip.Unmap().IPAddr().IP
+
+	if dbs.City != nil {
+		record, err := dbs.City.City(lookup)
+		if err != nil {
+			failed++
+		}
+		if record != nil {
+			p.Country = Name(record.Country.Names, lang)
+			p.CountryISO = record.Country.IsoCode
+			p.City = Name(record.City.Names, lang)
+			p.Continent = Name(record.Continent.Names, lang)
+			p.ContinentCode = record.Continent.Code
+			p.Latitude = record.Location.Latitude
+			p.Longitude = record.Location.Longitude
+		}
+	}
+
+	if dbs.ASN != nil {
+		record, err := dbs.ASN.ASN(lookup)
+		if err != nil {
+			failed++
+		}
+		if record != nil {
+			p.Asn = strconv.FormatUint(uint64(record.AutonomousSystemNumber), 10)
+			p.AsnOrg = record.AutonomousSystemOrganization
+		}
+	}
+
+	if dbs.ISP != nil {
+		record, err := dbs.ISP.ISP(lookup)
+		if err != nil {
+			failed++
+		}
+		if record != nil {
+			p.Isp = record.ISP
+		}
+	}
+
+	if dbs.ConnectionType != nil {
+		record, err := dbs.ConnectionType.ConnectionType(lookup)
+		if err != nil {
+			failed++
+		}
+		if record != nil {
+			p.ConnectionType = record.ConnectionType
+		}
+	}
+
+	// a misbuilt database can answer for private addresses, their location is
+	// meaningless
+	if !IsGlobal(p.Ip) && (p.Country != "" || p.Continent != "" || p.City != "" || p.AsnOrg != "" || (p.Asn != "" && p.Asn != "0") || p.Isp != "") {
+		p.Country, p.CountryISO, p.City, p.Asn, p.AsnOrg = "", "", "", "", ""
+		p.Continent, p.ContinentCode = "", ""
+		p.Isp, p.ConnectionType = "", ""
+		p.Latitude, p.Longitude = 0, 0
+		discarded = true
+	}
+	return failed, discarded
+}
@@ -0,0 +1,179 @@
+package flow
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+	"inet.af/netaddr"
+)
+
+type stubRecord struct {
+	country, iso, city string
+	asn                uint
+	asnOrg             string
+}
+
+// stubGeoReader answers for addresses in exactly the byte form of its
+// keys, like a database keying IPv4 by its 4 byte form
+type stubGeoReader map[string]stubRecord
+
+func (r stubGeoReader) record(ip net.IP) (stubRecord, error) {
+	record, ok := r[string(ip)]
+	if !ok {
+		return stubRecord{}, errors.New("not found")
+	}
+	return record, nil
+}
+
+func (r stubGeoReader) City(ip net.IP) (*geoip2.City, error) {
+	record, err := r.record(ip)
+	if err != nil {
+		return nil, err
+	}
+	city := &geoip2.City{}
+	city.Country.Names = map[string]string{"en": record.country}
+	city.Country.IsoCode = record.iso
+	city.City.Names = map[string]string{"en": record.city}
+	return city, nil
+}
+
+func (r stubGeoReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	record, err := r.record(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &geoip2.ASN{AutonomousSystemNumber: record.asn, AutonomousSystemOrganization: record.asnOrg}, nil
+}
+
+func (r stubGeoReader) ISP(ip net.IP) (*geoip2.ISP, error) {
+	return nil, errors.New("no ISP database")
+}
+
+func (r stubGeoReader) ConnectionType(ip net.IP) (*geoip2.ConnectionType, error) {
+	return nil, errors.New("no connection type database")
+}
+
+var testGeo = stubGeoReader{
+	string(net.ParseIP("8.8.8.8").To4()):   {"United States", "US", "", 15169, "Google LLC"},
+	string(net.ParseIP("2001:4860::8888")): {"United States", "US", "", 15169, "Google LLC"},
+	string(net.ParseIP("10.0.0.1").To4()):  {"Atlantis", "AT", "", 64500, "Misbuilt"},
+}
+
+func TestLocateMappedIPv4(t *testing.T) {
+	dbs := Databases{City: testGeo, ASN: testGeo}
+	plain := &Peer{Ip: netaddr.MustParseIP("8.8.8.8")}
+	mapped := &Peer{Ip: netaddr.MustParseIP("::ffff:8.8.8.8")}
+	for _, p := range []*Peer{plain, mapped} {
+		if failed, _ := Locate(p, dbs, "en"); failed != 0 {
+			t.Errorf("%s: %d failed lookups", p.Ip, failed)
+		}
+	}
+	mapped.Ip = plain.Ip
+	if *mapped != *plain {
+		t.Errorf("mapped %+v, plain %+v", *mapped, *plain)
+	}
+	if plain.Country != "United States" || plain.Asn != "15169" || plain.AsnOrg != "Google LLC" {
+		t.Errorf("located %+v", *plain)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	dbs := Databases{City: testGeo, ASN: testGeo}
+
+	p := &Peer{Ip: netaddr.MustParseIP("2001:4860::8888")}
+	if failed, discarded := Locate(p, dbs, "en"); failed != 0 || discarded || p.CountryISO != "US" || p.Asn != "15169" {
+		t.Errorf("%s: %+v, failed %d, discarded %v", p.Ip, *p, failed, discarded)
+	}
+
+	p = &Peer{Ip: netaddr.MustParseIP("9.9.9.9")}
+	if failed, _ := Locate(p, dbs, "en"); failed != 2 || p.Country != "" {
+		t.Errorf("%s: %+v, failed %d, want 2", p.Ip, *p, failed)
+	}
+
+	// a database answering for a private address
+	p = &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}
+	if _, discarded := Locate(p, dbs, "en"); !discarded || p.Country != "" || p.Asn != "" {
+		t.Errorf("%s: %+v, discarded %v", p.Ip, *p, discarded)
+	}
+
+	// no databases
+	p = &Peer{Ip: netaddr.MustParseIP("8.8.8.8")}
+	if failed, _ := Locate(p, Databases{}, "en"); failed != 0 || p.Country != "" {
+		t.Errorf("without databases: %+v, failed %d", *p, failed)
+	}
+}
+
+func TestLocateDiscardsPrivate(t *testing.T) {
+	// a misbuilt database with answers for every address
+	misbuilt := stubGeoReader{}
+	for _, raw := range []string{"10.1.2.3", "192.168.1.10", "100.64.0.1", "fd00::1", "8.8.8.8"} {
+		ip := net.ParseIP(raw)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		misbuilt[string(ip)] = stubRecord{"Atlantis", "AT", "Poseidonia", 64500, "Misbuilt"}
+	}
+	dbs := Databases{City: misbuilt, ASN: misbuilt}
+
+	for _, raw := range []string{"10.1.2.3", "192.168.1.10", "100.64.0.1", "fd00::1", "::ffff:192.168.1.10"} {
+		p := &Peer{Ip: netaddr.MustParseIP(raw)}
+		_, discarded := Locate(p, dbs, "en")
+		if !discarded || *p != (Peer{Ip: p.Ip}) {
+			t.Errorf("%s: %+v, discarded %v", raw, *p, discarded)
+		}
+	}
+
+	p := &Peer{Ip: netaddr.MustParseIP("8.8.8.8")}
+	if _, discarded := Locate(p, dbs, "en"); discarded || p.Country != "Atlantis" || p.City != "Poseidonia" {
+		t.Errorf("public %+v, discarded %v", *p, discarded)
+	}
+
+	// nothing found is nothing to discard
+	p = &Peer{Ip: netaddr.MustParseIP("172.16.0.1")}
+	if _, discarded := Locate(p, dbs, "en"); discarded {
+		t.Errorf("%s without answers discarded", p.Ip)
+	}
+}
+
+func TestMakePeer(t *testing.T) {
+	dbs := Databases{City: testGeo, ASN: testGeo}
+	tests := []struct {
+		raw  string
+		want Peer
+	}{
+		{"8.8.8.8", Peer{Country: "United States", CountryISO: "US", Asn: "15169", AsnOrg: "Google LLC", SpecialUse: "none"}},
+		{"::ffff:8.8.8.8", Peer{Country: "United States", CountryISO: "US", Asn: "15169", AsnOrg: "Google LLC", SpecialUse: "none"}},
+		{"10.0.0.1", Peer{SpecialUse: "private-use"}},
+		{"192.0.2.1", Peer{SpecialUse: "documentation"}},
+	}
+	for _, test := range tests {
+		p, _, err := MakePeer(test.raw, dbs, "en")
+		if err != nil {
+			t.Errorf("%s: %v", test.raw, err)
+			continue
+		}
+		test.want.Ip = p.Ip
+		if *p != test.want {
+			t.Errorf("%s: %+v, want %+v", test.raw, *p, test.want)
+		}
+	}
+
+	p, lookup, _ := MakePeer("::ffff:8.8.8.8", dbs, "en")
+	if p.Ip != netaddr.MustParseIP("8.8.8.8") || lookup != (Lookup{}) {
+		t.Errorf("mapped address %s, %+v", p.Ip, lookup)
+	}
+	if _, lookup, _ := MakePeer("10.0.0.1", dbs, "en"); !lookup.Discarded {
+		t.Errorf("answer for a private address kept, %+v", lookup)
+	}
+	if _, lookup, _ := MakePeer("9.9.9.9", dbs, "en"); lookup.Failed != 2 {
+		t.Errorf("unknown address %+v, want 2 failed", lookup)
+	}
+
+	for _, raw := range []string{"", "10.0.0", "example.com", "10.0.0.1/24"} {
+		if p, _, err := MakePeer(raw, dbs, "en"); err == nil {
+			t.Errorf("%q parsed as %+v", raw, *p)
+		}
+	}
+}
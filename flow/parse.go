@@ -0,0 +1,205 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseOptions say how MakeFlow reads a line, filled from -field-map,
+// -timestamp-field, -timestamp-unit, -domain-field and -fragment-field
+type ParseOptions struct {
+	// input field name to Flow field name
+	FieldMap       map[string]string
+	TimestampField string
+	TimestampUnit  string
+	// fields Flow has no member for, read into Domain and Fragmented.
+	// Empty skips them.
+	DomainField   string
+	FragmentField string
+}
+
+// ParseError is a line MakeFlow failed on, Reason is json or timestamp
+type ParseError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MakeFlow parses a pmacct JSON line. The addresses are left raw, MakePeer
+// parses and locates them.
+func MakeFlow(text string, opts ParseOptions) (*Flow, error) {
+	f := &Flow{}
+	if err := Unmarshal(text, f, opts.FieldMap); err != nil {
+		return nil, &ParseError{"json", err}
+	}
+
+	// a timestamp not parsing as the unit drops the flow like broken JSON
+	timestamp, err := lineTimestamp(text, f, opts.TimestampField, opts.TimestampUnit)
+	if err != nil {
+		return nil, &ParseError{"timestamp", err}
+	}
+	f.Timestamp = timestamp
+
+	if opts.DomainField != "" {
+		domain, err := lineField(text, opts.DomainField)
+		if err != nil {
+			return nil, &ParseError{"json", err}
+		}
+		f.Domain = string(domain)
+	}
+
+	if opts.FragmentField != "" {
+		value, err := lineField(text, opts.FragmentField)
+		if err != nil {
+			return nil, &ParseError{"json", err}
+		}
+		f.Fragmented = IsTruthy(string(value))
+	}
+	return f, nil
+}
+
+// Unmarshal decodes a flow line into f, renaming its fields by fields
+// first. A renamed field wins over one of the same name in the line.
+func Unmarshal(text string, f *Flow, fields map[string]string) error {
+	if fields == nil {
+		return json.Unmarshal([]byte(text), f)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &raw); err != nil {
+		return err
+	}
+	renamed := make(map[string]json.RawMessage, len(raw))
+	for name, value := range raw {
+		if _, ok := fields[name]; !ok {
+			renamed[name] = value
+		}
+	}
+	for from, to := range fields {
+		if value, ok := raw[from]; ok {
+			renamed[to] = value
+		}
+	}
+	data, err := json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, f)
+}
+
+// IsTruthy reads a flag primitive, absent, empty, 0 and false are false
+func IsTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "0", "false", "no":
+		return false
+	}
+	return true
+}
+
+// TimestampFields are tried by timestamp field auto, most precise first
+var TimestampFields = []string{"timestamp_end", "timestamp_start", "stamp_updated", "stamp_inserted"}
+
+// pmacct's format unless timestamps_since_epoch is set
+const pmacctTimeLayout = "2006-01-02 15:04:05.999999"
+
+// ParseTimestamp parses a time in unit: auto, s, ms, us, ns, rfc3339 or
+// pmacct
+func ParseTimestamp(value string, unit string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty timestamp")
+	}
+
+	switch unit {
+	case "rfc3339":
+		return time.Parse(time.RFC3339Nano, value)
+	case "pmacct":
+		return time.ParseInLocation(pmacctTimeLayout, value, time.Local)
+	case "s", "ms", "us", "ns":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return epochTime(n, unit), nil
+	case "auto":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return epochTime(n, guessEpochUnit(n)), nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, nil
+		}
+		return time.ParseInLocation(pmacctTimeLayout, value, time.Local)
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp unit %q", unit)
+}
+
+// guessEpochUnit picks the unit that puts n between 1973 and 5138
+func guessEpochUnit(n float64) string {
+	switch {
+	case n < 1e11:
+		return "s"
+	case n < 1e14:
+		return "ms"
+	case n < 1e17:
+		return "us"
+	}
+	return "ns"
+}
+
+func epochTime(n float64, unit string) time.Time {
+	scale := map[string]float64{"s": 1e9, "ms": 1e6, "us": 1e3, "ns": 1}[unit]
+	sec, frac := math.Modf(n * scale / 1e9)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// lineField returns a field of a flow line Flow has no member for, like a
+// custom primitive. It needs its own pass over the line.
+func lineField(text string, field string) (JSONScalar, error) {
+	var fields map[string]JSONScalar
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return "", err
+	}
+	return fields[field], nil
+}
+
+// lineTimestamp finds and parses the timestamp field of a flow line, a zero
+// time if there is none
+func lineTimestamp(text string, f *Flow, field, unit string) (time.Time, error) {
+	known := map[string]JSONScalar{
+		"timestamp_end":   f.TimestampEndRaw,
+		"timestamp_start": f.TimestampStartRaw,
+		"stamp_updated":   f.StampUpdatedRaw,
+		"stamp_inserted":  f.StampInsertedRaw,
+	}
+
+	var value JSONScalar
+	switch field {
+	case "auto":
+		for _, name := range TimestampFields {
+			if value = known[name]; value != "" {
+				break
+			}
+		}
+	case "timestamp_end", "timestamp_start", "stamp_updated", "stamp_inserted":
+		value = known[field]
+	default:
+		var err error
+		if value, err = lineField(text, field); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return ParseTimestamp(string(value), unit)
+}
@@ -0,0 +1,77 @@
+package flow
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMakeFlow(t *testing.T) {
+	opts := ParseOptions{TimestampField: "auto", TimestampUnit: "auto"}
+	f, err := MakeFlow(`{"event_type": "purge", "ip_src": "10.0.1.1", "ip_dst": "8.8.8.8", "port_src": 51000, "port_dst": 53, "proto": "udp", "packets": 2, "bytes": 143, "timestamp_end": "1700000000"}`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.IpSrcRaw != "10.0.1.1" || f.IpDstRaw != "8.8.8.8" || f.SrcPort != 51000 || f.DstPort != 53 ||
+		f.Proto != "udp" || f.Packages != 2 || f.Bytes != 143 || !f.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("parsed %+v", *f)
+	}
+	// addresses are parsed by MakePeer
+	if !f.IpSrc.IsZero() || f.Source != nil {
+		t.Errorf("addresses parsed early: %+v", *f)
+	}
+}
+
+func TestMakeFlowErrors(t *testing.T) {
+	opts := ParseOptions{TimestampField: "auto", TimestampUnit: "s", FragmentField: "frag"}
+	tests := []struct {
+		name   string
+		line   string
+		reason string
+	}{
+		{"truncated", `{"ip_src": "10.0.1.1", "ip_dst": "8.8`, "json"},
+		{"not json", `INFO ( default/core ): Start logging ...`, "json"},
+		{"empty", ``, "json"},
+		{"wrong type", `{"bytes": "many"}`, "json"},
+		{"bad timestamp", `{"bytes": 1, "timestamp_end": "yesterday"}`, "timestamp"},
+	}
+	for _, test := range tests {
+		f, err := MakeFlow(test.line, opts)
+		var parseErr *ParseError
+		if f != nil || !errors.As(err, &parseErr) || parseErr.Reason != test.reason {
+			t.Errorf("%s: flow %v, err %v, want reason %s", test.name, f, err, test.reason)
+		}
+	}
+}
+
+func TestMakeFlowOptions(t *testing.T) {
+	opts := ParseOptions{
+		FieldMap:       map[string]string{"src_host": "ip_src", "octets": "bytes"},
+		TimestampField: "first_seen",
+		TimestampUnit:  "ms",
+		DomainField:    "sni",
+		FragmentField:  "frag",
+	}
+	f, err := MakeFlow(`{"src_host": "10.0.1.1", "ip_src": "10.9.9.9", "octets": 900, "first_seen": 1700000000000, "sni": "example.com", "frag": "1"}`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.IpSrcRaw != "10.0.1.1" || f.Bytes != 900 || f.Domain != "example.com" || !f.Fragmented ||
+		!f.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("parsed %+v", *f)
+	}
+
+	// no timestamp is a zero time, no fragment field is not fragmented
+	f, err = MakeFlow(`{"bytes": 1}`, opts)
+	if err != nil || !f.Timestamp.IsZero() || f.Fragmented || f.Domain != "" {
+		t.Errorf("parsed %+v, err %v", f, err)
+	}
+}
+
+func TestIsTruthy(t *testing.T) {
+	for value, want := range map[string]bool{"": false, "0": false, "false": false, " No ": false, "1": true, "true": true, "yes": true} {
+		if got := IsTruthy(value); got != want {
+			t.Errorf("IsTruthy(%q) = %v", value, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package flow
+
+import (
+	"sort"
+
+	"inet.af/netaddr"
+)
+
+type specialUseRange struct {
+	prefix netaddr.IPPrefix
+	name   string
+	// globally reachable per the registry, unreachable ranges count as private
+	global bool
+}
+
+// IANA IPv4 and IPv6 Special-Purpose Address Registries, plus multicast
+// https://www.iana.org/assignments/iana-ipv4-special-registry
+// https://www.iana.org/assignments/iana-ipv6-special-registry
+var specialUseRegistry = []struct {
+	prefix string
+	name   string
+	global bool
+}{
+	{"0.0.0.0/8", "this-network", false},
+	{"0.0.0.0/32", "this-host", false},
+	{"10.0.0.0/8", "private-use", false},
+	{"100.64.0.0/10", "shared-address-space", false},
+	{"127.0.0.0/8", "loopback", false},
+	{"169.254.0.0/16", "link-local", false},
+	{"172.16.0.0/12", "private-use", false},
+	{"192.0.0.0/24", "ietf-protocol-assignments", false},
+	{"192.0.0.0/29", "ipv4-service-continuity", false},
+	{"192.0.0.8/32", "ipv4-dummy-address", false},
+	{"192.0.0.9/32", "port-control-protocol-anycast", true},
+	{"192.0.0.10/32", "turn-anycast", true},
+	{"192.0.0.170/32", "nat64-dns64-discovery", false},
+	{"192.0.0.171/32", "nat64-dns64-discovery", false},
+	{"192.0.2.0/24", "documentation", false},
+	{"192.31.196.0/24", "as112", true},
+	{"192.52.193.0/24", "amt", true},
+	{"192.168.0.0/16", "private-use", false},
+	{"192.175.48.0/24", "as112-direct-delegation", true},
+	{"198.18.0.0/15", "benchmarking", false},
+	{"198.51.100.0/24", "documentation", false},
+	{"203.0.113.0/24", "documentation", false},
+	{"224.0.0.0/4", "multicast", false},
+	{"240.0.0.0/4", "reserved", false},
+	{"255.255.255.255/32", "limited-broadcast", false},
+
+	{"::/128", "unspecified", false},
+	{"::1/128", "loopback", false},
+	{"::ffff:0:0/96", "ipv4-mapped", false},
+	{"64:ff9b::/96", "ipv4-ipv6-translation", true},
+	{"64:ff9b:1::/48", "ipv4-ipv6-translation", false},
+	{"100::/64", "discard-only", false},
+	{"2001::/23", "ietf-protocol-assignments", false},
+	{"2001::/32", "teredo", true},
+	{"2001:1::1/128", "port-control-protocol-anycast", true},
+	{"2001:1::2/128", "turn-anycast", true},
+	{"2001:2::/48", "benchmarking", false},
+	{"2001:3::/32", "amt", true},
+	{"2001:4:112::/48", "as112", true},
+	{"2001:20::/28", "orchid-v2", true},
+	{"2001:db8::/32", "documentation", false},
+	{"2002::/16", "6to4", true},
+	{"2620:4f:8000::/48", "as112-direct-delegation", true},
+	{"fc00::/7", "unique-local", false},
+	{"fe80::/10", "link-local", false},
+	{"ff00::/8", "multicast", false},
+}
+
+// most specific first, so the first match is the longest
+var specialUseRanges []specialUseRange
+
+func init() {
+	for _, r := range specialUseRegistry {
+		specialUseRanges = append(specialUseRanges, specialUseRange{netaddr.MustParseIPPrefix(r.prefix), r.name, r.global})
+	}
+	sort.SliceStable(specialUseRanges, func(i, j int) bool {
+		return specialUseRanges[i].prefix.Bits() > specialUseRanges[j].prefix.Bits()
+	})
+}
+
+// SpecialUse returns the most specific special-use range ip is in
+func SpecialUse(ip netaddr.IP) (name string, global bool, ok bool) {
+	for _, r := range specialUseRanges {
+		if r.prefix.Contains(ip) {
+			return r.name, r.global, true
+		}
+	}
+	return "", true, false
+}
+
+// SpecialUseName is the name of the special-use range ip is in, none if it
+// is in none
+func SpecialUseName(ip netaddr.IP) string {
+	if name, _, ok := SpecialUse(ip); ok {
+		return name
+	}
+	return "none"
+}
+
+// IsGlobal reports whether ip is neither private nor in a special-use range
+// that is not globally reachable
+func IsGlobal(ip netaddr.IP) bool {
+	ip = Canonical(ip)
+	if ip.IsPrivate() {
+		return false
+	}
+	_, global, _ := SpecialUse(ip)
+	return global
+}
+
+// IsPrivate treats hairpin NAT addresses like the private address behind
+// them, and every special-use range that is not globally reachable as
+// private, for IPv6 among others unique local fc00::/7 and link-local
+// fe80::/10
+func IsPrivate(ip netaddr.IP, hairpinIps []netaddr.IP) bool {
+	ip = Canonical(ip)
+	if ip.IsPrivate() || ContainsIP(hairpinIps, ip) {
+		return true
+	}
+	_, global, _ := SpecialUse(ip)
+	return !global
+}
+
+// Privacy classifies a flow by whether its ends are private: private if
+// both are, public if neither is, mixed otherwise
+func Privacy(srcPrivate, dstPrivate bool) string {
+	switch {
+	case srcPrivate && dstPrivate:
+		return "private"
+	case srcPrivate || dstPrivate:
+		return "mixed"
+	}
+	return "public"
+}
@@ -0,0 +1,60 @@
+package flow
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestSpecialUse(t *testing.T) {
+	tests := []struct {
+		ip      string
+		name    string
+		global  bool
+		private bool
+	}{
+		{"192.0.2.10", "documentation", false, true},
+		{"198.51.100.1", "documentation", false, true},
+		{"2001:db8::1", "documentation", false, true},
+		{"198.19.0.1", "benchmarking", false, true},
+		{"2001:2::1", "benchmarking", false, true},
+		// the most specific range wins
+		{"192.0.0.5", "ipv4-service-continuity", false, true},
+		{"192.0.0.9", "port-control-protocol-anycast", true, false},
+		{"192.0.0.200", "ietf-protocol-assignments", false, true},
+		{"2001::1", "teredo", true, false},
+		{"2001:10::1", "ietf-protocol-assignments", false, true},
+		{"100.64.1.1", "shared-address-space", false, true},
+		{"10.1.2.3", "private-use", false, true},
+		{"fd00::1", "unique-local", false, true},
+		{"fe80::1", "link-local", false, true},
+		{"239.1.1.1", "multicast", false, true},
+		{"ff02::1", "multicast", false, true},
+		{"255.255.255.255", "limited-broadcast", false, true},
+		{"8.8.8.8", "", true, false},
+		{"2606:4700::1111", "", true, false},
+	}
+	for _, test := range tests {
+		ip := netaddr.MustParseIP(test.ip)
+		name, global, ok := SpecialUse(ip)
+		if name != test.name || global != test.global || ok != (test.name != "") {
+			t.Errorf("%s: %q global %v ok %v, want %q global %v", test.ip, name, global, ok, test.name, test.global)
+		}
+		if got := IsGlobal(ip); got != test.global {
+			t.Errorf("%s: IsGlobal %v", test.ip, got)
+		}
+		if got := IsPrivate(ip, nil); got != test.private {
+			t.Errorf("%s: IsPrivate %v", test.ip, got)
+		}
+	}
+}
+
+func TestIsPrivateHairpin(t *testing.T) {
+	hairpin := []netaddr.IP{netaddr.MustParseIP("93.184.216.34")}
+	if !IsPrivate(netaddr.MustParseIP("93.184.216.34"), hairpin) {
+		t.Error("hairpin address not private")
+	}
+	if !IsPrivate(netaddr.MustParseIP("::ffff:10.0.0.1"), nil) {
+		t.Error("mapped private address not private")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+var (
+	geoipCheck        = flag.String("geoip-check", "", "Report how well the geo databases cover the addresses of this CIDR, then exit")
+	geoipCheckSamples = flag.Int("geoip-check-samples", 1024, "Addresses -geoip-check looks up, smaller ranges are checked completely")
+
+	selfTest = flag.Bool("selftest", false, "Look up well-known public addresses at startup, a -geoip-city or -geoip-asn set explicitly that finds nothing for them is fatal")
+)
+
+// public resolvers every City and ASN database knows
+var selfTestIPs = []string{"8.8.8.8", "1.1.1.1", "2001:4860:4860::8888"}
+
+type GeoCoverage struct {
+	Prefix    netaddr.IPPrefix
+	Checked   int
+	Country   int
+	ASN       int
+	Countries map[string]int
+}
+
+// SampleIPs returns every address of prefix if there are at most n,
+// otherwise n random ones
+func SampleIPs(prefix netaddr.IPPrefix, n int, rng *rand.Rand) []netaddr.IP {
+	prefix = prefix.Masked()
+	hostBits := int(prefix.IP().BitLen()) - int(prefix.Bits())
+
+	var ips []netaddr.IP
+	if hostBits < 31 && 1<<uint(hostBits) <= n {
+		r := prefix.Range()
+		for ip := r.From(); ; ip = ip.Next() {
+			ips = append(ips, ip)
+			if ip == r.To() {
+				break
+			}
+		}
+		return ips
+	}
+
+	base := prefix.IP().As16()
+	offset := 16 - int(prefix.IP().BitLen())/8
+	for i := 0; i < n; i++ {
+		b := base
+		for bit := int(prefix.Bits()); bit < int(prefix.IP().BitLen()); bit++ {
+			if rng.Intn(2) == 1 {
+				b[offset+bit/8] |= 0x80 >> uint(bit%8)
+			}
+		}
+		ip := netaddr.IPFrom16(b)
+		if prefix.IP().Is4() {
+			ip = ip.Unmap()
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// SelfTest looks up selfTestIPs like flows are enriched and logs what is
+// found. With city or asn required it fails if that database is missing or
+// finds nothing for all of them, e.g. a truncated file or the wrong edition.
+func SelfTest(dbs GeoReaders, city, asn bool) error {
+	var countries, asns int
+	for _, raw := range selfTestIPs {
+		peer, err := MakePeer(raw, dbs)
+		if err != nil {
+			return err
+		}
+		slog.Info("selftest", "ip", raw, "country", peer.Country, "asn", peer.Asn, "asn_org", peer.AsnOrg)
+		if peer.Country != "" {
+			countries++
+		}
+		if peer.Asn != "" {
+			asns++
+		}
+	}
+	if city && countries == 0 {
+		return fmt.Errorf("-geoip-city found no country for %s", strings.Join(selfTestIPs, ", "))
+	}
+	if asn && asns == 0 {
+		return fmt.Errorf("-geoip-asn found no ASN for %s", strings.Join(selfTestIPs, ", "))
+	}
+	return nil
+}
+
+// CheckGeoCoverage looks up the sampled addresses like flows are enriched
+func CheckGeoCoverage(prefix netaddr.IPPrefix, samples int, dbs GeoReaders) (GeoCoverage, error) {
+	c := GeoCoverage{Prefix: prefix, Countries: make(map[string]int)}
+	for _, ip := range SampleIPs(prefix, samples, rand.New(rand.NewSource(1))) {
+		peer, err := MakePeer(ip.String(), dbs)
+		if err != nil {
+			return c, err
+		}
+		c.Checked++
+		if peer.Country != "" {
+			c.Country++
+			c.Countries[peer.Country]++
+		}
+		if peer.Asn != "" {
+			c.ASN++
+		}
+	}
+	return c, nil
+}
+
+func (c GeoCoverage) Print(w io.Writer) {
+	percent := func(n int) float64 {
+		return 100 * float64(n) / float64(c.Checked)
+	}
+	fmt.Fprintf(w, "%s: %d addresses checked\n", c.Prefix, c.Checked)
+	fmt.Fprintf(w, "  country: %5.1f%% (%d distinct)\n", percent(c.Country), len(c.Countries))
+	fmt.Fprintf(w, "  asn:     %5.1f%%\n", percent(c.ASN))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+	"inet.af/netaddr"
+)
+
+func TestSampleIPs(t *testing.T) {
+	prefix := netaddr.MustParseIPPrefix("203.0.113.20/28")
+	ips := SampleIPs(prefix, 1024, rand.New(rand.NewSource(1)))
+	if len(ips) != 16 || ips[0] != netaddr.MustParseIP("203.0.113.16") || ips[15] != netaddr.MustParseIP("203.0.113.31") {
+		t.Errorf("/28 enumerated as %v", ips)
+	}
+
+	// too large to enumerate
+	prefix = netaddr.MustParseIPPrefix("2001:db8::/32")
+	ips = SampleIPs(prefix, 100, rand.New(rand.NewSource(1)))
+	if len(ips) != 100 {
+		t.Fatalf("%d samples, want 100", len(ips))
+	}
+	for _, ip := range ips {
+		if !prefix.Contains(ip) {
+			t.Errorf("%s sampled outside %s", ip, prefix)
+		}
+	}
+}
+
+func TestCheckGeoCoverage(t *testing.T) {
+	defer func(saved []GeoOverride) { geoOverrides = saved }(geoOverrides)
+	overrides, err := LoadGeoOverrides(writeTestFile(t, "overrides.json", `[
+		{"cidr": "203.0.113.0/29", "country": "Germany", "asn": "64500"},
+		{"cidr": "203.0.113.8/30", "country": "France"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoOverrides = overrides
+
+	coverage, err := CheckGeoCoverage(netaddr.MustParseIPPrefix("203.0.113.0/28"), 1024, GeoReaders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coverage.Checked != 16 || coverage.Country != 12 || coverage.ASN != 8 ||
+		coverage.Countries["Germany"] != 8 || coverage.Countries["France"] != 4 {
+		t.Errorf("coverage %+v", coverage)
+	}
+
+	var out bytes.Buffer
+	coverage.Print(&out)
+	want := "203.0.113.0/28: 16 addresses checked\n" +
+		"  country:  75.0% (2 distinct)\n" +
+		"  asn:      50.0%\n"
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// nowhereGeoReader finds nothing, like a truncated file or a database of
+// the wrong edition
+type nowhereGeoReader struct{}
+
+func (nowhereGeoReader) City(ip net.IP) (*geoip2.City, error) {
+	return &geoip2.City{}, nil
+}
+
+func (nowhereGeoReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	return nil, errors.New("invalid database type")
+}
+
+func (nowhereGeoReader) ISP(ip net.IP) (*geoip2.ISP, error) {
+	return nil, errors.New("invalid database type")
+}
+
+func (nowhereGeoReader) ConnectionType(ip net.IP) (*geoip2.ConnectionType, error) {
+	return nil, errors.New("invalid database type")
+}
+
+func TestSelfTest(t *testing.T) {
+	captureLogs(t, "text", "info")
+	tests := []struct {
+		name      string
+		dbs       GeoReaders
+		city, asn bool
+		err       string
+	}{
+		{"working", GeoReaders{City: anywhereGeoReader{}, ASN: anywhereGeoReader{}}, true, true, ""},
+		{"empty city", GeoReaders{City: nowhereGeoReader{}, ASN: anywhereGeoReader{}}, true, true, "-geoip-city"},
+		{"wrong asn edition", GeoReaders{City: anywhereGeoReader{}, ASN: nowhereGeoReader{}}, true, true, "-geoip-asn"},
+		{"missing asn", GeoReaders{City: anywhereGeoReader{}}, true, true, "-geoip-asn"},
+		// the default paths may be absent
+		{"missing, not required", GeoReaders{}, false, false, ""},
+		{"empty, not required", GeoReaders{City: nowhereGeoReader{}, ASN: nowhereGeoReader{}}, false, false, ""},
+	}
+	for _, test := range tests {
+		err := SelfTest(test.dbs, test.city, test.asn)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: %v, want an error about %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSelfTestLogs(t *testing.T) {
+	buf := captureLogs(t, "text", "info")
+	if err := SelfTest(GeoReaders{City: anywhereGeoReader{}, ASN: anywhereGeoReader{}}, true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range selfTestIPs {
+		if !strings.Contains(buf.String(), "msg=selftest ip="+ip+" country=Atlantis asn=64500") {
+			t.Errorf("no selftest line for %s in %q", ip, buf.String())
+		}
+	}
+}
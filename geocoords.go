@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var geoCoordsLabel = flag.Bool("label-geocoords", false, "Count bytes per remote location with latitude and longitude labels in flow_peer_location_bytes_total, one series per city")
+
+var flowPeerLocationBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flow_peer_location_bytes_total",
+		Help: "Bytes by location of the remote address, with -label-geocoords",
+	},
+	[]string{"country", "city", "latitude", "longitude"},
+)
+
+// ObserveLocation counts bytes at the coordinates of peer, peers the City
+// database doesn't locate are left out
+func ObserveLocation(peer *Peer, bytes float64) {
+	if peer.Latitude == 0 && peer.Longitude == 0 {
+		return
+	}
+	labels := prometheus.Labels{
+		"country":   geoLabel(peer.Country),
+		"city":      geoLabel(peer.City),
+		"latitude":  strconv.FormatFloat(peer.Latitude, 'f', -1, 64),
+		"longitude": strconv.FormatFloat(peer.Longitude, 'f', -1, 64),
+	}
+	flowPeerLocationBytes.With(labels).Add(bytes)
+	if janitor != nil {
+		janitor.Touch(flowPeerLocationBytes, labels, time.Now())
+	}
+}
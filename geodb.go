@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/patte/go-pmacct/flow"
+)
+
+// GeoReaders are the open databases, nil where the path is empty or the file
+// failed to open. OpenGeoDB fills them with *geoip2.Reader.
+type GeoReaders struct {
+	City           flow.GeoReader
+	ASN            flow.GeoReader
+	ISP            flow.GeoReader
+	ConnectionType flow.GeoReader
+}
+
+// fields returns the readers in the order of OpenGeoDB's paths
+func (r *GeoReaders) fields() []*flow.GeoReader {
+	return []*flow.GeoReader{&r.City, &r.ASN, &r.ISP, &r.ConnectionType}
+}
+
+// what peers lack without each database, in the order of fields
+var geoMissing = []string{"no country and city labels", "no asn labels", "no isp labels", "no connection_type labels"}
+
+func (r *GeoReaders) Close() {
+	for _, reader := range r.fields() {
+		if closer, ok := (*reader).(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// GeoDB holds the City, ASN, ISP and Connection-Type readers. Reload swaps
+// them for freshly opened ones, e.g. after a cron job replaced the .mmdb
+// files.
+type GeoDB struct {
+	paths []string
+
+	mu      sync.RWMutex
+	readers GeoReaders
+}
+
+// OpenGeoDB opens the databases, an empty path skips that one. A database
+// that fails to open is skipped with a warning, peers then lack its labels.
+func OpenGeoDB(cityPath, asnPath, ispPath, connectionTypePath string) *GeoDB {
+	g := &GeoDB{paths: []string{cityPath, asnPath, ispPath, connectionTypePath}}
+	for i, reader := range g.readers.fields() {
+		if g.paths[i] == "" {
+			continue
+		}
+		db, err := geoip2.Open(g.paths[i])
+		if err != nil {
+			slog.Warn(geoMissing[i], "err", err)
+			continue
+		}
+		*reader = db
+	}
+	return g
+}
+
+func (g *GeoDB) open() (GeoReaders, error) {
+	var readers GeoReaders
+	for i, reader := range readers.fields() {
+		if g.paths[i] == "" {
+			continue
+		}
+		db, err := geoip2.Open(g.paths[i])
+		if err != nil {
+			readers.Close()
+			return GeoReaders{}, err
+		}
+		*reader = db
+	}
+	return readers, nil
+}
+
+// View calls f with the current readers, which stay open until f returns
+func (g *GeoDB) View(f func(dbs GeoReaders)) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	f(g.readers)
+}
+
+// Reload opens the databases again and closes the old readers once no View
+// uses them. If any fails to open the old readers stay in place.
+func (g *GeoDB) Reload() error {
+	readers, err := g.open()
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.readers
+	g.readers = readers
+	g.mu.Unlock()
+
+	old.Close()
+	return nil
+}
+
+func (g *GeoDB) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.readers.Close()
+}
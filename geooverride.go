@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"inet.af/netaddr"
+)
+
+var geoipOverride = flag.String("geoip-override", "", "JSON file of CIDRs with country/asn/city values taking precedence over the GeoIP databases")
+
+// GeoOverride replaces the GeoIP values of a prefix, empty fields keep the
+// database value.
+//
+//	[{"cidr": "203.0.113.0/24", "country": "Germany", "country_iso": "DE", "asn": "64500"}]
+type GeoOverride struct {
+	CIDR       string `json:"cidr"`
+	Country    string `json:"country"`
+	CountryISO string `json:"country_iso"`
+	City       string `json:"city"`
+	Asn        string `json:"asn"`
+	AsnOrg     string `json:"asn_org"`
+
+	prefix netaddr.IPPrefix
+}
+
+// overrides sorted by prefix length, longest first
+var geoOverrides []GeoOverride
+
+// LoadGeoOverrides reads an override file, sorted for longest prefix matching
+func LoadGeoOverrides(path string) ([]GeoOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides []GeoOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range overrides {
+		prefix, err := netaddr.ParseIPPrefix(overrides[i].CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		overrides[i].prefix = prefix.Masked()
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].prefix.Bits() > overrides[j].prefix.Bits()
+	})
+	return overrides, nil
+}
+
+// applyGeoOverride sets the values of the longest matching override on peer
+func applyGeoOverride(peer *Peer, overrides []GeoOverride) {
+	for _, o := range overrides {
+		if !o.prefix.Contains(peer.Ip) {
+			continue
+		}
+		if o.Country != "" {
+			peer.Country = o.Country
+		}
+		if o.CountryISO != "" {
+			peer.CountryISO = o.CountryISO
+		}
+		if o.City != "" {
+			peer.City = o.City
+		}
+		if o.Asn != "" {
+			peer.Asn = o.Asn
+		}
+		if o.AsnOrg != "" {
+			peer.AsnOrg = o.AsnOrg
+		}
+		return
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoOverrideWinsOverDatabase(t *testing.T) {
+	path := writeTestFile(t, "overrides.json", `[
+		{"cidr": "203.0.113.0/24", "country": "Germany", "country_iso": "DE", "asn": "64500"},
+		{"cidr": "203.0.113.128/25", "city": "Berlin"},
+		{"cidr": "2001:db8::/32", "asn_org": "Example IPv6"}
+	]`)
+	overrides, err := LoadGeoOverrides(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want Peer
+	}{
+		// the /25 is more specific, only its city replaces the database one
+		{"203.0.113.200", Peer{Country: "United States", CountryISO: "US", City: "Berlin", Asn: "15169", AsnOrg: "Google LLC"}},
+		{"203.0.113.10", Peer{Country: "Germany", CountryISO: "DE", City: "Mountain View", Asn: "64500", AsnOrg: "Google LLC"}},
+		{"2001:db8::1", Peer{Country: "United States", CountryISO: "US", City: "Mountain View", Asn: "15169", AsnOrg: "Example IPv6"}},
+		// no override, the database answer stays
+		{"198.51.100.1", Peer{Country: "United States", CountryISO: "US", City: "Mountain View", Asn: "15169", AsnOrg: "Google LLC"}},
+	}
+	for _, test := range tests {
+		ip := netaddr.MustParseIP(test.ip)
+		// as looked up in the database
+		peer := &Peer{Ip: ip, Country: "United States", CountryISO: "US", City: "Mountain View", Asn: "15169", AsnOrg: "Google LLC"}
+		applyGeoOverride(peer, overrides)
+		test.want.Ip = ip
+		if *peer != test.want {
+			t.Errorf("%s: %+v, want %+v", test.ip, *peer, test.want)
+		}
+	}
+}
+
+func TestLoadGeoOverridesInvalid(t *testing.T) {
+	for _, content := range []string{`[{"cidr": "203.0.113.0/33"}]`, `{"cidr": "203.0.113.0/24"}`} {
+		if _, err := LoadGeoOverrides(writeTestFile(t, "overrides.json", content)); err == nil {
+			t.Errorf("%s loaded", content)
+		}
+	}
+}
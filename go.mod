@@ -1,10 +1,12 @@
 module github.com/patte/go-pmacct
 
-go 1.16
+go 1.21
 
 require (
+	github.com/mattn/go-sqlite3 v1.9.0
 	github.com/oschwald/geoip2-golang v1.5.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	inet.af/netaddr v0.0.0-20210903134321-85fa6c94624e // indirect
 	tailscale.com v1.14.3
 )
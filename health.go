@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var healthTimeout = flag.Duration("health-timeout", 5*time.Minute, "/healthz fails once no flow was parsed for this long")
+
+// Health answers /healthz: 200 while the input runs and flows arrive, 503
+// otherwise, so an orchestrator can restart a wedged exporter
+type Health struct {
+	timeout time.Duration
+	// unix nanoseconds of the last flow, the start time before the first
+	lastFlow int64
+
+	mu     sync.Mutex
+	source FlowSource
+}
+
+func NewHealth(timeout time.Duration, now time.Time) *Health {
+	return &Health{timeout: timeout, lastFlow: now.UnixNano()}
+}
+
+// FlowSeen records a parsed flow
+func (h *Health) FlowSeen(now time.Time) {
+	atomic.StoreInt64(&h.lastFlow, now.UnixNano())
+}
+
+// SetSource sets the input whose liveness is checked, if it can tell
+func (h *Health) SetSource(source FlowSource) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.source = source
+}
+
+// Check returns why the exporter is unhealthy, nil if it is not
+func (h *Health) Check(now time.Time) error {
+	h.mu.Lock()
+	source := h.source
+	h.mu.Unlock()
+	if running, ok := source.(interface{ Running() bool }); ok && !running.Running() {
+		return fmt.Errorf("%s is not running", *pmacctBin)
+	}
+	last := time.Unix(0, atomic.LoadInt64(&h.lastFlow))
+	if idle := now.Sub(last); idle > h.timeout {
+		return fmt.Errorf("no flow for %s", idle.Round(time.Second))
+	}
+	return nil
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.Check(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var heartbeatInterval = flag.Duration("heartbeat", 0, "Update exporter_heartbeat_timestamp every interval, flows or not, 0 disables")
+
+var exporterHeartbeat = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "exporter_heartbeat_timestamp",
+		Help: "Unix time of the last heartbeat, tells no traffic apart from a dead exporter",
+	},
+)
+
+// Heartbeat sets exporter_heartbeat_timestamp to now() every interval until
+// stop is closed
+func Heartbeat(interval time.Duration, now func() time.Time, stop <-chan struct{}) {
+	exporterHeartbeat.Set(float64(now().Unix()))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			exporterHeartbeat.Set(float64(now().Unix()))
+		case <-stop:
+			return
+		}
+	}
+}
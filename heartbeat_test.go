@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHeartbeatAdvances(t *testing.T) {
+	start := time.Unix(1614834367, 0)
+	var mu sync.Mutex
+	clock := start
+	// every heartbeat reads a clock a minute later
+	now := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		t := clock
+		clock = clock.Add(time.Minute)
+		return t
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Heartbeat(time.Millisecond, now, stop)
+		close(done)
+	}()
+
+	var last float64
+	deadline := time.Now().Add(5 * time.Second)
+	for last < float64(start.Add(3*time.Minute).Unix()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeat stuck at %v", last)
+		}
+		got := testutil.ToFloat64(exporterHeartbeat)
+		if got < last {
+			t.Fatalf("heartbeat went from %v to %v", last, got)
+		}
+		last = got
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Heartbeat didn't return after stop")
+	}
+	// no beats after stop
+	stopped := testutil.ToFloat64(exporterHeartbeat)
+	time.Sleep(10 * time.Millisecond)
+	if got := testutil.ToFloat64(exporterHeartbeat); got != stopped {
+		t.Errorf("heartbeat moved from %v to %v after stop", stopped, got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var histogramBuckets = flag.String("histogram-buckets", "", "Comma separated upper bounds in bytes of the flow_size_bytes buckets, 64 bytes to 4GiB in powers of 4 if empty")
+
+// bytes of single flows, by direction, set up by SetupMetrics
+var flowSizeBytes *prometheus.HistogramVec
+
+// ParseBuckets parses -histogram-buckets, empty gives the default buckets
+func ParseBuckets(spec string) ([]float64, error) {
+	if strings.TrimSpace(spec) == "" {
+		return prometheus.ExponentialBuckets(64, 4, 14), nil
+	}
+	var buckets []float64
+	for _, raw := range strings.Split(spec, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, fmt.Errorf("-histogram-buckets: %w", err)
+		}
+		// NewHistogramVec panics on anything but strictly increasing bounds
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("-histogram-buckets must be in increasing order, got %q", spec)
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// setupHistogram registers flow_size_bytes. Only direction is a label, every
+// bucket is a series of its own.
+func setupHistogram(reg prometheus.Registerer) error {
+	buckets, err := ParseBuckets(*histogramBuckets)
+	if err != nil {
+		return err
+	}
+	flowSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "flow_size_bytes",
+			Help:    "Bytes of single flows",
+			Buckets: buckets,
+		},
+		[]string{"direction"},
+	)
+	return reg.Register(flowSizeBytes)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"inet.af/netaddr"
+)
+
+var hostLabelsFile = flag.String("host-labels", "", `JSON file mapping IPs to friendly names, e.g. {"192.0.2.1": "edge-router"}`)
+
+var hostLabels map[netaddr.IP]string
+
+func LoadHostLabels(path string) (map[netaddr.IP]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	labels := make(map[netaddr.IP]string, len(raw))
+	for ipRaw, name := range raw {
+		ip, err := netaddr.ParseIP(ipRaw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		labels[ip] = name
+	}
+	return labels, nil
+}
+
+// HostLabel returns the friendly name of ip, or the ip itself
+func HostLabel(ip netaddr.IP) string {
+	if name, ok := hostLabels[ip]; ok {
+		return name
+	}
+	return ip.String()
+}
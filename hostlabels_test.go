@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestExporterParsedAndLabeled(t *testing.T) {
+	path := writeTestFile(t, "hosts.json", `{"192.0.2.1": "edge-router"}`)
+	labels, err := LoadHostLabels(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved map[netaddr.IP]string) { hostLabels = saved }(hostLabels)
+	hostLabels = labels
+
+	tests := []struct {
+		line     string
+		raw      string
+		exporter string
+	}{
+		{`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "peer_ip_src": "192.0.2.1"}`, "192.0.2.1", "edge-router"},
+		// not in -host-labels
+		{`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "peer_ip_src": "192.0.2.2"}`, "192.0.2.2", "192.0.2.2"},
+		// pmacctd doesn't know an exporter
+		{`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8"}`, "", ""},
+		// kept as it is if it's not an address
+		{`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "peer_ip_src": "core"}`, "core", "core"},
+	}
+	for _, test := range tests {
+		var f Flow
+		if err := unmarshalFlow(test.line, &f, nil); err != nil {
+			t.Fatal(err)
+		}
+		if f.ExporterRaw != test.raw {
+			t.Errorf("%s: parsed exporter %q, want %q", test.line, f.ExporterRaw, test.raw)
+		}
+		relabelStage(&f)
+		if got := flowLabelValues["exporter"](&f, &Peer{}); got != test.exporter {
+			t.Errorf("%s: exporter label %q, want %q", test.line, got, test.exporter)
+		}
+	}
+}
+
+func TestLoadHostLabelsInvalid(t *testing.T) {
+	if _, err := LoadHostLabels(writeTestFile(t, "hosts.json", `{"router": "edge"}`)); err == nil {
+		t.Error("non address key loaded")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+
+	"github.com/patte/go-pmacct/flow"
+
+	"tailscale.com/net/interfaces"
+)
+
+var ifaceBytes = flag.Bool("iface-bytes", false, "Count bytes per local interface in flow_iface_bytes_total, by the interface of the local address or its subnet")
+
+// set in main with -iface-bytes
+var ifaceMap *IfaceMap
+
+var flowIfaceBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flow_iface_bytes_total",
+		Help: "Bytes by the local interface of the flow, with -iface-bytes",
+	},
+	[]string{"iface", "direction"},
+)
+
+type ifaceAddress struct {
+	prefix netaddr.IPPrefix
+	name   string
+}
+
+// IfaceMap finds the interface of a local address: the one carrying the
+// address, else the one whose subnet contains it, e.g. a LAN host behind
+// -local-networks
+type IfaceMap struct {
+	mu        sync.RWMutex
+	addresses []ifaceAddress
+}
+
+// NewIfaceMap reads the addresses of the interfaces
+func NewIfaceMap() (*IfaceMap, error) {
+	m := &IfaceMap{}
+	return m, m.Refresh()
+}
+
+// Refresh reads the addresses again, e.g. after an interface came up
+func (m *IfaceMap) Refresh() error {
+	var addresses []ifaceAddress
+	err := interfaces.ForeachInterfaceAddress(func(iface interfaces.Interface, prefix netaddr.IPPrefix) {
+		prefix = netaddr.IPPrefixFrom(flow.Canonical(prefix.IP()), prefix.Bits())
+		addresses = append(addresses, ifaceAddress{prefix: prefix, name: iface.Name})
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addresses = addresses
+	return nil
+}
+
+// Name returns the interface of ip, empty if none has it or its subnet
+func (m *IfaceMap) Name(ip netaddr.IP) string {
+	ip = flow.Canonical(ip)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, address := range m.addresses {
+		if address.prefix.IP() == ip {
+			return address.name
+		}
+	}
+	// the most specific subnet, a /8 of one interface may hold the /24 of
+	// another
+	name, bits := "", -1
+	for _, address := range m.addresses {
+		if int(address.prefix.Bits()) > bits && address.prefix.Masked().Contains(ip) {
+			name, bits = address.name, int(address.prefix.Bits())
+		}
+	}
+	return name
+}
+
+// ObserveIface counts the bytes of a flow of known direction on its local
+// interface
+func ObserveIface(f *Flow, bytes float64) {
+	ip := f.LocalIP()
+	if ip.IsZero() {
+		return
+	}
+	flowIfaceBytes.With(prometheus.Labels{"iface": geoLabel(ifaceMap.Name(ip)), "direction": f.Direction}).Add(bytes)
+}
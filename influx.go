@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	influxURL    = flag.String("influx-url", "", "InfluxDB base url, e.g. http://localhost:8086, enables writing flows as line protocol")
+	influxOrg    = flag.String("influx-org", "", "InfluxDB organization")
+	influxBucket = flag.String("influx-bucket", "", "InfluxDB bucket")
+	influxToken  = flag.String("influx-token", "", "InfluxDB API token")
+	influxBatch  = flag.Int("influx-batch", 500, "Flows per InfluxDB write request")
+	influxFlush  = flag.Duration("influx-flush", 10*time.Second, "Max time a flow waits before being written to InfluxDB")
+)
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// FormatLineProtocol renders a flow as a single InfluxDB line protocol point
+func FormatLineProtocol(flow *Flow, at time.Time) string {
+	var b strings.Builder
+	b.WriteString("flow")
+
+	tags := [][2]string{
+		{"direction", flow.Direction},
+		{"private", flow.PrivateRaw},
+		{"proto", NormalizeProto(flow.Proto)},
+	}
+	if peer := flow.RemotePeer(); peer != nil {
+		tags = append(tags,
+			[2]string{"country", geoLabel(peer.Country)},
+			[2]string{"asn", geoLabel(peer.Asn)},
+			[2]string{"asn_org", geoLabel(peer.AsnOrg)},
+		)
+	}
+	for _, tag := range tags {
+		// empty tag values are not allowed in line protocol
+		if tag[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", tag[0], influxTagEscaper.Replace(tag[1]))
+	}
+
+	fmt.Fprintf(&b, " bytes=%di,packets=%di %d\n", flow.Bytes, flow.Packages, at.UnixNano())
+	return b.String()
+}
+
+// InfluxWriter writes flows to the InfluxDB v2 write api through an
+// AsyncEmitter, so a slow or unavailable database never blocks the scanner.
+type InfluxWriter struct {
+	endpoint string
+	token    string
+	client   *http.Client
+
+	emitter *AsyncEmitter
+}
+
+func NewInfluxWriter(baseURL, org, bucket, token string, config EmitterConfig) *InfluxWriter {
+	query := url.Values{}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+
+	w := &InfluxWriter{
+		endpoint: strings.TrimSuffix(baseURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	w.emitter = NewAsyncEmitter("influx", config, w.send)
+	return w
+}
+
+// Write queues the flow, dropping it if the queue is full
+func (w *InfluxWriter) Write(flow *Flow) {
+	w.emitter.Enqueue(FormatLineProtocol(flow, time.Now()))
+}
+
+// Close writes what is still queued and stops the writer
+func (w *InfluxWriter) Close() {
+	w.emitter.Close()
+}
+
+func (w *InfluxWriter) send(batch []interface{}) error {
+	var buf bytes.Buffer
+	for _, line := range batch {
+		buf.WriteString(line.(string))
+	}
+	return w.post(buf.Bytes())
+}
+
+func (w *InfluxWriter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx responded %s", resp.Status)
+	}
+	return nil
+}
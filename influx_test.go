@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func influxFlow() *Flow {
+	return &Flow{
+		IpSrc:      netaddr.MustParseIP("10.0.0.1"),
+		IpDst:      netaddr.MustParseIP("8.8.8.8"),
+		Proto:      "17",
+		Bytes:      1500,
+		Packages:   3,
+		Direction:  "out",
+		PrivateRaw: "mixed",
+		Source:     &Peer{Ip: netaddr.MustParseIP("10.0.0.1")},
+		Destination: &Peer{
+			Ip:      netaddr.MustParseIP("8.8.8.8"),
+			Country: "United States",
+			Asn:     "15169",
+			AsnOrg:  "Google LLC",
+		},
+	}
+}
+
+func TestFormatLineProtocol(t *testing.T) {
+	at := time.Unix(1700000000, 5)
+	got := FormatLineProtocol(influxFlow(), at)
+	want := `flow,direction=out,private=mixed,proto=udp,country=United\ States,asn=15169,asn_org=Google\ LLC bytes=1500i,packets=3i 1700000000000000005` + "\n"
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestFormatLineProtocolSkipsEmptyTags(t *testing.T) {
+	f := influxFlow()
+	f.Direction, f.PrivateRaw, f.Proto = "unknown", "", ""
+	got := FormatLineProtocol(f, time.Unix(0, 0))
+	if got != "flow,direction=unknown bytes=1500i,packets=3i 0\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestInfluxWriterPayload(t *testing.T) {
+	type request struct {
+		path, query, auth, body string
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := NewInfluxWriter(server.URL+"/", "home", "flows", "secret", EmitterConfig{Queue: 10, Batch: 2, Flush: time.Hour})
+	w.Write(influxFlow())
+	w.Write(influxFlow())
+	w.Close()
+
+	if len(requests) != 1 {
+		t.Fatalf("%d write requests, want one batch of 2", len(requests))
+	}
+	r := <-requests
+	if r.path != "/api/v2/write" || r.query != "bucket=flows&org=home&precision=ns" {
+		t.Errorf("wrote to %s?%s", r.path, r.query)
+	}
+	if r.auth != "Token secret" {
+		t.Errorf("Authorization %q", r.auth)
+	}
+	lines := strings.Split(strings.TrimSuffix(r.body, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("payload has %d lines:\n%s", len(lines), r.body)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "flow,direction=out,") || !strings.Contains(line, " bytes=1500i,packets=3i ") {
+			t.Errorf("line %q", line)
+		}
+	}
+}
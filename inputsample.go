@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inputSample     = flag.String("input-sample", "", "Process only 1/N of the input lines and scale bytes and packets by N, e.g. 1/10")
+	inputSampleMode = flag.String("input-sample-mode", "random", "How -input-sample picks lines: random or count (every Nth line)")
+)
+
+var (
+	flowInputSampleRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flow_input_sample_rate",
+			Help: "N of -input-sample, 1 when every line is processed",
+		},
+	)
+	flowsInputSampled = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flow_input_sampled_out_total",
+			Help: "Input lines skipped by -input-sample",
+		},
+	)
+)
+
+// ParseSampleRate parses "1/N" or "N" into N
+func ParseSampleRate(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(s), "1/"))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid sample rate %q, want 1/N with N >= 1", s)
+	}
+	return n, nil
+}
+
+// InputSampler keeps 1/N of the lines. Not safe for concurrent use, it sits
+// in front of the workers.
+type InputSampler struct {
+	rate int
+	// nil with mode count
+	rng *rand.Rand
+	n   int
+}
+
+func NewInputSampler(rate int, mode string, rng *rand.Rand) (*InputSampler, error) {
+	switch mode {
+	case "random":
+		return &InputSampler{rate: rate, rng: rng}, nil
+	case "count":
+		return &InputSampler{rate: rate}, nil
+	}
+	return nil, fmt.Errorf("unknown -input-sample-mode %q", mode)
+}
+
+// Keep reports whether the next line is processed
+func (s *InputSampler) Keep() bool {
+	if s.rng != nil {
+		return s.rng.Intn(s.rate) == 0
+	}
+	s.n++
+	if s.n < s.rate {
+		return false
+	}
+	s.n = 0
+	return true
+}
+
+// Scale returns a copy of a sampled flow with its counters turned into an
+// estimate of all flows it stands for, the flow itself keeps what was read
+func (s *InputSampler) Scale(flow *Flow) *Flow {
+	scaled := *flow
+	scaled.Bytes *= s.rate
+	scaled.Packages *= s.rate
+	return &scaled
+}
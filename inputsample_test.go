@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestParseSampleRate(t *testing.T) {
+	for in, want := range map[string]int{"1/10": 10, "10": 10, " 1/1 ": 1, "1": 1} {
+		if got, err := ParseSampleRate(in); err != nil || got != want {
+			t.Errorf("ParseSampleRate(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "1/0", "0", "-3", "2/10", "1/x"} {
+		if _, err := ParseSampleRate(in); err == nil {
+			t.Errorf("ParseSampleRate(%q) accepted", in)
+		}
+	}
+}
+
+func TestInputSamplerCount(t *testing.T) {
+	s, err := NewInputSampler(4, "count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []int
+	for i := 1; i <= 12; i++ {
+		if s.Keep() {
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) != 3 || kept[0] != 4 || kept[1] != 8 || kept[2] != 12 {
+		t.Errorf("kept lines %v, want every 4th", kept)
+	}
+}
+
+func TestInputSamplerEstimate(t *testing.T) {
+	// the scaled sum of the kept flows estimates the sum of all of them
+	const rate, lines, bytes = 10, 100000, 1500
+	for _, mode := range []string{"count", "random"} {
+		s, err := NewInputSampler(rate, mode, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var estimate int
+		for i := 0; i < lines; i++ {
+			if !s.Keep() {
+				continue
+			}
+			f := &Flow{Bytes: bytes, Packages: 1}
+			scaled := s.Scale(f)
+			if scaled.Bytes != bytes*rate || scaled.Packages != rate {
+				t.Fatalf("%s: scaled to %d bytes %d packets", mode, scaled.Bytes, scaled.Packages)
+			}
+			// -json-out and the other archives keep what was read
+			if f.Bytes != bytes || f.Packages != 1 {
+				t.Fatalf("%s: sampled flow changed to %d bytes %d packets", mode, f.Bytes, f.Packages)
+			}
+			estimate += scaled.Bytes
+		}
+		if off := math.Abs(float64(estimate)/(lines*bytes) - 1); off > 0.03 {
+			t.Errorf("%s: estimate %d off by %.1f%% from %d", mode, estimate, off*100, lines*bytes)
+		}
+	}
+}
+
+func TestNewInputSamplerMode(t *testing.T) {
+	if _, err := NewInputSampler(2, "hash", nil); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ipSampleRate = flag.Float64("ip-sample-rate", 0, "Fraction of flows whose remote ip is also counted in flow_sampled_ip_bytes{asn,ip}, 0 disables")
+	ipSampleTTL  = flag.Duration("ip-sample-ttl", 5*time.Minute, "Time after which an ip not sampled again is dropped from flow_sampled_ip_bytes")
+	ipSampleMax  = flag.Int("ip-sample-max", 1000, "Max series of flow_sampled_ip_bytes, new ips are ignored beyond")
+)
+
+type ipSampleKey struct {
+	asn string
+	ip  string
+}
+
+type ipSample struct {
+	bytes    float64
+	lastSeen time.Time
+}
+
+// IPSampler counts the bytes of a random fraction of flows per ASN and
+// remote ip. Series expire after ttl without a sampled flow, so per-ip
+// detail is around for spot checks without growing forever.
+type IPSampler struct {
+	rate float64
+	ttl  time.Duration
+	max  int
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	samples map[ipSampleKey]*ipSample
+
+	desc *prometheus.Desc
+}
+
+func NewIPSampler(rate float64, ttl time.Duration, max int, rng *rand.Rand) *IPSampler {
+	return &IPSampler{
+		rate:    rate,
+		ttl:     ttl,
+		max:     max,
+		rng:     rng,
+		samples: make(map[ipSampleKey]*ipSample),
+		desc: prometheus.NewDesc(
+			"flow_sampled_ip_bytes",
+			"Bytes of sampled flows per ASN and remote ip, see -ip-sample-rate, series expire after -ip-sample-ttl",
+			[]string{"asn", "ip"}, nil,
+		),
+	}
+}
+
+func (s *IPSampler) Observe(flow *Flow, now time.Time) {
+	peer := flow.RemotePeer()
+	if peer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rng.Float64() >= s.rate {
+		return
+	}
+	key := ipSampleKey{geoLabel(peer.Asn), peer.Ip.String()}
+	sample, ok := s.samples[key]
+	if !ok {
+		if len(s.samples) >= s.max {
+			s.expire(now)
+		}
+		if len(s.samples) >= s.max {
+			return
+		}
+		sample = &ipSample{}
+		s.samples[key] = sample
+	}
+	sample.bytes += float64(flow.Bytes)
+	sample.lastSeen = now
+}
+
+// expire drops samples not seen within ttl, s.mu held
+func (s *IPSampler) expire(now time.Time) {
+	for key, sample := range s.samples {
+		if now.Sub(sample.lastSeen) > s.ttl {
+			delete(s.samples, key)
+		}
+	}
+}
+
+// Len returns the number of live series
+func (s *IPSampler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.samples)
+}
+
+func (s *IPSampler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *IPSampler) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	for key, sample := range s.samples {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, sample.bytes, key.asn, key.ip)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestIPSamplerRate(t *testing.T) {
+	for _, rate := range []float64{0, 0.25, 1} {
+		s := NewIPSampler(rate, time.Hour, 10, rand.New(rand.NewSource(1)))
+		for i := 0; i < 10000; i++ {
+			f := outFlow("8.8.8.8", 53, 1)
+			f.Destination.Asn = "15169"
+			s.Observe(f, time.Now())
+		}
+		got := gathered(t, s)[`flow_sampled_ip_bytes{asn="15169",ip="8.8.8.8"}`]
+		if want := rate * 10000; got < want*0.95 || got > want*1.05 {
+			t.Errorf("rate %v: sampled %v bytes, want about %v", rate, got, want)
+		}
+	}
+}
+
+func TestIPSamplerTTL(t *testing.T) {
+	s := NewIPSampler(1, 5*time.Minute, 10, rand.New(rand.NewSource(1)))
+	now := time.Now()
+	s.Observe(outFlow("8.8.8.8", 53, 100), now.Add(-10*time.Minute))
+	s.Observe(outFlow("1.1.1.1", 53, 100), now.Add(-10*time.Minute))
+	// sampled again, stays
+	s.Observe(outFlow("1.1.1.1", 53, 50), now)
+	s.Observe(outFlow("9.9.9.9", 53, 10), now)
+
+	assertGathered(t, gathered(t, s), map[string]float64{
+		`flow_sampled_ip_bytes{asn="unknown",ip="1.1.1.1"}`: 150,
+		`flow_sampled_ip_bytes{asn="unknown",ip="9.9.9.9"}`: 10,
+	})
+	if s.Len() != 2 {
+		t.Errorf("%d series after expiry, want 2", s.Len())
+	}
+}
+
+func TestIPSamplerMax(t *testing.T) {
+	s := NewIPSampler(1, 5*time.Minute, 2, rand.New(rand.NewSource(1)))
+	now := time.Now()
+	s.Observe(outFlow("8.8.8.8", 53, 1), now.Add(-10*time.Minute))
+	s.Observe(outFlow("1.1.1.1", 53, 1), now)
+	// full, but 8.8.8.8 has expired and makes room
+	s.Observe(outFlow("9.9.9.9", 53, 1), now)
+	// full with live series
+	s.Observe(outFlow("4.4.4.4", 53, 1), now)
+
+	assertGathered(t, gathered(t, s), map[string]float64{
+		`flow_sampled_ip_bytes{asn="unknown",ip="1.1.1.1"}`: 1,
+		`flow_sampled_ip_bytes{asn="unknown",ip="9.9.9.9"}`: 1,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var seriesTTL = flag.Duration("series-ttl", 0, "Delete series of the byte, packet and location counters not updated for this long, e.g. 24h, 0 keeps them forever")
+
+// set in main with -series-ttl
+var janitor *SeriesJanitor
+
+var flowSeriesEvicted = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "flow_series_evicted_total",
+		Help: "Counter series deleted by -series-ttl",
+	},
+)
+
+type seriesEntry struct {
+	labels   prometheus.Labels
+	lastSeen time.Time
+}
+
+// SeriesJanitor remembers when each series of the flag dependent counters
+// was last updated and deletes those idle for longer than ttl. A deleted
+// series starts at 0 again when its traffic returns, which rate() treats
+// like a restart.
+type SeriesJanitor struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	series map[*prometheus.CounterVec]map[string]*seriesEntry
+}
+
+func NewSeriesJanitor(ttl time.Duration) *SeriesJanitor {
+	return &SeriesJanitor{
+		ttl:    ttl,
+		series: make(map[*prometheus.CounterVec]map[string]*seriesEntry),
+	}
+}
+
+// Touch marks the series of vec with labels as updated at now
+func (j *SeriesJanitor) Touch(vec *prometheus.CounterVec, labels prometheus.Labels, now time.Time) {
+	key := seriesKey(labels)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, ok := j.series[vec]
+	if !ok {
+		entries = make(map[string]*seriesEntry)
+		j.series[vec] = entries
+	}
+	if entry, ok := entries[key]; ok {
+		entry.lastSeen = now
+		return
+	}
+	entries[key] = &seriesEntry{labels: labels, lastSeen: now}
+}
+
+// Sweep deletes the series idle since before now - ttl, returning how many
+func (j *SeriesJanitor) Sweep(now time.Time) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	deleted := 0
+	for vec, entries := range j.series {
+		for key, entry := range entries {
+			if now.Sub(entry.lastSeen) <= j.ttl {
+				continue
+			}
+			vec.Delete(entry.labels)
+			delete(entries, key)
+			deleted++
+		}
+	}
+	flowSeriesEvicted.Add(float64(deleted))
+	return deleted
+}
+
+// Run sweeps every tenth of the ttl, at most every second, until stop is
+// closed
+func (j *SeriesJanitor) Run(stop <-chan struct{}) {
+	interval := j.ttl / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			j.Sweep(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// seriesKey identifies a label set independent of map order
+func seriesKey(labels prometheus.Labels) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"\x00"+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x01")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jsonOut       = flag.String("json-out", "", "Append enriched flows as JSON lines to this file, - for stdout")
+	jsonOutFields = flag.String("json-out-fields", "", "Comma separated fields written by -json-out, default all")
+	jsonOutSample = flag.Int("json-out-sample", 1, "Write only 1 in N flows to -json-out, records carry sample_rate to scale totals back up")
+)
+
+// jsonFields maps the field names of -json-out records to their value
+var jsonFields = map[string]func(f *Flow) interface{}{
+	"ip_src":    func(f *Flow) interface{} { return f.IpSrc.String() },
+	"ip_dst":    func(f *Flow) interface{} { return f.IpDst.String() },
+	"port_src":  func(f *Flow) interface{} { return f.SrcPort },
+	"port_dst":  func(f *Flow) interface{} { return f.DstPort },
+	"proto":     func(f *Flow) interface{} { return NormalizeProto(f.Proto) },
+	"packets":   func(f *Flow) interface{} { return f.Packages },
+	"bytes":     func(f *Flow) interface{} { return f.Bytes },
+	"direction": func(f *Flow) interface{} { return f.Direction },
+	"private":   func(f *Flow) interface{} { return f.PrivateRaw },
+	"exporter":  func(f *Flow) interface{} { return f.Exporter },
+	"label":     func(f *Flow) interface{} { return f.Label },
+	"timestamp": func(f *Flow) interface{} {
+		if f.Timestamp.IsZero() {
+			return nil
+		}
+		return f.Timestamp
+	},
+}
+
+func init() {
+	peerFields := map[string]func(p *Peer) interface{}{
+		"country":         func(p *Peer) interface{} { return p.Country },
+		"country_iso":     func(p *Peer) interface{} { return p.CountryISO },
+		"continent":       func(p *Peer) interface{} { return p.Continent },
+		"continent_code":  func(p *Peer) interface{} { return p.ContinentCode },
+		"city":            func(p *Peer) interface{} { return p.City },
+		"asn":             func(p *Peer) interface{} { return p.Asn },
+		"asn_org":         func(p *Peer) interface{} { return p.AsnOrg },
+		"latitude":        func(p *Peer) interface{} { return p.Latitude },
+		"longitude":       func(p *Peer) interface{} { return p.Longitude },
+		"hostname":        func(p *Peer) interface{} { return p.Hostname },
+		"isp":             func(p *Peer) interface{} { return p.Isp },
+		"connection_type": func(p *Peer) interface{} { return p.ConnectionType },
+	}
+	for name, get := range peerFields {
+		get := get
+		jsonFields["src_"+name] = func(f *Flow) interface{} { return get(f.Source) }
+		jsonFields["dst_"+name] = func(f *Flow) interface{} { return get(f.Destination) }
+	}
+}
+
+// ParseJSONFields validates a comma separated field list, empty means all
+func ParseJSONFields(list string) ([]string, error) {
+	if list == "" {
+		fields := make([]string, 0, len(jsonFields))
+		for name := range jsonFields {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		return fields, nil
+	}
+
+	var fields []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := jsonFields[name]; !ok {
+			return nil, fmt.Errorf("unknown -json-out-fields field %q", name)
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// ProjectFlow returns the selected fields of a flow
+func ProjectFlow(f *Flow, fields []string) map[string]interface{} {
+	record := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		record[name] = jsonFields[name](f)
+	}
+	return record
+}
+
+// FlowID hashes what identifies a flow record, the same flow always gets
+// the same id
+func FlowID(f *Flow) uint64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s|%s|%d|%d|%s|%s|%d",
+		f.IpSrcRaw, f.IpDstRaw, f.SrcPort, f.DstPort, f.Proto, f.ExporterRaw, f.Timestamp.UnixNano())
+	return mix64(hash.Sum64())
+}
+
+// JSONWriter appends flows as JSON lines
+type JSONWriter struct {
+	fields []string
+	// keep 1 in sample flows, chosen by FlowID so a rerun keeps the same ones
+	sample int
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewJSONWriter(path string, fields []string, sample int) (*JSONWriter, error) {
+	var out io.WriteCloser = os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	buf := bufio.NewWriter(out)
+	return &JSONWriter{
+		fields: fields,
+		sample: sample,
+		out:    out,
+		buf:    buf,
+		enc:    json.NewEncoder(buf),
+	}, nil
+}
+
+func (w *JSONWriter) Write(f *Flow) error {
+	if w.sample > 1 && FlowID(f)%uint64(w.sample) != 0 {
+		return nil
+	}
+	record := ProjectFlow(f, w.fields)
+	if w.sample > 1 {
+		record["sample_rate"] = w.sample
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(record)
+}
+
+// WriteSession appends an assembled session, whatever -json-out-fields
+// and -json-out-sample select of the flows
+func (w *JSONWriter) WriteSession(s *Session) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(s.Record())
+}
+
+func (w *JSONWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Flush()
+}
+
+// Run flushes every interval until stop is closed, so the file can be tailed
+func (w *JSONWriter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *JSONWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.out == os.Stdout {
+		return nil
+	}
+	return w.out.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseJSONFields(t *testing.T) {
+	fields, err := ParseJSONFields(" bytes, dst_country ,direction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fields, ","); got != "bytes,dst_country,direction" {
+		t.Errorf("fields %s", got)
+	}
+
+	if _, err := ParseJSONFields("bytes,src_password"); err == nil {
+		t.Error("unknown field accepted")
+	}
+
+	all, err := ParseJSONFields("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(jsonFields) || !sort.StringsAreSorted(all) {
+		t.Errorf("default fields %v, want all %d sorted", all, len(jsonFields))
+	}
+}
+
+func TestJSONWriterSelectedFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.json")
+	w, err := NewJSONWriter(path, []string{"bytes", "direction", "dst_country"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Flow{
+		IpSrc:       netaddr.MustParseIP("10.0.0.1"),
+		IpDst:       netaddr.MustParseIP("8.8.8.8"),
+		Bytes:       1500,
+		Direction:   "out",
+		Source:      &Peer{Ip: netaddr.MustParseIP("10.0.0.1")},
+		Destination: &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States"},
+	}
+	if err := w.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"bytes": 1500.0, "direction": "out", "dst_country": "United States"}
+	if len(record) != len(want) {
+		t.Errorf("record %v, want only %v", record, want)
+	}
+	for name, value := range want {
+		if record[name] != value {
+			t.Errorf("%s = %v, want %v", name, record[name], value)
+		}
+	}
+	// the addresses were not selected
+	if strings.Contains(string(data), "10.0.0.1") {
+		t.Errorf("unselected address written: %s", data)
+	}
+}
+
+func TestJSONWriterSample(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.json")
+	w, err := NewJSONWriter(path, []string{"port_src", "bytes"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []int
+	for port := 0; port < 10000; port++ {
+		f := &Flow{IpSrcRaw: "10.0.0.1", IpDstRaw: "8.8.8.8", SrcPort: port, Bytes: 100,
+			Source: &Peer{}, Destination: &Peer{}}
+		if FlowID(f)%10 == 0 {
+			kept = append(kept, port)
+		}
+		w.Write(f)
+	}
+	w.Close()
+
+	if len(kept) < 900 || len(kept) > 1100 {
+		t.Errorf("kept %d of 10000 flows at 1 in 10", len(kept))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(kept) {
+		t.Fatalf("%d records, want %d", len(lines), len(kept))
+	}
+	var total float64
+	for i, line := range lines {
+		var record map[string]float64
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		// the same flows on every run
+		if record["port_src"] != float64(kept[i]) {
+			t.Errorf("record %d of port %v, want %d", i, record["port_src"], kept[i])
+		}
+		if record["sample_rate"] != 10 {
+			t.Errorf("record %d: sample_rate %v", i, record["sample_rate"])
+		}
+		total += record["bytes"] * record["sample_rate"]
+	}
+	// totals reconstructed from the sample
+	if total < 900000 || total > 1100000 {
+		t.Errorf("reconstructed %v bytes, want about 1000000", total)
+	}
+}
+
+func TestJSONWriterUnsampled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.json")
+	w, err := NewJSONWriter(path, []string{"bytes"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Write(&Flow{SrcPort: i, Bytes: 1})
+	}
+	w.Close()
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\"bytes\":1}\n{\"bytes\":1}\n{\"bytes\":1}\n" {
+		t.Errorf("unsampled output %q", data)
+	}
+}
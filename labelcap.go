@@ -0,0 +1,32 @@
+package main
+
+import "sync"
+
+// LabelCap passes through the first max distinct values of a label and maps
+// every later one to "other", bounding the series a label can create
+type LabelCap struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func NewLabelCap(max int) *LabelCap {
+	return &LabelCap{max: max, seen: make(map[string]struct{})}
+}
+
+func (c *LabelCap) Value(value string) string {
+	if value == "" {
+		return value
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[value]; ok {
+		return value
+	}
+	if len(c.seen) >= c.max {
+		return "other"
+	}
+	c.seen[value] = struct{}{}
+	return value
+}
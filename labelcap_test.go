@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestLabelCap(t *testing.T) {
+	c := NewLabelCap(2)
+	for _, test := range []struct{ value, want string }{
+		{"voip", "voip"},
+		{"", ""},
+		{"backup", "backup"},
+		{"video", "other"},
+		{"voip", "voip"},
+	} {
+		if got := c.Value(test.value); got != test.want {
+			t.Errorf("%q: %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTagLabel(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction,tag", "tag-max-values": "1"})
+	registry := setupTestMetrics(t)
+
+	lines := []string{
+		`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "bytes": 100, "label": "voip"}`,
+		`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "bytes": 10}`,
+		`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "bytes": 1, "label": "backup"}`,
+	}
+	for _, line := range lines {
+		var f Flow
+		if err := unmarshalFlow(line, &f, nil); err != nil {
+			t.Fatal(err)
+		}
+		f.IpSrc, f.IpDst = netaddr.MustParseIP(f.IpSrcRaw), netaddr.MustParseIP(f.IpDstRaw)
+		f.Source, f.Destination = &Peer{Ip: f.IpSrc}, &Peer{Ip: f.IpDst}
+		f.Direction = "out"
+		LogPrometheus(&f)
+	}
+
+	got := gatheredFrom(t, registry)
+	for key, want := range map[string]float64{
+		`flow_direction_bytes{direction="out",tag="voip"}`: 100,
+		// without a label the tag is empty
+		`flow_direction_bytes{direction="out",tag=""}`: 10,
+		// over -tag-max-values
+		`flow_direction_bytes{direction="out",tag="other"}`: 1,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var labelsFlag = flag.String("labels", "", "Comma separated labels of the byte and packet counters: direction, private, country, continent, city, asn, asn_org, proto, port, exporter or tag, empty keeps the default")
+
+// labels of the byte and packet counters without -labels
+var defaultFlowLabels = []string{"direction", "private", "country", "asn", "asn_org", "exporter", "tag"}
+
+// -labels, the other label flags add theirs after these
+var flowLabels = defaultFlowLabels
+
+// flowLabelValues are the labels -labels chooses from, computed from the
+// flow and its remote peer
+var flowLabelValues = map[string]func(flow *Flow, peer *Peer) string{
+	"direction": func(flow *Flow, peer *Peer) string { return flow.Direction },
+	"private":   func(flow *Flow, peer *Peer) string { return flow.PrivateRaw },
+	"country":   func(flow *Flow, peer *Peer) string { return geoLabel(peer.Country) },
+	"continent": func(flow *Flow, peer *Peer) string { return geoLabel(peer.Continent) },
+	"city":      func(flow *Flow, peer *Peer) string { return geoLabel(peer.City) },
+	"asn":       func(flow *Flow, peer *Peer) string { return geoLabel(peer.Asn) },
+	"asn_org":   func(flow *Flow, peer *Peer) string { return geoLabel(peer.AsnOrg) },
+	"proto":     func(flow *Flow, peer *Peer) string { return geoLabel(NormalizeProto(flow.Proto)) },
+	"port":      func(flow *Flow, peer *Peer) string { return ServicePort(flow.SrcPort, flow.DstPort, *portMax) },
+	// empty for pmacctd, only set by collectors
+	"exporter": func(flow *Flow, peer *Peer) string { return flow.Exporter },
+	// pmacct's label primitive, empty unless tagged in pmacct config
+	"tag": func(flow *Flow, peer *Peer) string { return tagCap.Value(flow.Label) },
+}
+
+// ParseLabels parses -labels, empty is the default set
+func ParseLabels(spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return defaultFlowLabels, nil
+	}
+	var labels []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := flowLabelValues[name]; !ok {
+			return nil, fmt.Errorf("unknown label %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("label %q is listed twice", name)
+		}
+		seen[name] = true
+		labels = append(labels, name)
+	}
+	return labels, nil
+}
+
+func hasLabel(labels []string, name string) bool {
+	for _, label := range labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	learnFor    = flag.Duration("learn", 0, "Observe traffic for this long, print a label set that fits -learn-budget and exit")
+	learnBudget = flag.Int("learn-budget", 10000, "Series budget for the label set suggested by -learn")
+)
+
+// learnCandidates are the peer labels considered by -learn, most useful
+// first, all of them accepted by -labels
+var learnCandidates = []string{"country", "asn", "asn_org", "city"}
+
+func candidateValue(name string, peer *Peer) string {
+	switch name {
+	case "country":
+		return peer.Country
+	case "asn":
+		return peer.Asn
+	case "asn_org":
+		return peer.AsnOrg
+	case "city":
+		return peer.City
+	}
+	return ""
+}
+
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct values added to it
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func (h *hyperLogLog) Add(value string) {
+	hash := fnv.New64a()
+	io.WriteString(hash, value)
+	x := mix64(hash.Sum64())
+
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// mix64 spreads fnv output over all bits, fnv alone clusters short keys
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb3fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Learner estimates the series count of every combination of candidate
+// labels, on top of the always present direction and private labels.
+type Learner struct {
+	mu     sync.Mutex
+	flows  int
+	combos map[uint]*hyperLogLog
+}
+
+func NewLearner() *Learner {
+	l := &Learner{combos: make(map[uint]*hyperLogLog)}
+	for set := uint(0); set < 1<<len(learnCandidates); set++ {
+		l.combos[set] = &hyperLogLog{}
+	}
+	return l
+}
+
+func (l *Learner) Observe(flow *Flow) {
+	peer := flow.RemotePeer()
+	if peer == nil {
+		return
+	}
+
+	values := make([]string, len(learnCandidates))
+	for i, name := range learnCandidates {
+		values[i] = candidateValue(name, peer)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flows++
+	var key strings.Builder
+	for set, hll := range l.combos {
+		key.Reset()
+		key.WriteString(flow.Direction)
+		key.WriteByte(0)
+		key.WriteString(flow.PrivateRaw)
+		for i, v := range values {
+			if set&(1<<i) != 0 {
+				key.WriteByte(0)
+				key.WriteString(v)
+			}
+		}
+		hll.Add(key.String())
+	}
+}
+
+func setLabels(set uint) []string {
+	labels := []string{"direction", "private"}
+	for i, name := range learnCandidates {
+		if set&(1<<i) != 0 {
+			labels = append(labels, name)
+		}
+	}
+	return labels
+}
+
+// Suggest returns the label set with the most candidate labels whose
+// estimated series count stays within budget, preferring fewer series.
+func (l *Learner) Suggest(budget uint64) (labels []string, series uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	best := uint(0)
+	bestCount := -1
+	bestSeries := l.combos[0].Estimate()
+	for set, hll := range l.combos {
+		estimate := hll.Estimate()
+		count := bits.OnesCount(set)
+		if estimate > budget {
+			continue
+		}
+		if count > bestCount || (count == bestCount && estimate < bestSeries) {
+			best, bestCount, bestSeries = set, count, estimate
+		}
+	}
+	return setLabels(best), bestSeries
+}
+
+func (l *Learner) Report(w io.Writer, budget uint64) {
+	l.mu.Lock()
+	fmt.Fprintf(w, "learned from %d flows, estimated series per label:\n", l.flows)
+	type row struct {
+		name   string
+		series uint64
+	}
+	rows := make([]row, len(learnCandidates))
+	for i, name := range learnCandidates {
+		rows[i] = row{name, l.combos[1<<i].Estimate()}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].series < rows[j].series })
+	for _, r := range rows {
+		fmt.Fprintf(w, "  %-8s %d\n", r.name, r.series)
+	}
+
+	labels, series := l.Suggest(budget)
+	fmt.Fprintf(w, "suggested flags (~%d series, budget %d):\n  %s\n", series, budget, suggestedFlags(labels))
+}
+
+// suggestedFlags renders a label set as flags to paste into the command line
+func suggestedFlags(labels []string) string {
+	return "-labels=" + strings.Join(labels, ",")
+}
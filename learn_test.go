@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 50000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("value-%d", i))
+			// duplicates don't count
+			h.Add(fmt.Sprintf("value-%d", i/2))
+		}
+		estimate := float64(h.Estimate())
+		if diff := (estimate - float64(n)) / float64(n); diff < -0.05 || diff > 0.05 {
+			t.Errorf("%d distinct values estimated as %v", n, estimate)
+		}
+	}
+}
+
+// learnFlows feeds synthetic inbound flows: 8 countries, 200 ASNs with one
+// organization each, and 1000 cities spread over 5000 remote addresses
+func learnFlows(l *Learner) {
+	for i := 0; i < 20000; i++ {
+		ipIndex := i % 5000
+		asn := ipIndex % 200
+		ip := netaddr.IPv4(11, byte(ipIndex>>8), byte(ipIndex), 1)
+		l.Observe(&Flow{
+			Direction:  "in",
+			PrivateRaw: "mixed",
+			Source: &Peer{
+				Ip:      ip,
+				Country: fmt.Sprintf("country-%d", asn%8),
+				Asn:     fmt.Sprint(asn),
+				AsnOrg:  fmt.Sprintf("org-%d", asn),
+				City:    fmt.Sprintf("city-%d", ipIndex%1000),
+			},
+		})
+	}
+}
+
+func TestLearnerSuggest(t *testing.T) {
+	l := NewLearner()
+	learnFlows(l)
+
+	tests := []struct {
+		budget uint64
+		labels string
+	}{
+		// every other label follows from city
+		{2000, "direction,private,country,asn,asn_org,city"},
+		{500, "direction,private,country,asn,asn_org"},
+		{100, "direction,private,country"},
+		{0, "direction,private"},
+		{1000000, "direction,private,country,asn,asn_org,city"},
+	}
+	for _, test := range tests {
+		labels, series := l.Suggest(test.budget)
+		if got := strings.Join(labels, ","); got != test.labels {
+			t.Errorf("budget %d: suggested %s (~%d series), want %s", test.budget, got, series, test.labels)
+		}
+		if test.budget > 0 && series > test.budget {
+			t.Errorf("budget %d: suggested %d series", test.budget, series)
+		}
+	}
+}
+
+func TestLearnerIgnoresUnknownDirection(t *testing.T) {
+	l := NewLearner()
+	l.Observe(&Flow{Direction: "unknown", Source: &Peer{}, Destination: &Peer{}})
+	if l.flows != 0 {
+		t.Errorf("learned from %d flows without a remote peer", l.flows)
+	}
+}
+
+func TestLearnerReport(t *testing.T) {
+	l := NewLearner()
+	learnFlows(l)
+
+	var out bytes.Buffer
+	l.Report(&out, 500)
+	report := out.String()
+	for _, want := range []string{"learned from 20000 flows", "suggested flags", "-labels=direction,private,country,asn,asn_org\n"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestSuggestedFlagsParse(t *testing.T) {
+	l := NewLearner()
+	learnFlows(l)
+
+	for _, budget := range []uint64{0, 500, 2000, 1000000} {
+		labels, _ := l.Suggest(budget)
+		flags := suggestedFlags(labels)
+		spec, ok := strings.CutPrefix(flags, "-labels=")
+		if !ok {
+			t.Fatalf("budget %d: suggested %q, want -labels=", budget, flags)
+		}
+		parsed, err := ParseLabels(spec)
+		if err != nil {
+			t.Errorf("budget %d: -labels rejects the suggestion %q: %v", budget, spec, err)
+			continue
+		}
+		if strings.Join(parsed, ",") != strings.Join(labels, ",") {
+			t.Errorf("budget %d: -labels=%s parses as %v", budget, spec, parsed)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	logFormat    = flag.String("log-format", "text", "Format of logs and -verbose flow output: text, or json for log shippers")
+	logLevelFlag = flag.String("log-level", "info", "Least severe level logged: debug, info, warn or error, -verbose is the same as debug")
+)
+
+// all -json-out fields, what a flow is logged with
+var flowLogFields []string
+
+// SetupLogging checks -log-format and -log-level and makes a logger writing
+// to out the default. Until then slog writes through the log package.
+func SetupLogging(out io.Writer) error {
+	if err := baseLevel.UnmarshalText([]byte(*logLevelFlag)); err != nil {
+		return fmt.Errorf("unknown -log-level %q", *logLevelFlag)
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		return fmt.Errorf("unknown -log-format %q", *logFormat)
+	}
+	logLevel.Set(baseLevel)
+	flowLogFields, _ = ParseJSONFields("")
+	slog.SetDefault(newLogger(out))
+	return nil
+}
+
+// newLogger returns a logger in -log-format at the current level
+func newLogger(out io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if *logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts))
+	}
+	return slog.New(slog.NewTextHandler(out, opts))
+}
+
+// fatal logs msg with args as error and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// LogFlow logs a flow at debug level with all -json-out fields
+func LogFlow(flow *Flow) {
+	slog.Debug("flow", "flow", ProjectFlow(flow, flowLogFields))
+}
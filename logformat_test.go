@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// captureLogs makes slog write to the returned buffer in format at level,
+// until the test ends
+func captureLogs(t *testing.T, format, level string) *bytes.Buffer {
+	t.Helper()
+	setFlags(t, map[string]string{"log-format": format, "log-level": level})
+	savedLogger, savedLevel, savedBase, savedFields := slog.Default(), logLevel.Level(), baseLevel, flowLogFields
+	t.Cleanup(func() {
+		slog.SetDefault(savedLogger)
+		logLevel.Set(savedLevel)
+		baseLevel, flowLogFields = savedBase, savedFields
+	})
+	var buf bytes.Buffer
+	if err := SetupLogging(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	buf := captureLogs(t, "json", "debug")
+
+	slog.Info("started", "workers", 2)
+	LogFlow(&Flow{
+		IpSrc: netaddr.MustParseIP("10.0.0.1"), IpDst: netaddr.MustParseIP("8.8.8.8"),
+		DstPort: 53, Proto: "17", Bytes: 140, Direction: "out",
+		Source:      &Peer{Ip: netaddr.MustParseIP("10.0.0.1")},
+		Destination: &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States"},
+	})
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%v: %s", err, scanner.Text())
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d lines, want 2", len(records))
+	}
+	if records[0]["msg"] != "started" || records[0]["level"] != "INFO" || records[0]["workers"] != 2.0 {
+		t.Errorf("log line %v", records[0])
+	}
+	flow, ok := records[1]["flow"].(map[string]interface{})
+	if !ok || records[1]["level"] != "DEBUG" {
+		t.Fatalf("flow line %v", records[1])
+	}
+	for field, want := range map[string]interface{}{
+		"ip_dst": "8.8.8.8", "port_dst": 53.0, "proto": "udp", "bytes": 140.0,
+		"direction": "out", "dst_country": "United States",
+	} {
+		if flow[field] != want {
+			t.Errorf("flow %s = %v, want %v", field, flow[field], want)
+		}
+	}
+}
+
+func TestLogFormatTextDefault(t *testing.T) {
+	buf := captureLogs(t, "text", "info")
+	slog.Info("started", "workers", 2)
+	// below -log-level
+	LogFlow(&Flow{Source: &Peer{}, Destination: &Peer{}})
+
+	if got := buf.String(); !strings.Contains(got, "level=INFO msg=started workers=2") || strings.Count(got, "\n") != 1 {
+		t.Errorf("text output %q", got)
+	}
+}
+
+func TestSetupLoggingInvalid(t *testing.T) {
+	defer func(saved slog.Level) { baseLevel = saved }(baseLevel)
+	for _, flags := range []map[string]string{
+		{"log-format": "xml", "log-level": "info"},
+		{"log-format": "json", "log-level": "loud"},
+	} {
+		setFlags(t, flags)
+		if err := SetupLogging(&bytes.Buffer{}); err == nil {
+			t.Errorf("%v accepted", flags)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var logLevelToken = flag.String("loglevel-token", "", "Enable POST /loglevel?level=debug|info|warn|error[&ttl=10m] to switch the log level at runtime, authorized by this bearer token")
+
+var (
+	// level of the default logger, -log-level or debug with -verbose, and
+	// swapped by /loglevel
+	logLevel = new(slog.LevelVar)
+	// -log-level
+	baseLevel slog.Level
+)
+
+// isVerbose reports whether debug output such as per flow dumps is on
+func isVerbose() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+// setVerbose switches between debug and -log-level
+func setVerbose(on bool) {
+	if on {
+		logLevel.Set(slog.LevelDebug)
+	} else {
+		logLevel.Set(baseLevel)
+	}
+}
+
+// LogLevelHandler switches the log level at runtime, after ttl it reverts to
+// -log-level, or debug with -verbose
+type LogLevelHandler struct {
+	token string
+
+	mu     sync.Mutex
+	revert *time.Timer
+}
+
+func NewLogLevelHandler(token string) *LogLevelHandler {
+	return &LogLevelHandler{token: token}
+}
+
+func (h *LogLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+		http.Error(w, fmt.Sprintf("unknown level %q, debug, info, warn or error", r.URL.Query().Get("level")), http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		var err error
+		if ttl, err = time.ParseDuration(raw); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("bad ttl %q", raw), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.revert != nil {
+		h.revert.Stop()
+		h.revert = nil
+	}
+	logLevel.Set(level)
+	if ttl > 0 {
+		h.revert = time.AfterFunc(ttl, func() { setVerbose(*verbose) })
+	}
+	slog.Info("log level set", "level", level, "by", r.RemoteAddr)
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postLogLevel(h http.Handler, method, token, query string) int {
+	r := httptest.NewRequest(method, "/loglevel?"+query, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	buf := captureLogs(t, "text", "info")
+	h := NewLogLevelHandler("secret")
+
+	for _, c := range []struct {
+		method, token, query string
+		code                 int
+	}{
+		{http.MethodGet, "secret", "level=debug", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", "level=debug", http.StatusUnauthorized},
+		{http.MethodPost, "wrong", "level=debug", http.StatusUnauthorized},
+		{http.MethodPost, "secret", "level=loud", http.StatusBadRequest},
+		{http.MethodPost, "secret", "level=debug&ttl=-1s", http.StatusBadRequest},
+	} {
+		if code := postLogLevel(h, c.method, c.token, c.query); code != c.code {
+			t.Errorf("%s %q with %q: %d, want %d", c.method, c.query, c.token, code, c.code)
+		}
+	}
+	slog.Debug("hidden")
+	if strings.Contains(buf.String(), "hidden") || isVerbose() {
+		t.Fatalf("rejected requests changed the level: %q", buf.String())
+	}
+
+	if code := postLogLevel(h, http.MethodPost, "secret", "level=debug"); code != http.StatusOK {
+		t.Fatalf("level=debug: %d", code)
+	}
+	slog.Debug("shown")
+	if !strings.Contains(buf.String(), "msg=shown") || !isVerbose() {
+		t.Errorf("debug output after level=debug: %q", buf.String())
+	}
+
+	if code := postLogLevel(h, http.MethodPost, "secret", "level=error"); code != http.StatusOK {
+		t.Fatalf("level=error: %d", code)
+	}
+	buf.Reset()
+	slog.Warn("quiet")
+	if buf.Len() != 0 {
+		t.Errorf("warn output after level=error: %q", buf.String())
+	}
+}
+
+func TestLogLevelHandlerTTL(t *testing.T) {
+	captureLogs(t, "text", "info")
+	h := NewLogLevelHandler("secret")
+
+	if code := postLogLevel(h, http.MethodPost, "secret", "level=debug&ttl=20ms"); code != http.StatusOK {
+		t.Fatalf("level=debug&ttl=20ms: %d", code)
+	}
+	if !isVerbose() {
+		t.Fatal("level not switched to debug")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for isVerbose() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := logLevel.Level(); got != slog.LevelInfo {
+		t.Errorf("level after ttl %v, want INFO", got)
+	}
+}
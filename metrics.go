@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	metricNamespace = flag.String("metric-namespace", "", "Prefix of every flow metric, e.g. pmacct exports pmacct_flow_direction_bytes")
+	metricSubsystem = flag.String("metric-subsystem", "", "Prefix between -metric-namespace and the metric name")
+
+	basicAuthUser = flag.String("basic-auth-user", "", "Require this user for /metrics, together with -basic-auth-pass")
+	basicAuthPass = flag.String("basic-auth-pass", "", "Password of -basic-auth-user")
+
+	openMetrics = flag.Bool("openmetrics", false, "Serve the OpenMetrics format to scrapers asking for it, the Prometheus text format stays the default")
+	exemplars   = flag.Bool("exemplars", false, "Attach the remote IP of the last flow as exemplar to the byte and packet counters, needs -openmetrics")
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type metricSpec struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// metricSchema collects the label set of every flag dependent counter before
+// any of them is constructed, so that conflicting flags end in an error at
+// startup instead of a registration panic.
+type metricSchema struct {
+	specs []*metricSpec
+	index map[string]*metricSpec
+}
+
+func newMetricSchema() *metricSchema {
+	return &metricSchema{index: make(map[string]*metricSpec)}
+}
+
+// Add declares a counter, declaring it again is only fine with the same labels
+func (s *metricSchema) Add(name, help string, labels ...string) error {
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("metric %s: invalid label name %q", name, label)
+		}
+		if seen[label] {
+			return fmt.Errorf("metric %s: label %q is requested by more than one flag", name, label)
+		}
+		seen[label] = true
+	}
+
+	if existing, ok := s.index[name]; ok {
+		if strings.Join(existing.labels, ",") != strings.Join(labels, ",") {
+			return fmt.Errorf("metric %s requested with labels [%s] and [%s], check the label flags",
+				name, strings.Join(existing.labels, ","), strings.Join(labels, ","))
+		}
+		return nil
+	}
+
+	spec := &metricSpec{name, help, labels}
+	s.specs = append(s.specs, spec)
+	s.index[name] = spec
+	return nil
+}
+
+// directionMetric returns the name, help and first label of the byte counter
+func directionMetric() (name, help, label string) {
+	if *senseLabel {
+		return "flow_bytes", "Bytes by sense, local_to_remote or remote_to_local", "sense"
+	}
+	return "flow_direction_bytes", "in or out Bytes", "direction"
+}
+
+// packetMetric is the packet counter matching directionMetric
+func packetMetric() (name, help string) {
+	if *senseLabel {
+		return "flow_packets", "Packets by sense, local_to_remote or remote_to_local"
+	}
+	return "flow_direction_packets", "in or out Packets"
+}
+
+// BuildSchema computes the final label sets from the active flags
+func BuildSchema() (*metricSchema, error) {
+	s := newMetricSchema()
+
+	name, help, first := directionMetric()
+	var labels []string
+	for _, label := range flowLabels {
+		switch {
+		case label == "direction":
+			labels = append(labels, first)
+		case label == "asn_org" && *combineASN:
+			// part of asn
+		default:
+			labels = append(labels, label)
+		}
+	}
+	if *asnGroupsFile != "" {
+		labels = append(labels, "network_group")
+	}
+	if *asRelationshipsFile != "" {
+		labels = append(labels, "relationship")
+	}
+	if *domainGroupsFile != "" {
+		labels = append(labels, "domain_group")
+	}
+	if *specialUseLabel {
+		labels = append(labels, "special_use")
+	}
+	if *replayLabel {
+		labels = append(labels, "source_file")
+	}
+	if *localLabel {
+		labels = append(labels, "local")
+	}
+	// the same as listing them in -labels
+	if *cityLabel && !hasLabel(labels, "city") {
+		labels = append(labels, "city")
+	}
+	if *continentLabel && !hasLabel(labels, "continent") {
+		labels = append(labels, "continent")
+	}
+	if *protoLabel && !hasLabel(labels, "proto") {
+		labels = append(labels, "proto")
+	}
+	if *geoipISP != "" {
+		labels = append(labels, "isp")
+	}
+	if *geoipConnectionType != "" {
+		labels = append(labels, "connection_type")
+	}
+	if err := s.Add(name, help, labels...); err != nil {
+		return nil, err
+	}
+	// same labels as the byte counter, so both can be divided
+	packetName, packetHelp := packetMetric()
+	if err := s.Add(packetName, packetHelp, labels...); err != nil {
+		return nil, err
+	}
+
+	if *fullLabels {
+		if err := s.Add("flow_bytes_total", "Bytes by country and asn of source and destination",
+			"country_src", "country_dst", "asn_src", "asn_dst", "direction"); err != nil {
+			return nil, err
+		}
+	}
+	if *openMetrics {
+		if err := s.checkFamilies(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// checkFamilies rejects counters OpenMetrics would expose as one family, it
+// names a counter family without the _total suffix, so flow_bytes and
+// flow_bytes_total both become flow_bytes
+func (s *metricSchema) checkFamilies() error {
+	families := make(map[string]string, len(s.specs))
+	for _, spec := range s.specs {
+		family := strings.TrimSuffix(spec.name, "_total")
+		if other, ok := families[family]; ok {
+			return fmt.Errorf("metrics %s and %s are both the %s family in OpenMetrics, check the flags", other, spec.name, family)
+		}
+		families[family] = spec.name
+	}
+	return nil
+}
+
+// SetupMetrics constructs and registers every flag dependent counter exactly
+// once. It has to run after flag.Parse.
+func SetupMetrics(reg prometheus.Registerer) error {
+	schema, err := BuildSchema()
+	if err != nil {
+		return err
+	}
+
+	vecs := make(map[string]*prometheus.CounterVec, len(schema.specs))
+	for _, spec := range schema.specs {
+		vec := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: spec.name,
+				Help: spec.help,
+			},
+			spec.labels,
+		)
+		if err := reg.Register(vec); err != nil {
+			return fmt.Errorf("metric %s: %w", spec.name, err)
+		}
+		vecs[spec.name] = vec
+		persistentCounters[spec.name] = vec
+	}
+
+	name, _, _ := directionMetric()
+	flowDirectionBytes = vecs[name]
+	packetName, _ := packetMetric()
+	flowDirectionPackets = vecs[packetName]
+	flowBytesTotal = vecs["flow_bytes_total"]
+	tagCap = NewLabelCap(*tagMaxValues)
+	localCap = NewLabelCap(*localMaxValues)
+	return setupHistogram(reg)
+}
+
+// prefixedGatherer renames the metrics of g to namespace_subsystem_name when
+// scraped. Renaming the gathered families covers every metric, whether
+// registered by promauto at init or in SetupMetrics, and -counter-state
+// keeps seeing the plain names. The go_, process_ and promhttp_ metrics of
+// the client library keep their standard names.
+func prefixedGatherer(g prometheus.Gatherer, namespace, subsystem string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, family := range families {
+			name := family.GetName()
+			if strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_") || strings.HasPrefix(name, "promhttp_") {
+				continue
+			}
+			name = prometheus.BuildFQName(namespace, subsystem, name)
+			family.Name = &name
+		}
+		return families, err
+	})
+}
+
+// MetricsHandler serves /metrics, prefixed by -metric-namespace and
+// -metric-subsystem and behind -basic-auth-user if set
+func MetricsHandler() http.Handler {
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *metricNamespace != "" || *metricSubsystem != "" {
+		gatherer = prefixedGatherer(gatherer, *metricNamespace, *metricSubsystem)
+	}
+	handler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: *openMetrics}))
+	if *basicAuthUser != "" {
+		handler = basicAuth(handler, *basicAuthUser, *basicAuthPass)
+	}
+	return handler
+}
+
+// basicAuth passes requests with user and pass on to next, and answers 401
+// to all others
+func basicAuth(next http.Handler, user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// both compared, so the time taken tells nothing about which is wrong
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
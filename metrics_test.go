@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricSchemaConflict(t *testing.T) {
+	s := newMetricSchema()
+	if err := s.Add("flow_direction_bytes", "", "direction", "country"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("flow_direction_bytes", "", "direction", "country"); err != nil {
+		t.Errorf("same labels again: %v", err)
+	}
+	err := s.Add("flow_direction_bytes", "", "direction", "city")
+	if err == nil || !strings.Contains(err.Error(), "[direction,country] and [direction,city]") {
+		t.Errorf("conflicting labels: %v", err)
+	}
+	if len(s.specs) != 1 {
+		t.Errorf("%d specs, want the metric once", len(s.specs))
+	}
+}
+
+func TestMetricSchemaInvalidLabels(t *testing.T) {
+	tests := []struct {
+		labels []string
+		err    string
+	}{
+		{[]string{"direction", "proto", "proto"}, `label "proto" is requested by more than one flag`},
+		{[]string{"connection-type"}, `invalid label name "connection-type"`},
+		{[]string{"__name__"}, `invalid label name "__name__"`},
+	}
+	for _, test := range tests {
+		err := newMetricSchema().Add("flow_direction_bytes", "", test.labels...)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: %v, want %s", test.labels, err, test.err)
+		}
+	}
+}
+
+// withLabelFlags runs f with -labels, -label-proto and -sense set
+func withLabelFlags(t *testing.T, labels string, proto, sense bool, f func()) {
+	t.Helper()
+	defer func(savedLabels []string, savedProto, savedSense bool) {
+		flowLabels, *protoLabel, *senseLabel = savedLabels, savedProto, savedSense
+	}(flowLabels, *protoLabel, *senseLabel)
+	parsed, err := ParseLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flowLabels, *protoLabel, *senseLabel = parsed, proto, sense
+	f()
+}
+
+func TestBuildSchemaFlagCombinations(t *testing.T) {
+	// -label-proto adds nothing proto in -labels already has
+	withLabelFlags(t, "direction,proto", true, false, func() {
+		s, err := BuildSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(s.index["flow_direction_bytes"].labels, ","); got != "direction,proto" {
+			t.Errorf("labels %s", got)
+		}
+		if s.index["flow_direction_packets"] == nil {
+			t.Error("no packet counter")
+		}
+	})
+	// -sense renames the counters and their first label
+	withLabelFlags(t, "direction,country", false, true, func() {
+		s, err := BuildSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.index["flow_direction_bytes"] != nil || s.index["flow_bytes"] == nil {
+			t.Fatalf("specs %v", s.index)
+		}
+		if got := strings.Join(s.index["flow_packets"].labels, ","); got != "sense,country" {
+			t.Errorf("labels %s", got)
+		}
+	})
+}
+
+func TestParseLabelsErrors(t *testing.T) {
+	for spec, want := range map[string]string{
+		"direction,asn,asn": `label "asn" is listed twice`,
+		"direction,ip":      `unknown label "ip"`,
+	} {
+		if _, err := ParseLabels(spec); err == nil || err.Error() != want {
+			t.Errorf("%s: %v, want %s", spec, err, want)
+		}
+	}
+}
+
+func TestSetupMetricsTwiceErrs(t *testing.T) {
+	defer func(bytes, packets *prometheus.CounterVec) {
+		flowDirectionBytes, flowDirectionPackets = bytes, packets
+	}(flowDirectionBytes, flowDirectionPackets)
+
+	registry := prometheus.NewRegistry()
+	if err := SetupMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("second setup panicked: %v", r)
+		}
+	}()
+	if err := SetupMetrics(registry); err == nil {
+		t.Error("registering the counters twice succeeded")
+	}
+}
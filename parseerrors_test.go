@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlowParseErrors(t *testing.T) {
+	setFlags(t, map[string]string{"timestamp-field": "timestamp_end", "timestamp-unit": "s"})
+	defer func(saved slog.Level) { logLevel.Set(saved) }(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+
+	tests := []struct {
+		reason string
+		parse  func() error
+	}{
+		{"json", func() error {
+			_, err := MakeFlow(`{"ip_src": "10.0.0.1", "ip_d`, nil)
+			return err
+		}},
+		{"timestamp", func() error {
+			_, err := MakeFlow(`{"ip_src": "10.0.0.1", "timestamp_end": "soon"}`, nil)
+			return err
+		}},
+		{"ip_parse", func() error {
+			_, err := MakePeer("10.0.0", GeoReaders{})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		counter := flowParseErrors.With(prometheus.Labels{"reason": test.reason})
+		before := testutil.ToFloat64(counter)
+		if err := test.parse(); err == nil {
+			t.Errorf("%s: no error", test.reason)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("flow_parse_errors_total{reason=%q} grew by %v, want 1", test.reason, got)
+		}
+	}
+}
+
+func TestFlowParseErrorsValidFlow(t *testing.T) {
+	setFlags(t, map[string]string{"timestamp-field": "timestamp_end", "timestamp-unit": "s"})
+	before := map[string]float64{}
+	for _, reason := range []string{"json", "timestamp", "ip_parse"} {
+		before[reason] = testutil.ToFloat64(flowParseErrors.With(prometheus.Labels{"reason": reason}))
+	}
+	if _, err := MakeFlow(`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "timestamp_end": "1614834367"}`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MakePeer("8.8.8.8", GeoReaders{}); err != nil {
+		t.Fatal(err)
+	}
+	for reason, value := range before {
+		if got := testutil.ToFloat64(flowParseErrors.With(prometheus.Labels{"reason": reason})); got != value {
+			t.Errorf("flow_parse_errors_total{reason=%q} grew by %v on a valid flow", reason, got-value)
+		}
+	}
+}
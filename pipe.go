@@ -1,295 +1,1397 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"inet.af/netaddr"
 
-	"github.com/oschwald/geoip2-golang"
+	"github.com/patte/go-pmacct/flow"
 
 	"tailscale.com/net/interfaces"
 )
 
 var (
-	addr    = flag.String("addr", ":9590", "Listening Address for /metrics")
-	verbose = flag.Bool("verbose", false, "Be chatty on stdout")
+	addr    = flag.String("addr", ":9590", "Listening Address for /metrics, comma separated to listen on several")
+	verbose = flag.Bool("verbose", false, "Log at debug level, including every flow")
+
+	metricsPath = flag.String("metrics-path", "/metrics", "Path the metrics are served on")
+
+	tlsCert = flag.String("tls-cert", "", "Certificate file, serves HTTPS together with -tls-key")
+	tlsKey  = flag.String("tls-key", "", "Private key file of -tls-cert")
+
+	geoipCity = flag.String("geoip-city", "GeoLite2-City.mmdb", "MaxMind City database, empty skips country and city lookups")
+	geoipASN  = flag.String("geoip-asn", "GeoLite2-ASN.mmdb", "MaxMind ASN database, empty skips ASN lookups")
+	geoipLang = flag.String("geoip-lang", "en", "Language of country, city and continent names, e.g. de, fr or ja, falling back to en")
+
+	// commercial databases, off by default
+	geoipISP            = flag.String("geoip-isp", "", "MaxMind GeoIP2-ISP database, adds the isp label")
+	geoipConnectionType = flag.String("geoip-connection-type", "", "MaxMind GeoIP2-Connection-Type database, adds the connection_type label")
+
+	tagMaxValues = flag.Int("tag-max-values", 100, "Distinct values of pmacct's label primitive exported as the tag label, the rest become other")
+
+	senseLabel = flag.Bool("sense", false, "Export flow_bytes{sense=local_to_remote|remote_to_local} instead of flow_direction_bytes{direction=out|in}")
+
+	zeroBytePolicy = flag.String("zero-byte", "count", "Zero byte flows: count them in the byte counter (creating their series), or drop them before -sink")
+
+	fragmentField = flag.String("fragment-field", "", "pmacct custom primitive flagging fragmented flows, counted in flow_fragmented_bytes")
+
+	unknownLabel = flag.String("unknown-country-label", "unknown", "Value of country, asn and asn_org labels the geo databases have no answer for")
+
+	localLabel     = flag.Bool("label-local", false, "Add the local address of each flow as local label, named via -host-labels")
+	localMaxValues = flag.Int("local-max-values", 50, "Distinct values of the local label, the rest become other")
+
+	fullLabels = flag.Bool("full-labels", false, "Also export flow_bytes_total with the country and asn of both ends, far more series than the remote end alone")
+
+	samplingRate = flag.Int("sampling-rate", 1, "Multiply bytes and packets by this before they reach -sink, for exporters that sample without telling pmacct")
+
+	cityLabel      = flag.Bool("label-city", false, "Add the city of the remote address as city label, can multiply the series count many times over")
+	continentLabel = flag.Bool("label-continent", false, "Add the continent of the remote address as continent label")
+	protoLabel     = flag.Bool("label-proto", false, "Add the protocol, e.g. tcp or udp, as proto label")
+
+	combineASN = flag.Bool("combine-asn", false, "Export the asn label as \"15169 (Google LLC)\" and drop asn_org, halving the ASN labels")
+
+	directionMode = flag.String("direction-mode", "endpoint", "endpoint: flows to or from a local address are in or out; gateway: flows entering or leaving the local networks through the WAN are")
+
+	excludeProtos     stringList
+	hairpinFlag       stringList
+	localNetworksFlag stringList
+
+	privateNetworksFlag stringList
+
+	// public addresses NATed back to local services, see -hairpin-ip
+	hairpinIps []netaddr.IP
+	// -private-networks, beside the special-use ranges
+	privateNetworks []netaddr.IPPrefix
+	// -local-networks, for capturing traffic of other hosts on a router
+	localNetworks []netaddr.IPPrefix
 )
 
-// {"event_type": "purge", "ip_src": "10.0.1.1", "ip_dst": "10.0.2.1", "packets": 2, "bytes": 143}
-type Flow struct {
-	IpSrcRaw    string `json:"ip_src"`
-	IpDstRaw    string `json:"ip_dst"`
-	IpSrc       netaddr.IP
-	IpDst       netaddr.IP
-	Packages    int    `json:"packets"`
-	Bytes       int    `json:"bytes"`
-	Proto       string `json:"proto"`
-	Direction   string
-	Private     bool
-	PrivateRaw  string
-	Source      *Peer
-	Destination *Peer
+func init() {
+	flag.Var(&excludeProtos, "exclude-proto", "Skip flows of this protocol, e.g. udp or 17 (repeatable)")
+	flag.Var(&hairpinFlag, "hairpin-ip", "Public IP(s) NATed back to a local service, flows between them and local or private addresses are private and neither in nor out (repeatable, comma separated)")
+	flag.Var(&privateNetworksFlag, "private-networks", "CIDRs counted as private beside RFC 1918, ULA and the other special-use ranges, e.g. a lab network (repeatable, comma separated)")
+	flag.Var(&localNetworksFlag, "local-networks", "CIDRs whose addresses count as local for direction, beside the own addresses (repeatable, comma separated)")
+
+	// exported at 0 from startup, so alerts on increase() see the first error
+	for _, reason := range []string{"json", "timestamp", "ip_parse", "geoip"} {
+		flowParseErrors.With(prometheus.Labels{"reason": reason})
+	}
+	for _, status := range []string{"counted", "filtered", "parse_error", "unknown_direction", "not_flow", "dropped"} {
+		flowEvents.With(prometheus.Labels{"status": status})
+	}
 }
-type Peer struct {
-	Ip         netaddr.IP
-	Country    string
-	CountryISO string
-	City       string
-	Asn        string
-	AsnOrg     string
-	Latitude   float64
-	Longitude  float64
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
 }
 
-func MakeFlow(text string, localIps []netaddr.IP, dbCity *geoip2.Reader, dbASN *geoip2.Reader) (*Flow, error) {
-	f := Flow{}
-	if err := json.Unmarshal([]byte(text), &f); err != nil {
-		return nil, err
-	}
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-	source, err := MakePeer(f.IpSrcRaw, dbCity, dbASN)
-	if err != nil && *verbose {
-		return nil, err
+// the flow types and helpers under their names from before package flow
+type (
+	Flow       = flow.Flow
+	Peer       = flow.Peer
+	jsonScalar = flow.JSONScalar
+)
+
+var (
+	Sense          = flow.Sense
+	isGlobal       = flow.IsGlobal
+	containsIP     = flow.ContainsIP
+	containsPrefix = flow.ContainsPrefix
+	privacy        = flow.Privacy
+	unmarshalFlow  = flow.Unmarshal
+	ParseTimestamp = flow.ParseTimestamp
+)
+
+// MakeFlow parses a pmacct JSON line by the parse flags, counting errors by
+// reason, and runs it through pipeline, a nil flow means a stage dropped it
+func MakeFlow(text string, pipeline Pipeline) (*Flow, error) {
+	opts := flow.ParseOptions{
+		FieldMap:       fieldMap,
+		TimestampField: *timestampField,
+		TimestampUnit:  *timestampUnit,
+		FragmentField:  *fragmentField,
 	}
-	destination, err := MakePeer(f.IpDstRaw, dbCity, dbASN)
-	if err != nil && *verbose {
+	if domainGroups != nil {
+		opts.DomainField = *domainField
+	}
+	f, err := flow.MakeFlow(text, opts)
+	if err != nil {
+		var parseErr *flow.ParseError
+		if errors.As(err, &parseErr) {
+			flowParseErrors.With(prometheus.Labels{"reason": parseErr.Reason}).Inc()
+		}
 		return nil, err
 	}
 
-	f.IpSrc = source.Ip
-	f.IpDst = destination.Ip
-
-	f.Source = source
-	f.Destination = destination
-
-	f.Direction = GetDirection(f, localIps)
-	f.Private = source.Ip.IsPrivate() && destination.Ip.IsPrivate()
-	if f.Private {
-		f.PrivateRaw = "private"
-	} else {
-		f.PrivateRaw = "public"
+	timestamp, reason := ClampTimestamp(f.Timestamp, time.Now(), *maxClockSkew)
+	if reason != "" {
+		flowBadTimestamp.With(prometheus.Labels{"reason": reason}).Inc()
 	}
+	f.Timestamp = timestamp
 
-	return &f, nil
+	keep, err := pipeline.Run(f)
+	if err != nil || !keep {
+		return nil, err
+	}
+	return f, nil
 }
 
-func MakePeer(ipRaw string, dbCity *geoip2.Reader, dbASN *geoip2.Reader) (*Peer, error) {
-	ip, err := netaddr.ParseIP(ipRaw)
+// MakePeer is flow.MakePeer with -geoip-lang, counting failed lookups and
+// discarded answers for private addresses. It applies -normalize-asn-org,
+// -geo-override and -resolve-ptr on top.
+func MakePeer(ipRaw string, dbs GeoReaders) (*Peer, error) {
+	peer, lookup, err := flow.MakePeer(ipRaw, flow.Databases{
+		City:           dbs.City,
+		ASN:            dbs.ASN,
+		ISP:            dbs.ISP,
+		ConnectionType: dbs.ConnectionType,
+	}, *geoipLang)
 	if err != nil {
+		flowParseErrors.With(prometheus.Labels{"reason": "ip_parse"}).Inc()
 		return nil, err
 	}
+	flowParseErrors.With(prometheus.Labels{"reason": "geoip"}).Add(float64(lookup.Failed))
+	if lookup.Discarded {
+		geoipPrivateHits.Inc()
+	}
+	if *normalizeASNOrg && peer.AsnOrg != "" {
+		peer.AsnOrg = NormalizeASNOrg(peer.AsnOrg, asnOrgMap)
+	}
+	applyGeoOverride(peer, geoOverrides)
 
-	var country string
-	var countryISO string
-	var city string
-	var latitude float64
-	var longitude float64
-	cityRecord, _ := dbCity.City(ip.IPAddr().IP)
-	if cityRecord != nil {
-		country = cityRecord.Country.Names["en"]
-		countryISO = cityRecord.Country.IsoCode
-		city = cityRecord.City.Names["en"]
-		latitude = cityRecord.Location.Latitude
-		longitude = cityRecord.Location.Longitude
-	}
-
-	var asn string
-	var asnOrg string
-	asnRecord, _ := dbASN.ASN(ip.IPAddr().IP)
-	if asnRecord != nil {
-		asn = strconv.FormatUint(uint64(asnRecord.AutonomousSystemNumber), 10)
-		asnOrg = asnRecord.AutonomousSystemOrganization
-	}
-
-	return &Peer{
-		Ip:         ip,
-		Country:    country,
-		CountryISO: countryISO,
-		City:       city,
-		Asn:        asn,
-		AsnOrg:     asnOrg,
-		Latitude:   latitude,
-		Longitude:  longitude,
-	}, nil
+	// private addresses rarely have a useful PTR outside the local resolver
+	if ptrCache != nil && isGlobal(peer.Ip) {
+		peer.Hostname = ptrCache.Hostname(peer.Ip, time.Now())
+	}
+
+	return peer, nil
 }
 
-func containsIP(ips []netaddr.IP, ip netaddr.IP) bool {
-	for _, ip1 := range ips {
-		if ip1 == ip {
-			return true
+// isPrivate is flow.IsPrivate with the -hairpin-ip addresses and
+// -private-networks
+func isPrivate(ip netaddr.IP) bool {
+	return flow.IsPrivate(ip, hairpinIps) || containsPrefix(privateNetworks, ip)
+}
+
+// parseIPList parses flag values holding one or more comma separated IPs
+func parseIPList(values []string) ([]netaddr.IP, error) {
+	var ips []netaddr.IP
+	for _, value := range values {
+		for _, raw := range strings.Split(value, ",") {
+			ip, err := netaddr.ParseIP(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, flow.Canonical(ip))
 		}
 	}
-	return false
+	return ips, nil
+}
+
+// parsePrefixList parses flag values holding comma separated IPs or CIDRs,
+// a plain IP is a prefix of its full length
+func parsePrefixList(values []string) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+	for _, value := range values {
+		for _, raw := range strings.Split(value, ",") {
+			raw = strings.TrimSpace(raw)
+			if !strings.Contains(raw, "/") {
+				ip, err := netaddr.ParseIP(raw)
+				if err != nil {
+					return nil, err
+				}
+				prefixes = append(prefixes, netaddr.IPPrefixFrom(ip, ip.BitLen()))
+				continue
+			}
+			prefix, err := netaddr.ParseIPPrefix(raw)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
 }
 
+// the direction strategy of -direction-mode, set in main
+var resolveDirection = flow.ResolveDirection
+
 func GetDirection(f Flow, localIps []netaddr.IP) string {
-	if containsIP(localIps, f.IpDst) {
-		return "in"
+	direction, _ := ResolveDirection(f, localIps)
+	return direction
+}
+
+// ResolveDirection resolves with the -direction-mode strategy and
+// -local-networks, after -hairpin-ip
+func ResolveDirection(f Flow, localIps []netaddr.IP) (direction string, method string) {
+	if direction, method, ok := flow.ResolveHairpin(f, hairpinIps, localIps, localNetworks); ok {
+		return direction, method
+	}
+	return resolveDirection(f, localIps, localNetworks)
+}
+
+// protocol numbers pmacct may emit instead of names
+var protoNames = map[string]string{
+	"1":   "icmp",
+	"2":   "igmp",
+	"6":   "tcp",
+	"17":  "udp",
+	"47":  "gre",
+	"50":  "esp",
+	"58":  "ipv6-icmp",
+	"132": "sctp",
+}
+
+// NormalizeProto lowercases a protocol and maps well known numbers to names
+func NormalizeProto(proto string) string {
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if name, ok := protoNames[proto]; ok {
+		return name
 	}
-	if containsIP(localIps, f.IpSrc) {
-		return "out"
+	return proto
+}
+
+func isExcludedProto(proto string) bool {
+	for _, p := range excludeProtos {
+		if NormalizeProto(p) == proto {
+			return true
+		}
 	}
-	return "unknown"
+	return false
 }
 
 var (
-	flowDirectionBytes = promauto.NewCounterVec(
+	// labels depend on flags, constructed by SetupMetrics
+	flowDirectionBytes   *prometheus.CounterVec
+	flowDirectionPackets *prometheus.CounterVec
+	tagCap               *LabelCap
+	localCap             *LabelCap
+	// nil unless -full-labels
+	flowBytesTotal *prometheus.CounterVec
+
+	flowDirectionResolution = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_direction_resolution_total",
+			Help: "Flows by the method that decided their direction",
+		},
+		[]string{"method"},
+	)
+	flowFragmentedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_fragmented_bytes",
+			Help: "Bytes of flows flagged by -fragment-field",
+		},
+		[]string{"direction"},
+	)
+	flowSummaryBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_summary_bytes",
+			Help: "Bytes by class: internet_in, internet_out or local (between private addresses)",
+		},
+		[]string{"class"},
+	)
+	flowsZeroByte = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flows_zero_byte_total",
+			Help: "Flows with zero bytes, see -zero-byte",
+		},
+	)
+	flowParseErrors = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "flow_direction_bytes",
-			Help: "in or out Bytes",
+			Name: "flow_parse_errors_total",
+			Help: "Records skipped as unparseable (json, timestamp, ip_parse) and failed geoip lookups",
 		},
-		[]string{"direction", "private", "country", "asn", "asn_org"},
+		[]string{"reason"},
+	)
+	flowEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_events_total",
+			Help: "Input lines by outcome: counted, filtered, parse_error, unknown_direction, not_flow or dropped, they sum up to pmacct_output_lines_total",
+		},
+		[]string{"status"},
+	)
+	flowRecordsProcessed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flow_records_processed_total",
+			Help: "JSON flow records parsed from the input, whether a pipeline stage dropped them or not",
+		},
+	)
+	flowUnknownBytes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flow_unknown_bytes_total",
+			Help: "Bytes of flows neither in nor out, e.g. transit on a mirror port, missing from the byte counter",
+		},
+	)
+	geoipPrivateHits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geoip_private_hit_total",
+			Help: "GeoIP answers for private or special-use addresses, discarded",
+		},
+	)
+	flowsExcluded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flows_excluded_total",
+			Help: "Flows skipped by -exclude-proto",
+		},
+		[]string{"proto"},
+	)
+	flowsExcludedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flows_excluded_bytes_total",
+			Help: "Bytes of the flows skipped by -exclude-proto",
+		},
+		[]string{"proto"},
 	)
-	// flowBytesTotal = promauto.NewCounterVec(
-	// 	prometheus.CounterOpts{
-	// 		Name: "flow_bytes_total",
-	// 		Help: "Flow Bytes.",
-	// 	},
-	// 	[]string{"ip_src", "ip_dst", "country_src", "country_dst", "asn_src", "asn_dst", "direction"},
-	// )
 )
 
+// geoLabel replaces an empty geo lookup result by -unknown-country-label
+func geoLabel(value string) string {
+	if value == "" {
+		return *unknownLabel
+	}
+	return value
+}
+
+// asnLabel formats the asn label of -combine-asn, just the number if the
+// database knows no organization
+func asnLabel(peer *Peer) string {
+	if peer.Asn == "" {
+		return geoLabel("")
+	}
+	if peer.AsnOrg == "" {
+		return peer.Asn
+	}
+	return peer.Asn + " (" + peer.AsnOrg + ")"
+}
+
+// SummaryClass returns the flow_summary_bytes class of a flow, empty for
+// public flows of unknown direction
+func SummaryClass(flow *Flow) string {
+	switch {
+	case flow.Private:
+		return "local"
+	case flow.Direction == "in":
+		return "internet_in"
+	case flow.Direction == "out":
+		return "internet_out"
+	}
+	return ""
+}
+
+// LogPrometheus counts a flow AccountFlow let through in the metrics
 func LogPrometheus(flow *Flow) {
-	if flow.Direction == "in" || flow.Direction == "out" {
-		var peer *Peer
-		if flow.Direction == "in" {
-			peer = flow.Source
-		} else {
-			peer = flow.Destination
-		}
-		flowDirectionBytes.With(
-			prometheus.Labels{
-				"direction": flow.Direction,
-				"private":   flow.PrivateRaw,
-				// "ip":        peer.Ip.String(),
-				"country": peer.Country,
-				"asn":     peer.Asn,
-				"asn_org": peer.AsnOrg,
-			},
-		).Add(float64(flow.Bytes))
-	}
-	// flowBytesTotal.With(
-	// 	prometheus.Labels{
-	// 		"ip_src":      flow.IpSrc.String(),
-	// 		"ip_dst":      flow.IpDst.String(),
-	// 		"country_src": flow.Source.Country,
-	// 		"country_dst": flow.Destination.Country,
-	// 		"asn_src":     flow.Source.Asn,
-	// 		"asn_dst":     flow.Destination.Asn,
-	// 		"direction":   flow.Direction,
-	// 	},
-	// ).Add(float64(flow.Bytes))
+	bytes := float64(flow.Bytes)
+	packets := float64(flow.Packages)
+	flowSizeBytes.With(prometheus.Labels{"direction": flow.Direction}).Observe(bytes)
+
+	if class := SummaryClass(flow); class != "" {
+		flowSummaryBytes.With(prometheus.Labels{"class": class}).Add(bytes)
+	}
+
+	if flow.Fragmented {
+		flowFragmentedBytes.With(prometheus.Labels{"direction": flow.Direction}).Add(bytes)
+	}
+
+	if *portBytes {
+		port := ServicePort(flow.SrcPort, flow.DstPort, *portMax)
+		flowPortBytes.With(prometheus.Labels{"port": port, "direction": flow.Direction}).Add(bytes)
+	}
+
+	if ifaceMap != nil {
+		ObserveIface(flow, bytes)
+	}
+
+	if peer := flow.RemotePeer(); peer != nil {
+		labels := make(prometheus.Labels, len(flowLabels))
+		for _, name := range flowLabels {
+			labels[name] = flowLabelValues[name](flow, peer)
+		}
+		if *combineASN {
+			labels["asn"] = asnLabel(peer)
+			delete(labels, "asn_org")
+		}
+		if topASN != nil {
+			topASN.Observe(peer.Asn, bytes)
+			if !topASN.Keep(peer.Asn) {
+				labels["asn"] = "other"
+				if _, ok := labels["asn_org"]; ok {
+					labels["asn_org"] = "other"
+				}
+			}
+		}
+		if _, ok := labels["direction"]; ok && *senseLabel {
+			delete(labels, "direction")
+			labels["sense"] = Sense(flow.Direction)
+		}
+		if asnGroups != nil {
+			labels["network_group"] = asnGroups.Group(peer.Asn, *asnGroupsOther)
+		}
+		if asRelationships != nil {
+			labels["relationship"] = asRelationships.Relationship(peer.Asn)
+		}
+		if *domainGroupsFile != "" {
+			labels["domain_group"] = flow.DomainGroup
+		}
+		if *specialUseLabel {
+			labels["special_use"] = peer.SpecialUse
+		}
+		if *replayLabel {
+			labels["source_file"] = flow.SourceFile
+		}
+		if *localLabel {
+			labels["local"] = localCap.Value(HostLabel(flow.LocalIP()))
+		}
+		if *cityLabel {
+			labels["city"] = geoLabel(peer.City)
+		}
+		if *continentLabel {
+			labels["continent"] = geoLabel(peer.Continent)
+		}
+		if *protoLabel {
+			labels["proto"] = geoLabel(NormalizeProto(flow.Proto))
+		}
+		if *geoipISP != "" {
+			labels["isp"] = geoLabel(peer.Isp)
+		}
+		if *geoipConnectionType != "" {
+			labels["connection_type"] = geoLabel(peer.ConnectionType)
+		}
+		var exemplar prometheus.Labels
+		if *exemplars {
+			exemplar = prometheus.Labels{"remote_ip": peer.Ip.String()}
+		}
+		addCounter(flowDirectionBytes, labels, bytes, exemplar)
+		addCounter(flowDirectionPackets, labels, packets, exemplar)
+		if *geoCoordsLabel {
+			ObserveLocation(peer, bytes)
+		}
+		if janitor != nil {
+			now := time.Now()
+			janitor.Touch(flowDirectionBytes, labels, now)
+			janitor.Touch(flowDirectionPackets, labels, now)
+		}
+		if cardinality != nil {
+			cardinality.Observe(labels)
+		}
+	} else {
+		// neither in nor out, e.g. transit on a mirror port
+		flowUnknownBytes.Add(bytes)
+	}
+
+	// both ends, whatever the direction
+	if flowBytesTotal != nil {
+		labels := prometheus.Labels{
+			"country_src": geoLabel(flow.Source.Country),
+			"country_dst": geoLabel(flow.Destination.Country),
+			"asn_src":     geoLabel(flow.Source.Asn),
+			"asn_dst":     geoLabel(flow.Destination.Asn),
+			"direction":   flow.Direction,
+		}
+		addCounter(flowBytesTotal, labels, bytes, nil)
+		if janitor != nil {
+			janitor.Touch(flowBytesTotal, labels, time.Now())
+		}
+	}
+}
+
+// ValidateFlags rejects the flag values and combinations main can't run
+// with, before anything is opened or registered. It sets flowLabels from
+// -labels, the metric schema it checks last depends on them.
+func ValidateFlags() error {
+	if !validTimestampUnit(*timestampUnit) {
+		return fmt.Errorf("unknown -timestamp-unit %q", *timestampUnit)
+	}
+	if *ewmaAlpha <= 0 || *ewmaAlpha > 1 {
+		return fmt.Errorf("-ewma-alpha must be in (0, 1], got %v", *ewmaAlpha)
+	}
+	if *v6AggLen < 0 || *v6AggLen > 128 {
+		return fmt.Errorf("-v6-agg-len must be between 0 and 128, got %d", *v6AggLen)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key have to be set together")
+	}
+	if (*basicAuthUser == "") != (*basicAuthPass == "") {
+		return errors.New("-basic-auth-user and -basic-auth-pass have to be set together")
+	}
+	if *exemplars && !*openMetrics {
+		return errors.New("-exemplars needs -openmetrics, only OpenMetrics carries them")
+	}
+	if *sessionWebhook != "" && !*sessionsEnabled {
+		return errors.New("-session-webhook needs -sessions")
+	}
+	if !strings.HasPrefix(*metricsPath, "/") {
+		return fmt.Errorf("-metrics-path has to start with /, got %q", *metricsPath)
+	}
+	for _, listen := range strings.Split(*addr, ",") {
+		if strings.TrimSpace(listen) == "" {
+			return fmt.Errorf("empty address in -addr %q", *addr)
+		}
+	}
+	for _, prefix := range []string{*metricNamespace, *metricSubsystem} {
+		if prefix != "" && !labelNameRE.MatchString(prefix) {
+			return fmt.Errorf("invalid metric prefix %q", prefix)
+		}
+	}
+	// an emitter's flush ticker panics on anything else
+	for _, flush := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"-influx-flush", *influxFlush},
+		{"-sqlite-flush", *sqliteFlush},
+		{"-sink-flush", *sinkFlush},
+		{"-session-webhook-flush", *sessionWebhookFlush},
+	} {
+		if flush.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %v", flush.name, flush.value)
+		}
+	}
+	// the queue is four batches, a negative one panics and zero drops every flow
+	for _, batch := range []struct {
+		name  string
+		value int
+	}{
+		{"-influx-batch", *influxBatch},
+		{"-sqlite-batch", *sqliteBatch},
+		{"-sink-batch", *sinkBatch},
+		{"-session-webhook-batch", *sessionWebhookBatch},
+	} {
+		if batch.value < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d", batch.name, batch.value)
+		}
+	}
+	if *samplingRate < 0 {
+		return fmt.Errorf("-sampling-rate must be positive, got %d", *samplingRate)
+	}
+	if *zeroBytePolicy != "count" && *zeroBytePolicy != "drop" {
+		return fmt.Errorf("unknown -zero-byte %q", *zeroBytePolicy)
+	}
+	if _, err := ShardKey(*shardBy, nil); err != nil {
+		return fmt.Errorf("invalid -shard-by: %w", err)
+	}
+	if !validSelfFlows(*selfFlows) {
+		return fmt.Errorf("unknown -self-flows %q", *selfFlows)
+	}
+
+	labels, err := ParseLabels(*labelsFlag)
+	if err != nil {
+		return fmt.Errorf("parsing -labels: %w", err)
+	}
+	flowLabels = labels
+	if (*combineASN || *topASNFlag > 0) && !hasLabel(flowLabels, "asn") {
+		return errors.New("-combine-asn and -top-asn need asn in -labels")
+	}
+	_, err = BuildSchema()
+	return err
 }
 
 func main() {
 	flag.Parse()
+	if *configFile != "" {
+		if err := LoadConfig(*configFile, flag.CommandLine); err != nil {
+			fatal("loading -config", "err", err)
+		}
+	}
+
+	// -log-rate limits everything logged, except its own summary
+	var logOut io.Writer = os.Stderr
+	var limiter *RateLimiter
+	if *logRate > 0 {
+		limiter = NewRateLimiter(*logRate, time.Now())
+		logOut = limiter.Writer(os.Stderr)
+	}
+	if err := SetupLogging(logOut); err != nil {
+		fatal("setting up logging", "err", err)
+	}
+	setVerbose(*verbose)
+
+	if *samplingRate == 0 {
+		slog.Warn("-sampling-rate 0 is treated as 1")
+		*samplingRate = 1
+	}
+	if err := ValidateFlags(); err != nil {
+		fatal("invalid flags", "err", err)
+	}
+	if *basicAuthUser != "" && *tlsCert == "" {
+		slog.Warn("-basic-auth-user without -tls-cert sends the password in plain text")
+	}
+	listenAddrs := strings.Split(*addr, ",")
+	for i, listen := range listenAddrs {
+		listenAddrs[i] = strings.TrimSpace(listen)
+	}
 
 	// get local ip addresses
 	localIps, _, err := interfaces.LocalAddresses()
 	if err != nil {
-		log.Fatal(err)
+		fatal("listing local addresses", "err", err)
 	}
-	fmt.Printf("Local ips: %s\n", localIps)
+	// link-local ones come with their zone, flows without
+	for i, ip := range localIps {
+		localIps[i] = flow.Canonical(ip)
+	}
+	slog.Info("local ips", "ips", localIps)
 
-	// open geo databases
-	dbCity, err := geoip2.Open("GeoLite2-City.mmdb")
+	if *ifaceBytes {
+		ifaceMap, err = NewIfaceMap()
+		if err != nil {
+			fatal("listing interface addresses", "err", err)
+		}
+	}
+
+	hairpinIps, err = parseIPList(hairpinFlag)
+	if err != nil {
+		fatal("parsing -hairpin-ip", "err", err)
+	}
+	privateNetworks, err = parsePrefixList(privateNetworksFlag)
+	if err != nil {
+		fatal("parsing -private-networks", "err", err)
+	}
+	localNetworks, err = parsePrefixList(localNetworksFlag)
+	if err != nil {
+		fatal("parsing -local-networks", "err", err)
+	}
+	if len(localNetworks) > 0 {
+		slog.Info("local networks", "networks", localNetworks)
+	}
+	switch *directionMode {
+	case "endpoint":
+	case "gateway":
+		resolveDirection = flow.ResolveGatewayDirection
+		if len(localNetworks) == 0 {
+			slog.Warn("-direction-mode gateway without -local-networks, only the own addresses are inside")
+		}
+	default:
+		fatal("unknown -direction-mode", "mode", *directionMode)
+	}
+	includeCIDRs, err = parsePrefixList(includeCIDRFlag)
 	if err != nil {
-		log.Fatal(err)
+		fatal("parsing -include-cidr", "err", err)
+	}
+	excludeCIDRs, err = parsePrefixList(excludeCIDRFlag)
+	if err != nil {
+		fatal("parsing -exclude-cidr", "err", err)
+	}
+
+	// open geo databases, an empty path or a missing file skips that
+	// enrichment, SIGHUP reopens them
+	geo := OpenGeoDB(*geoipCity, *geoipASN, *geoipISP, *geoipConnectionType)
+	defer geo.Close()
+
+	if *fieldMapFile != "" {
+		fieldMap, err = LoadFieldMap(*fieldMapFile)
+		if err != nil {
+			fatal("loading -field-map", "err", err)
+		}
 	}
-	defer dbCity.Close()
 
-	dbASN, err := geoip2.Open("GeoLite2-ASN.mmdb")
+	if *asnOrgMapFile != "" {
+		*normalizeASNOrg = true
+		asnOrgMap, err = LoadASNOrgMap(*asnOrgMapFile)
+		if err != nil {
+			fatal("loading -asnorg-map", "err", err)
+		}
+	}
+
+	if *hostLabelsFile != "" {
+		hostLabels, err = LoadHostLabels(*hostLabelsFile)
+		if err != nil {
+			fatal("loading -host-labels", "err", err)
+		}
+	}
+
+	if *domainGroupsFile != "" {
+		domainGroups, err = LoadDomainGroups(*domainGroupsFile)
+		if err != nil {
+			fatal("loading -domain-groups", "err", err)
+		}
+	}
+
+	if *asnGroupsFile != "" {
+		asnGroups, err = LoadASNGroups(*asnGroupsFile)
+		if err != nil {
+			fatal("loading -asn-groups", "err", err)
+		}
+	}
+
+	if *asRelationshipsFile != "" {
+		asRelationships, err = LoadASRelationships(*asRelationshipsFile)
+		if err != nil {
+			fatal("loading -as-relationships", "err", err)
+		}
+	}
+
+	if *geoipOverride != "" {
+		geoOverrides, err = LoadGeoOverrides(*geoipOverride)
+		if err != nil {
+			fatal("loading -geoip-override", "err", err)
+		}
+	}
+
+	if *selfTest {
+		// only a path given on purpose has to work, the defaults may be absent
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		city := explicit["geoip-city"] && *geoipCity != ""
+		asn := explicit["geoip-asn"] && *geoipASN != ""
+		geo.View(func(dbs GeoReaders) {
+			err = SelfTest(dbs, city, asn)
+		})
+		if err != nil {
+			fatal("selftest", "err", err)
+		}
+	}
+
+	if *geoipCheck != "" {
+		prefix, err := netaddr.ParseIPPrefix(*geoipCheck)
+		if err != nil {
+			fatal("parsing -geoip-check", "err", err)
+		}
+		if *geoipCheckSamples < 1 {
+			fatal("-geoip-check-samples must be at least 1")
+		}
+		var coverage GeoCoverage
+		geo.View(func(dbs GeoReaders) {
+			coverage, err = CheckGeoCoverage(prefix, *geoipCheckSamples, dbs)
+		})
+		if err != nil {
+			fatal("checking geo coverage", "err", err)
+		}
+		coverage.Print(os.Stdout)
+		return
+	}
+
+	if *directionCacheSize > 0 {
+		directionCache = NewDirectionCache(*directionCacheSize)
+	}
+	eventTypes = ParseEventTypes(*eventTypesFlag)
+
+	pipeline := BuildPipeline(localIps, geo)
+	slog.Debug("pipeline", "stages", pipeline.String())
+
+	if *dryRun {
+		if *replayFile != "" {
+			fatal("-dry-run reads the input lines, use -replay without it")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		source, err := OpenFlowSource()
+		if err != nil {
+			fatal("starting input", "err", err)
+		}
+		if err := DryRun(ctx, source, pipeline, os.Stdout, *dryRunLines); err != nil {
+			fatal("input", "err", err)
+		}
+		return
+	}
+
+	// after -dry-run, which registers no metrics
+	if err := SetupMetrics(prometheus.DefaultRegisterer); err != nil {
+		fatal("setting up metrics", "err", err)
+	}
+	if *counterState != "" {
+		if err := LoadCounters(*counterState); err != nil {
+			fatal("loading -counter-state", "err", err)
+		}
+	}
+
+	var learner *Learner
+	if *learnFor > 0 {
+		learner = NewLearner()
+	}
+
+	sink, err := NewFlowSink(*sinkName, *sinkAddr, NewEmitterConfig(*sinkBatch, *sinkFlush))
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid -sink", "err", err)
 	}
-	defer dbASN.Close()
 
-	// start prometheus on /metrics
-	go func() {
-		log.Printf("Starting Prometheus web server, available at: http://%s/metrics\n", *addr)
-		http.Handle("/metrics", promhttp.Handler())
-		http.ListenAndServe(*addr, nil)
-	}()
+	var influx *InfluxWriter
+	if *influxURL != "" {
+		influx = NewInfluxWriter(*influxURL, *influxOrg, *influxBucket, *influxToken, NewEmitterConfig(*influxBatch, *influxFlush))
+	}
 
-	// wait for either a term signal or a message indicating shutdown
-	var wg sync.WaitGroup
-	wg.Add(1)
+	var sqliteWriter *SQLiteWriter
+	if *sqlitePath != "" {
+		sqliteWriter, err = NewSQLiteWriter(*sqlitePath, NewEmitterConfig(*sqliteBatch, *sqliteFlush))
+		if err != nil {
+			fatal("opening -sqlite-path", "err", err)
+		}
+	}
+
+	var sourceFilter *SourceFilter
+	if *sourceFilterFlag != "" {
+		sourceFilter, err = ParseSourceFilter(*sourceFilterFlag)
+		if err != nil {
+			fatal("parsing -source-filter", "err", err)
+		}
+	}
+
+	var inputSampler *InputSampler
+	flowInputSampleRate.Set(1)
+	if *inputSample != "" && *replayFile != "" {
+		slog.Warn("-input-sample doesn't apply to -replay, every flow is replayed")
+	} else if *inputSample != "" {
+		rate, err := ParseSampleRate(*inputSample)
+		if err != nil {
+			fatal("parsing -input-sample", "err", err)
+		}
+		inputSampler, err = NewInputSampler(rate, *inputSampleMode, rand.New(rand.NewSource(time.Now().UnixNano())))
+		if err != nil {
+			fatal("invalid -input-sample-mode", "err", err)
+		}
+		flowInputSampleRate.Set(float64(rate))
+	}
+
+	var jsonWriter *JSONWriter
+	if *jsonOut != "" {
+		fields, err := ParseJSONFields(*jsonOutFields)
+		if err != nil {
+			fatal("parsing -json-out-fields", "err", err)
+		}
+		if *jsonOutSample < 1 {
+			fatal("-json-out-sample must be at least 1")
+		}
+		jsonWriter, err = NewJSONWriter(*jsonOut, fields, *jsonOutSample)
+		if err != nil {
+			fatal("opening -json-out", "err", err)
+		}
+	}
+
+	var binaryWriter *BinaryWriter
+	if *binaryOut != "" {
+		binaryWriter, err = NewBinaryWriter(*binaryOut)
+		if err != nil {
+			fatal("opening -binary-out", "err", err)
+		}
+	}
+
+	if *topASNFlag > 0 {
+		topASN = NewTopASN(*topASNFlag, *topMaxTracked)
+	}
+	if *seriesTTL > 0 {
+		janitor = NewSeriesJanitor(*seriesTTL)
+	}
+	if *aggregateInterval > 0 {
+		aggregator = NewAggregator()
+	}
+
+	var talkers *TopTalkersCollector
+	if *topTalkers > 0 {
+		talkers = NewTopTalkersCollector(NewTopN(*topMaxTracked), *topTalkers)
+		prometheus.MustRegister(talkers)
+	}
+
+	var ports *TopPortsCollector
+	if *topPorts > 0 {
+		ports = NewTopPortsCollector(NewTopN(*topMaxTracked), *topPorts)
+		prometheus.MustRegister(ports)
+	}
+
+	if *cardinalityEnabled {
+		cardinality = NewCardinalityTracker()
+		prometheus.MustRegister(cardinality)
+		http.Handle("/cardinality", cardinality)
+	}
+
+	var countryProto *CountryProtoCollector
+	if *topCountryProto > 0 {
+		countryProto = NewCountryProtoCollector(NewTopN(*topMaxTracked), *topCountryProto)
+		prometheus.MustRegister(countryProto)
+	}
 
-	// listen to SIGINT, SIGTERM
+	if *logLevelToken != "" {
+		http.Handle("/loglevel", NewLogLevelHandler(*logLevelToken))
+	}
+
+	var ipSampler *IPSampler
+	if *ipSampleRate > 0 {
+		ipSampler = NewIPSampler(*ipSampleRate, *ipSampleTTL, *ipSampleMax, rand.New(rand.NewSource(time.Now().UnixNano())))
+		prometheus.MustRegister(ipSampler)
+	}
+
+	if talkers != nil || ports != nil {
+		http.Handle("/top", &TopView{Talkers: talkers, Ports: ports})
+	}
+
+	var recentFlows *RecentFlows
+	if *debugFlows {
+		if *debugFlowsSize < 1 {
+			fatal("-debug-flows must be at least 1")
+		}
+		recentFlows = NewRecentFlows(*debugFlowsSize)
+		// individual addresses, as private as the metrics
+		var handler http.Handler = recentFlows
+		if *basicAuthUser != "" {
+			handler = basicAuth(handler, *basicAuthUser, *basicAuthPass)
+		}
+		http.Handle("/debug/flows", handler)
+	}
+
+	var countryPairs *CountryPairs
+	if *sankeyEnabled {
+		countryPairs = NewCountryPairs(NewTopN(*topMaxTracked), *sankeyLinks)
+		http.Handle("/sankey", countryPairs)
+	}
+
+	var billing *Billing
+	if *billingPeriodFlag != "" {
+		period, err := ParseBillingPeriod(*billingPeriodFlag, *billingDay, *billingAnchor)
+		if err != nil {
+			fatal("parsing -billing-period", "err", err)
+		}
+		billing = NewBilling(period, *billingState, time.Now())
+		if *billingState != "" {
+			if err := billing.Load(); err != nil {
+				fatal("loading -billing-state", "err", err)
+			}
+		}
+	}
+
+	var scanDetector *ScanDetector
+	if *scanDetect {
+		scanDetector = NewScanDetector(*scanMinDsts, *scanMaxAvg, *scanMaxSources)
+	}
+
+	if *resolvePTR {
+		ptrCache = NewPTRCache(defaultPTRLookup, *ptrTimeout, *ptrCacheTTL, *ptrCacheSize)
+	}
+
+	var csvExporter *CSVExporter
+	if *csvOut != "" {
+		if err := os.MkdirAll(*csvOut, 0755); err != nil {
+			fatal("creating -csv-out", "err", err)
+		}
+		csvExporter = NewCSVExporter(*csvOut, *csvTop, *topMaxTracked)
+	}
+
+	var dnsDetector *DNSAnomalyDetector
+	if *dnsAnomaly {
+		resolvers, err := parsePrefixList(dnsResolverFlag)
+		if err != nil {
+			fatal("parsing -dns-resolver", "err", err)
+		}
+		dnsDetector = NewDNSAnomalyDetector(*dnsMaxBytesPerFlow, resolvers)
+	}
+
+	var rates *RateTracker
+	if *rateInterval > 0 {
+		rates = NewRateTracker(*ewmaAlpha)
+	}
+
+	var sessionTable *SessionTable
+	if *sessionsEnabled {
+		sessionTable = NewSessionTable(*sessionWindow, *sessionMaxPending)
+	}
+	var webhook *WebhookWriter
+	if *sessionWebhook != "" {
+		webhook = NewWebhookWriter(*sessionWebhook, NewEmitterConfig(*sessionWebhookBatch, *sessionWebhookFlush))
+	}
+
+	health := NewHealth(*healthTimeout, time.Now())
+	http.Handle("/healthz", health)
+
+	// start prometheus on -metrics-path, every address serves the same mux
+	http.Handle(*metricsPath, MetricsHandler())
+	for _, listen := range listenAddrs {
+		go func(listen string) {
+			if *tlsCert != "" {
+				slog.Info("starting Prometheus web server", "url", "https://"+listen+*metricsPath)
+				// a bad certificate or key would otherwise leave nothing to scrape
+				fatal("serving HTTPS", "addr", listen, "err", http.ListenAndServeTLS(listen, *tlsCert, *tlsKey, nil))
+			}
+			slog.Info("starting Prometheus web server", "url", "http://"+listen+*metricsPath)
+			if err := http.ListenAndServe(listen, nil); err != nil {
+				slog.Error("serving HTTP", "addr", listen, "err", err)
+			}
+		}(listen)
+	}
+
+	// cancelled by a term signal, the end of the input or of learn mode
+	ctx, stop := context.WithCancel(context.Background())
+
+	// listen to SIGINT, SIGTERM, and SIGHUP to reload the geo databases
 	go func() {
-		termChan := make(chan os.Signal)
-		signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
-		<-termChan // blocks
-		fmt.Println("term received, shutting down...")
-		wg.Done()
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				if err := geo.Reload(); err != nil {
+					slog.Error("reloading geo databases, keeping the old ones", "err", err)
+				} else {
+					slog.Info("geo databases reloaded")
+				}
+				if directionCache != nil {
+					directionCache.Reset()
+				}
+				if ifaceMap != nil {
+					if err := ifaceMap.Refresh(); err != nil {
+						slog.Error("reloading interface addresses", "err", err)
+					}
+				}
+				continue
+			}
+			slog.Info("term received, shutting down")
+			stop()
+			return
+		}
 	}()
 
-	// exec command: pmacctd
-	// https://github.com/pmacct/pmacct/blob/master/QUICKSTART
-	// https://github.com/pmacct/pmacct/blob/6579ebeccdd0dd33e013a20a0b12a89c1bd65e94/sql/pmacct-create-table_v9.pgsql
-	//
-	cmd := exec.Command("pmacctd", "-r 1", "-c src_host,dst_host,src_port,dst_port,proto", "-P print", "-O json")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+	// closed once shutdown begins, stops background workers
+	quit := ctx.Done()
+
+	if limiter != nil {
+		go limiter.Report(newLogger(os.Stderr), 10*time.Second, quit)
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("cmd.Start() failed with '%s'\n", err)
+
+	if scanDetector != nil {
+		go scanDetector.Run(*scanWindow, quit)
 	}
-	// handle stdout of pmacctd
-	scanner := bufio.NewScanner(stdout)
-	go func() {
-		for scanner.Scan() {
-			text := scanner.Text()
+
+	if jsonWriter != nil {
+		go jsonWriter.Run(time.Second, quit)
+	}
+
+	if binaryWriter != nil {
+		go binaryWriter.Run(time.Second, quit)
+	}
+
+	if topASN != nil {
+		go topASN.Run(*topWindow, quit)
+	}
+
+	if janitor != nil {
+		go janitor.Run(quit)
+	}
+
+	if aggregator != nil {
+		go aggregator.Run(*aggregateInterval, quit)
+	}
+
+	if talkers != nil {
+		go talkers.store.ResetEvery(*topWindow, quit)
+	}
+
+	if ports != nil {
+		go ports.store.ResetEvery(*topWindow, quit)
+	}
+
+	if countryProto != nil {
+		go countryProto.store.ResetEvery(*topWindow, quit)
+	}
+
+	if countryPairs != nil {
+		go countryPairs.store.ResetEvery(*topWindow, quit)
+	}
+
+	if csvExporter != nil {
+		go csvExporter.Run(*csvInterval, quit)
+	}
+
+	if billing != nil {
+		go billing.Run(time.Minute, quit)
+	}
+
+	if rates != nil {
+		go rates.Run(*rateInterval, quit)
+	}
+
+	if *heartbeatInterval > 0 {
+		go Heartbeat(*heartbeatInterval, time.Now, quit)
+	}
+
+	if *counterState != "" {
+		go SaveCountersEvery(*counterState, *counterStateInterval, quit)
+	}
+
+	// end learn mode after the configured duration
+	if learner != nil {
+		go func() {
+			select {
+			case <-time.After(*learnFor):
+				learner.Report(os.Stdout, uint64(*learnBudget))
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// hands a flow that made it through the pipeline to every output
+	handle := func(flow *Flow) {
+		if isVerbose() {
+			LogFlow(flow)
+		}
+
+		if counted := AccountFlow(flow); counted != nil {
+			// only the sink estimates the lines -input-sample skipped
+			if inputSampler != nil {
+				counted = inputSampler.Scale(counted)
+			}
+			sink.Write(counted)
+		}
+
+		if recentFlows != nil {
+			recentFlows.Add(flow)
+		}
+
+		if influx != nil {
+			influx.Write(flow)
+		}
+
+		if sqliteWriter != nil {
+			sqliteWriter.Write(flow)
+		}
+
+		if binaryWriter != nil {
+			if err := binaryWriter.Write(flow); err != nil {
+				slog.Error("writing -binary-out", "err", err)
+			}
+		}
+
+		if jsonWriter != nil {
+			if err := jsonWriter.Write(flow); err != nil {
+				slog.Error("writing -json-out", "err", err)
+			}
+		}
+
+		if talkers != nil {
+			talkers.Observe(flow)
+		}
+
+		if ports != nil {
+			ports.Observe(flow)
+		}
+
+		if countryProto != nil {
+			countryProto.Observe(flow)
+		}
+
+		if ipSampler != nil {
+			ipSampler.Observe(flow, time.Now())
+		}
+
+		if countryPairs != nil {
+			countryPairs.Observe(flow)
+		}
+
+		if billing != nil {
+			billing.Add(flow, time.Now())
+		}
+
+		if scanDetector != nil {
+			scanDetector.Observe(flow)
+		}
+
+		if dnsDetector != nil {
+			dnsDetector.Observe(flow)
+		}
+
+		if csvExporter != nil {
+			csvExporter.Observe(flow)
+		}
+
+		if learner != nil {
+			learner.Observe(flow)
+		}
+
+		if rates != nil {
+			rates.Observe(flow)
+		}
+
+		if sessionTable != nil {
+			if session := sessionTable.Add(flow, time.Now()); session != nil {
+				LogSession(session)
+				if jsonWriter != nil {
+					if err := jsonWriter.WriteSession(session); err != nil {
+						slog.Error("writing -json-out", "err", err)
+					}
+				}
+				if webhook != nil {
+					webhook.Write(session)
+				}
+			}
+		}
+	}
+
+	// closed once every flow is handled
+	inputDone := make(chan struct{})
+
+	if *replayFile != "" {
+		go func() {
+			defer close(inputDone)
+			if err := ReplayFiles(ctx, *replayFile, pipeline, handle); err != nil {
+				slog.Error("replay", "err", err)
+			}
+			stop()
+		}()
+	} else {
+		handleLine := func(text string) {
 			if strings.HasPrefix(text, "{") {
+				if sourceFilter != nil && !sourceFilter.Match(text) {
+					flowsSourceFiltered.Inc()
+					flowEvents.With(prometheus.Labels{"status": "filtered"}).Inc()
+					return
+				}
 
-				flow, err := MakeFlow(text, localIps, dbCity, dbASN)
+				flow, err := MakeFlow(text, pipeline)
 				if err != nil {
-					log.Fatal(err)
+					// pmacct occasionally prints partial lines or empty addresses,
+					// counted in flow_parse_errors_total
+					slog.Debug("skipping flow", "err", err, "line", text)
+					flowEvents.With(prometheus.Labels{"status": "parse_error"}).Inc()
+					return
+				}
+				flowRecordsProcessed.Inc()
+				health.FlowSeen(time.Now())
+				if flow == nil {
+					flowEvents.With(prometheus.Labels{"status": "filtered"}).Inc()
+					return
 				}
+				ObserveTimestampLag(flow, time.Now())
+				handle(flow)
+			} else {
+				slog.Info("pmacct", "line", text)
+				flowEvents.With(prometheus.Labels{"status": "not_flow"}).Inc()
+			}
+		}
+
+		// workers run apart from reading the input, so parsing or
+		// enrichment running late can't stall pmacct writing to its stdout
+		if *workers < 1 {
+			fatal("-workers has to be at least 1", "workers", *workers)
+		}
+		if *queueSize < 0 {
+			fatal("-queue-size can't be negative", "queue-size", *queueSize)
+		}
+		if *queueOverflow != "drop" && *queueOverflow != "block" {
+			fatal("invalid -queue-overflow, use drop or block", "queue-overflow", *queueOverflow)
+		}
+		key, err := ShardKey(*shardBy, geo)
+		if err != nil {
+			fatal("invalid -shard-by", "err", err)
+		}
+		dispatcher := NewDispatcher(*workers, *queueSize, *queueOverflow == "drop", key, handleLine)
+		handleLine = dispatcher.Dispatch
 
-				if *verbose {
-					// fmt.Printf("%s\n", text)
-					fmt.Printf("%+v\n%+v\n%+v\n\n", flow, flow.Source, flow.Destination)
+		// sampled before the workers so skipped lines cost nothing
+		if inputSampler != nil {
+			process := handleLine
+			handleLine = func(text string) {
+				if !inputSampler.Keep() {
+					flowsInputSampled.Inc()
+					flowEvents.With(prometheus.Labels{"status": "filtered"}).Inc()
+					return
 				}
+				process(text)
+			}
+		}
 
-				LogPrometheus(flow)
-			} else {
-				fmt.Println(text)
-				// TODO identify exit message by pmacct
-				// wg.Done()
+		// pmacct ending on its own, e.g. at the end of a -I capture file,
+		// shuts down like SIGTERM. One sender to a socket input exiting
+		// leaves the others streaming.
+		var onExit func()
+		if *unixgramPath == "" && *listenFlow == "" {
+			onExit = func() {
+				if ctx.Err() == nil {
+					slog.Info("pmacct is exiting, shutting down")
+					stop()
+				}
 			}
 		}
-	}()
+		handleLine = watchStatus(handleLine, onExit)
+		handleLine = countLines(handleLine, time.Now)
 
-	// wait a reason to exit
-	wg.Wait()
+		// started last, nothing exits between here and Run leaving it behind
+		source, err := OpenFlowSource()
+		if err != nil {
+			fatal("starting input", "err", err)
+		}
+		health.SetSource(source)
+		if pmacctd, ok := source.(*PmacctdSource); ok {
+			if collector := NewPmacctProcessCollector("/proc", pmacctd.Pid); collector != nil {
+				prometheus.MustRegister(collector)
+			}
+		}
 
-	// send SIGINT to pmacctd
-	err = cmd.Process.Signal(syscall.SIGINT)
-	if err != nil {
-		log.Fatal(err)
+		go func() {
+			defer close(inputDone)
+			if err := source.Run(ctx, handleLine); err != nil {
+				slog.Error("input", "err", err)
+			}
+			dispatcher.Close()
+			// EOF on stdin shuts down like SIGTERM
+			if *stdinInput {
+				stop()
+			}
+		}()
 	}
 
-	// wait for pmacctd to exit
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	// wait a reason to exit, cancelling ctx stops the input and the workers
+	<-ctx.Done()
+
+	// let the input finish its last flow before closing the writers
+	<-inputDone
+	// before the counter state is saved
+	if aggregator != nil {
+		aggregator.Flush()
+	}
+	sink.Close()
+	if influx != nil {
+		influx.Close()
+	}
+	if webhook != nil {
+		webhook.Close()
+	}
+	if jsonWriter != nil {
+		if err := jsonWriter.Close(); err != nil {
+			slog.Error("closing -json-out", "err", err)
+		}
+	}
+	if binaryWriter != nil {
+		if err := binaryWriter.Close(); err != nil {
+			slog.Error("closing -binary-out", "err", err)
+		}
+	}
+	if csvExporter != nil {
+		if err := csvExporter.Flush(time.Now()); err != nil {
+			slog.Error("writing -csv-out", "err", err)
+		}
+	}
+	if sqliteWriter != nil {
+		if err := sqliteWriter.Close(); err != nil {
+			slog.Error("closing -sqlite-path", "err", err)
+		}
+	}
+	if *counterState != "" {
+		if err := SaveCounters(*counterState, prometheus.DefaultGatherer); err != nil {
+			slog.Error("saving counter state", "err", err)
+		}
+	}
+	if billing != nil && *billingState != "" {
+		if err := billing.Save(); err != nil {
+			slog.Error("saving billing state", "err", err)
+		}
 	}
 
-	fmt.Println("finished!")
+	slog.Info("finished")
 }
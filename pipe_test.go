@@ -0,0 +1,430 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+// setFlags sets flags like on the command line, until the test ends
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("no flag -%s", name)
+		}
+		saved := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatalf("-%s %s: %v", name, value, err)
+		}
+		t.Cleanup(func() { f.Value.Set(saved) })
+	}
+}
+
+// setupTestMetrics constructs the flag dependent counters as main does, on
+// a registry of their own, after -labels and the other flags are set
+func setupTestMetrics(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	savedLabels, savedBytes, savedPackets, savedTotal := flowLabels, flowDirectionBytes, flowDirectionPackets, flowBytesTotal
+	savedTagCap, savedLocalCap, savedSize, savedPersistent := tagCap, localCap, flowSizeBytes, persistentCounters
+	t.Cleanup(func() {
+		flowLabels, flowDirectionBytes, flowDirectionPackets, flowBytesTotal = savedLabels, savedBytes, savedPackets, savedTotal
+		tagCap, localCap, flowSizeBytes, persistentCounters = savedTagCap, savedLocalCap, savedSize, savedPersistent
+	})
+	persistentCounters = map[string]*prometheus.CounterVec{}
+
+	labels, err := ParseLabels(*labelsFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flowLabels = labels
+	registry := prometheus.NewRegistry()
+	if err := SetupMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestClassifyStageHairpin(t *testing.T) {
+	defer func(saved []netaddr.IP) { hairpinIps = saved }(hairpinIps)
+	defer func(saved []netaddr.IPPrefix) { localNetworks = saved }(localNetworks)
+	hairpinIps = []netaddr.IP{netaddr.MustParseIP("203.0.113.7")}
+	localNetworks = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")}
+	localIps := []netaddr.IP{netaddr.MustParseIP("192.168.1.1")}
+
+	tests := []struct {
+		src, dst  string
+		direction string
+		private   string
+	}{
+		// without -hairpin-ip this was out to a public peer
+		{"192.168.1.20", "203.0.113.7", "unknown", "private"},
+		{"203.0.113.7", "192.168.1.20", "unknown", "private"},
+		{"8.8.8.8", "203.0.113.7", "in", "mixed"},
+		{"192.168.1.20", "8.8.8.8", "out", "mixed"},
+	}
+	classify := classifyStage(localIps, nil)
+	for _, test := range tests {
+		f := &Flow{IpSrc: netaddr.MustParseIP(test.src), IpDst: netaddr.MustParseIP(test.dst)}
+		if keep, err := classify(f); !keep || err != nil {
+			t.Fatalf("%s -> %s dropped: %v", test.src, test.dst, err)
+		}
+		if f.Direction != test.direction || f.PrivateRaw != test.private {
+			t.Errorf("%s -> %s: %s %s, want %s %s", test.src, test.dst,
+				f.Direction, f.PrivateRaw, test.direction, test.private)
+		}
+	}
+}
+
+func TestLogPrometheusSense(t *testing.T) {
+	setFlags(t, map[string]string{"sense": "true", "labels": "direction,country"})
+	registry := setupTestMetrics(t)
+
+	local := netaddr.MustParseIP("10.0.0.1")
+	remote := &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States"}
+	// local src: sent by us
+	LogPrometheus(&Flow{Direction: "out", IpSrc: local, IpDst: remote.Ip, Bytes: 100, Packages: 1,
+		Source: &Peer{Ip: local}, Destination: remote})
+	// local dst: received
+	LogPrometheus(&Flow{Direction: "in", IpSrc: remote.Ip, IpDst: local, Bytes: 700, Packages: 2,
+		Source: remote, Destination: &Peer{Ip: local}})
+
+	got := gatheredFrom(t, registry)
+	for key, want := range map[string]float64{
+		`flow_bytes{country="United States",sense="local_to_remote"}`:   100,
+		`flow_bytes{country="United States",sense="remote_to_local"}`:   700,
+		`flow_packets{country="United States",sense="local_to_remote"}`: 1,
+		`flow_packets{country="United States",sense="remote_to_local"}`: 2,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+	for key := range got {
+		if strings.HasPrefix(key, "flow_direction_") {
+			t.Errorf("%s exported with -sense", key)
+		}
+	}
+}
+
+func TestSense(t *testing.T) {
+	for direction, sense := range map[string]string{
+		"out":     "local_to_remote",
+		"in":      "remote_to_local",
+		"unknown": "unknown",
+	} {
+		if got := Sense(direction); got != sense {
+			t.Errorf("%s: %s, want %s", direction, got, sense)
+		}
+	}
+}
+
+func TestLogPrometheusLocalLabel(t *testing.T) {
+	setFlags(t, map[string]string{"label-local": "true", "labels": "direction"})
+	defer func(saved map[netaddr.IP]string) { hostLabels = saved }(hostLabels)
+	hostLabels = map[netaddr.IP]string{netaddr.MustParseIP("203.0.113.2"): "shop"}
+	registry := setupTestMetrics(t)
+
+	web, shop := netaddr.MustParseIP("203.0.113.1"), netaddr.MustParseIP("203.0.113.2")
+	remote := &Peer{Ip: netaddr.MustParseIP("8.8.8.8")}
+	// received by one tenant, sent by the other
+	LogPrometheus(&Flow{Direction: "in", IpSrc: remote.Ip, IpDst: web, Bytes: 700, Packages: 1,
+		Source: remote, Destination: &Peer{Ip: web}})
+	LogPrometheus(&Flow{Direction: "out", IpSrc: shop, IpDst: remote.Ip, Bytes: 100, Packages: 1,
+		Source: &Peer{Ip: shop}, Destination: remote})
+	LogPrometheus(&Flow{Direction: "out", IpSrc: web, IpDst: remote.Ip, Bytes: 30, Packages: 1,
+		Source: &Peer{Ip: web}, Destination: remote})
+
+	got := map[string]float64{}
+	for key, value := range gatheredFrom(t, registry) {
+		if strings.HasPrefix(key, "flow_direction_bytes{") {
+			got[key] = value
+		}
+	}
+	assertGathered(t, got, map[string]float64{
+		`flow_direction_bytes{direction="in",local="203.0.113.1"}`:  700,
+		`flow_direction_bytes{direction="out",local="shop"}`:        100,
+		`flow_direction_bytes{direction="out",local="203.0.113.1"}`: 30,
+	})
+}
+
+func TestLogPrometheusUnknownGeo(t *testing.T) {
+	for _, placeholder := range []string{"unknown", "n/a"} {
+		setFlags(t, map[string]string{"unknown-country-label": placeholder, "labels": "direction,country,asn,asn_org"})
+		registry := setupTestMetrics(t)
+
+		remote := &Peer{Ip: netaddr.MustParseIP("203.0.113.9")}
+		local := &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}
+		LogPrometheus(&Flow{Direction: "in", IpSrc: remote.Ip, IpDst: local.Ip, Bytes: 10, Packages: 1,
+			Source: remote, Destination: local})
+
+		key := fmt.Sprintf(`flow_direction_bytes{asn=%q,asn_org=%q,country=%q,direction="in"}`, placeholder, placeholder, placeholder)
+		if got := gatheredFrom(t, registry)[key]; got != 10 {
+			t.Errorf("%s = %v, want 10", key, got)
+		}
+	}
+}
+
+func TestFragmentedFlows(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction"})
+	setupTestMetrics(t)
+	counter := flowFragmentedBytes.With(prometheus.Labels{"direction": "in"})
+
+	tests := []struct {
+		field      string
+		line       string
+		fragmented bool
+	}{
+		{"frag", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100, "frag": 1}`, true},
+		{"frag", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100, "frag": "true"}`, true},
+		{"frag", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100, "frag": 0}`, false},
+		{"frag", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100, "frag": "false"}`, false},
+		// pmacct not configured to report it
+		{"frag", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100}`, false},
+		{"", `{"ip_src": "8.8.8.8", "ip_dst": "10.0.0.1", "bytes": 100, "frag": 1}`, false},
+	}
+	for _, test := range tests {
+		setFlags(t, map[string]string{"fragment-field": test.field})
+		f, err := MakeFlow(test.line, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.line, err)
+		}
+		if f.Fragmented != test.fragmented {
+			t.Errorf("-fragment-field %q %s: fragmented %v", test.field, test.line, f.Fragmented)
+		}
+
+		f.Direction, f.Source, f.Destination = "in", &Peer{}, &Peer{}
+		before := testutil.ToFloat64(counter)
+		LogPrometheus(f)
+		want := 0.0
+		if test.fragmented {
+			want = 100
+		}
+		if got := testutil.ToFloat64(counter) - before; got != want {
+			t.Errorf("-fragment-field %q %s: flow_fragmented_bytes grew by %v, want %v", test.field, test.line, got, want)
+		}
+	}
+}
+
+func TestLogPrometheusZeroByte(t *testing.T) {
+	tests := []struct {
+		policy string
+		series bool
+	}{
+		{"count", true},
+		{"drop", false},
+	}
+	for _, test := range tests {
+		setFlags(t, map[string]string{"zero-byte": test.policy, "labels": "direction,country"})
+		registry := setupTestMetrics(t)
+
+		remote := &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States"}
+		before := testutil.ToFloat64(flowsZeroByte)
+		f := &Flow{Direction: "out", IpDst: remote.Ip, Packages: 1,
+			Source: &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}, Destination: remote}
+		if counted := AccountFlow(f); counted != nil {
+			LogPrometheus(counted)
+		}
+		if got := testutil.ToFloat64(flowsZeroByte) - before; got != 1 {
+			t.Errorf("%s: flows_zero_byte_total grew by %v, want 1", test.policy, got)
+		}
+
+		key := `flow_direction_bytes{country="United States",direction="out"}`
+		value, ok := gatheredFrom(t, registry)[key]
+		if ok != test.series || value != 0 {
+			t.Errorf("%s: %s = %v, present %v, want present %v", test.policy, key, value, ok, test.series)
+		}
+	}
+}
+
+func TestSummaryClass(t *testing.T) {
+	tests := []struct {
+		direction string
+		private   bool
+		class     string
+	}{
+		{"in", false, "internet_in"},
+		{"out", false, "internet_out"},
+		// both ends private, whatever the direction
+		{"in", true, "local"},
+		{"out", true, "local"},
+		{"unknown", true, "local"},
+		// neither local nor decided
+		{"unknown", false, ""},
+	}
+	for _, test := range tests {
+		if got := SummaryClass(&Flow{Direction: test.direction, Private: test.private}); got != test.class {
+			t.Errorf("%s private %v: %q, want %q", test.direction, test.private, got, test.class)
+		}
+	}
+}
+
+func TestLogPrometheusSummaryBytes(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction"})
+	setupTestMetrics(t)
+	classes := []string{"internet_in", "internet_out", "local"}
+	before := map[string]float64{}
+	for _, class := range classes {
+		before[class] = testutil.ToFloat64(flowSummaryBytes.With(prometheus.Labels{"class": class}))
+	}
+
+	for _, f := range []*Flow{
+		{Direction: "in", Bytes: 1000},
+		{Direction: "out", Bytes: 200},
+		{Direction: "in", Bytes: 30, Private: true},
+		{Direction: "unknown", Bytes: 4, Private: true},
+		{Direction: "unknown", Bytes: 50000},
+	} {
+		f.Packages, f.Source, f.Destination = 1, &Peer{}, &Peer{}
+		LogPrometheus(f)
+	}
+	for class, want := range map[string]float64{"internet_in": 1000, "internet_out": 200, "local": 34} {
+		if got := testutil.ToFloat64(flowSummaryBytes.With(prometheus.Labels{"class": class})) - before[class]; got != want {
+			t.Errorf("flow_summary_bytes{class=%q} grew by %v, want %v", class, got, want)
+		}
+	}
+}
+
+func TestLogPrometheusCombineASN(t *testing.T) {
+	setFlags(t, map[string]string{"combine-asn": "true", "labels": "direction,asn,asn_org"})
+	registry := setupTestMetrics(t)
+
+	local := &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}
+	for _, remote := range []*Peer{
+		{Ip: netaddr.MustParseIP("8.8.8.8"), Asn: "15169", AsnOrg: "Google LLC"},
+		{Ip: netaddr.MustParseIP("192.0.2.1"), Asn: "64500"},
+		{Ip: netaddr.MustParseIP("192.0.2.2")},
+	} {
+		LogPrometheus(&Flow{Direction: "out", IpSrc: local.Ip, IpDst: remote.Ip, Bytes: 100, Packages: 1,
+			Source: local, Destination: remote})
+	}
+
+	got := map[string]float64{}
+	for key, value := range gatheredFrom(t, registry) {
+		if strings.HasPrefix(key, "flow_direction_bytes{") {
+			got[key] = value
+		}
+	}
+	// one asn label, no asn_org
+	assertGathered(t, got, map[string]float64{
+		`flow_direction_bytes{asn="15169 (Google LLC)",direction="out"}`: 100,
+		`flow_direction_bytes{asn="64500",direction="out"}`:              100,
+		`flow_direction_bytes{asn="unknown",direction="out"}`:            100,
+	})
+}
+
+// anywhereGeoReader is a misbuilt database with the same answer for every
+// address
+type anywhereGeoReader struct{}
+
+func (anywhereGeoReader) City(ip net.IP) (*geoip2.City, error) {
+	city := &geoip2.City{}
+	city.Country.Names = map[string]string{"en": "Atlantis"}
+	return city, nil
+}
+
+func (anywhereGeoReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	return &geoip2.ASN{AutonomousSystemNumber: 64500, AutonomousSystemOrganization: "Misbuilt"}, nil
+}
+
+func (anywhereGeoReader) ISP(ip net.IP) (*geoip2.ISP, error) {
+	return nil, fmt.Errorf("no ISP database")
+}
+
+func (anywhereGeoReader) ConnectionType(ip net.IP) (*geoip2.ConnectionType, error) {
+	return nil, fmt.Errorf("no connection type database")
+}
+
+func TestMakePeerCounts(t *testing.T) {
+	dbs := GeoReaders{City: anywhereGeoReader{}, ASN: anywhereGeoReader{}, ISP: anywhereGeoReader{}}
+	hits := testutil.ToFloat64(geoipPrivateHits)
+	geoErrors := flowParseErrors.With(prometheus.Labels{"reason": "geoip"})
+	ipErrors := flowParseErrors.With(prometheus.Labels{"reason": "ip_parse"})
+	failed, unparsed := testutil.ToFloat64(geoErrors), testutil.ToFloat64(ipErrors)
+
+	peer, err := MakePeer("192.168.1.20", dbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Country != "" || peer.Asn != "" || peer.SpecialUse != "private-use" {
+		t.Errorf("private peer %+v", *peer)
+	}
+	if got := testutil.ToFloat64(geoipPrivateHits) - hits; got != 1 {
+		t.Errorf("geoip_private_hit_total grew by %v, want 1", got)
+	}
+
+	peer, err = MakePeer("8.8.8.8", dbs)
+	if err != nil || peer.Country != "Atlantis" || peer.Asn != "64500" {
+		t.Errorf("public peer %+v, err %v", peer, err)
+	}
+	// the ISP lookups of both
+	if got := testutil.ToFloat64(geoErrors) - failed; got != 2 {
+		t.Errorf("geoip errors grew by %v, want 2", got)
+	}
+
+	if _, err := MakePeer("not an ip", dbs); err == nil {
+		t.Error("bad address parsed")
+	}
+	if got := testutil.ToFloat64(ipErrors) - unparsed; got != 1 {
+		t.Errorf("ip_parse errors grew by %v, want 1", got)
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		flags map[string]string
+		err   string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"sense": "true", "full-labels": "true"}, ""},
+		{map[string]string{"sense": "true", "openmetrics": "true"}, ""},
+		{map[string]string{"full-labels": "true", "openmetrics": "true"}, ""},
+		{map[string]string{"sense": "true", "full-labels": "true", "openmetrics": "true"},
+			"metrics flow_bytes and flow_bytes_total are both the flow_bytes family in OpenMetrics"},
+		{map[string]string{"labels": "direction,city", "label-city": "true"}, ""},
+		{map[string]string{"timestamp-unit": "fortnight"}, "unknown -timestamp-unit"},
+		{map[string]string{"ewma-alpha": "0"}, "-ewma-alpha must be in (0, 1]"},
+		{map[string]string{"v6-agg-len": "129"}, "-v6-agg-len must be between 0 and 128"},
+		{map[string]string{"tls-cert": "cert.pem"}, "-tls-cert and -tls-key"},
+		{map[string]string{"basic-auth-user": "prometheus"}, "-basic-auth-user and -basic-auth-pass"},
+		{map[string]string{"exemplars": "true"}, "-exemplars needs -openmetrics"},
+		{map[string]string{"session-webhook": "http://localhost:8080"}, "-session-webhook needs -sessions"},
+		{map[string]string{"metrics-path": "metrics"}, "-metrics-path has to start with /"},
+		{map[string]string{"addr": ":9590,"}, "empty address in -addr"},
+		{map[string]string{"metric-namespace": "pm-acct"}, "invalid metric prefix"},
+		{map[string]string{"sink-flush": "0s"}, "-sink-flush must be positive"},
+		{map[string]string{"sink-batch": "-1"}, "-sink-batch must be at least 1"},
+		{map[string]string{"influx-batch": "0"}, "-influx-batch must be at least 1"},
+		{map[string]string{"sqlite-batch": "0"}, "-sqlite-batch must be at least 1"},
+		{map[string]string{"session-webhook-batch": "-5"}, "-session-webhook-batch must be at least 1"},
+		{map[string]string{"sampling-rate": "-10"}, "-sampling-rate must be positive"},
+		{map[string]string{"zero-byte": "skip"}, "unknown -zero-byte"},
+		{map[string]string{"shard-by": "dst"}, "invalid -shard-by"},
+		{map[string]string{"self-flows": "merge"}, "unknown -self-flows"},
+		{map[string]string{"labels": "direction,ip"}, `unknown label "ip"`},
+		{map[string]string{"labels": "direction,country", "combine-asn": "true"}, "-combine-asn and -top-asn need asn"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.flags), func(t *testing.T) {
+			defer func(saved []string) { flowLabels = saved }(flowLabels)
+			setFlags(t, test.flags)
+			err := ValidateFlags()
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.err != "" && err == nil:
+				t.Errorf("no error, want %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("error %q, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	selfFlows    = flag.String("self-flows", "keep", "Flows with identical src and dst: keep, drop, or count (only in flow_self_bytes)")
+	maxFlowBytes = flag.Int("max-flow-bytes", 0, "Drop flows claiming more bytes than this as implausible, 0 disables")
+)
+
+var (
+	flowSelfBytes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flow_self_bytes",
+			Help: "Bytes of flows with identical src and dst, with -self-flows count",
+		},
+	)
+	flowImplausible = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_implausible_total",
+			Help: "Flows dropped for byte or packet values that can't be right, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+// Stage is one step every flow goes through before the outputs see it.
+// Returning false drops the flow, no later stage runs.
+type Stage struct {
+	Name string
+	Run  func(flow *Flow) (bool, error)
+}
+
+// Pipeline runs its stages in order
+type Pipeline []Stage
+
+// Run returns false if a stage dropped the flow
+func (p Pipeline) Run(flow *Flow) (bool, error) {
+	for _, stage := range p {
+		keep, err := stage.Run(flow)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", stage.Name, err)
+		}
+		if !keep {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (p Pipeline) String() string {
+	names := make([]string, len(p))
+	for i, stage := range p {
+		names[i] = stage.Name
+	}
+	return strings.Join(names, " -> ")
+}
+
+// BuildPipeline assembles the stages from the active flags
+func BuildPipeline(localIps []netaddr.IP, geo *GeoDB) Pipeline {
+	var p Pipeline
+	if len(eventTypes) > 0 {
+		p = append(p, Stage{"event", eventStage(eventTypes)})
+	}
+	p = append(p, Stage{"sanity", sanityStage(*maxFlowBytes)}, Stage{"filter", filterStage})
+	if len(includeCIDRs) > 0 || len(excludeCIDRs) > 0 {
+		p = append(p, Stage{"cidr", cidrStage(includeCIDRs, excludeCIDRs)})
+	}
+	if *selfFlows != "keep" {
+		p = append(p, Stage{"self", selfStage(*selfFlows)})
+	}
+	p = append(p,
+		Stage{"enrich", enrichStage(geo)},
+		Stage{"classify", classifyStage(localIps, directionCache)},
+		Stage{"relabel", relabelStage},
+	)
+	if domainGroups != nil {
+		p = append(p, Stage{"domain", domainStage(domainGroups)})
+	}
+	return p
+}
+
+func validSelfFlows(policy string) bool {
+	return policy == "keep" || policy == "drop" || policy == "count"
+}
+
+// sanityStage drops flows with values that would corrupt the counters:
+// negative ones make Add panic, huge ones are malformed or wrapped
+func sanityStage(maxBytes int) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		var reason string
+		switch {
+		case flow.Bytes < 0 || flow.Packages < 0:
+			reason = "negative"
+		case maxBytes > 0 && flow.Bytes > maxBytes:
+			reason = "too_large"
+		default:
+			return true, nil
+		}
+		flowImplausible.With(prometheus.Labels{"reason": reason}).Inc()
+		slog.Warn("implausible flow", "reason", reason, "src", flow.IpSrcRaw, "dst", flow.IpDstRaw,
+			"bytes", flow.Bytes, "packets", flow.Packages)
+		return false, nil
+	}
+}
+
+// filterStage drops -exclude-proto flows before any lookup is done
+func filterStage(flow *Flow) (bool, error) {
+	proto := NormalizeProto(flow.Proto)
+	if isExcludedProto(proto) {
+		flowsExcluded.With(prometheus.Labels{"proto": proto}).Inc()
+		flowsExcludedBytes.With(prometheus.Labels{"proto": proto}).Add(float64(flow.Bytes))
+		return false, nil
+	}
+	return true, nil
+}
+
+// selfStage takes flows with src == dst out of the regular counters, they
+// are neither in nor out
+func selfStage(policy string) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		if flow.IpSrcRaw == "" || flow.IpSrcRaw != flow.IpDstRaw {
+			return true, nil
+		}
+		slog.Debug("self flow", "ip", flow.IpSrcRaw, "src_port", flow.SrcPort, "dst_port", flow.DstPort,
+			"proto", flow.Proto, "bytes", flow.Bytes)
+		if policy == "count" {
+			flowSelfBytes.Add(float64(flow.Bytes))
+		}
+		return false, nil
+	}
+}
+
+// enrichStage looks up both peers in the geo databases
+func enrichStage(geo *GeoDB) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		var source, destination *Peer
+		var sourceErr, destinationErr error
+		// both peers from the same databases, even during a reload
+		geo.View(func(dbs GeoReaders) {
+			source, sourceErr = MakePeer(flow.IpSrcRaw, dbs)
+			destination, destinationErr = MakePeer(flow.IpDstRaw, dbs)
+		})
+		// without both addresses there is nothing to classify, the flow is
+		// skipped whatever the verbosity, counted as ip_parse error
+		if sourceErr != nil {
+			return false, sourceErr
+		}
+		if destinationErr != nil {
+			return false, destinationErr
+		}
+
+		flow.IpSrc = source.Ip
+		flow.IpDst = destination.Ip
+
+		flow.Source = source
+		flow.Destination = destination
+		return true, nil
+	}
+}
+
+// classifyStage decides direction and privateness, with cache remembering
+// the direction of recent address pairs if not nil
+func classifyStage(localIps []netaddr.IP, cache *DirectionCache) func(*Flow) (bool, error) {
+	return func(flow *Flow) (bool, error) {
+		var direction, method string
+		var ok bool
+		if cache != nil {
+			direction, method, ok = cache.Get(flow.IpSrc, flow.IpDst)
+		}
+		if !ok {
+			direction, method = ResolveDirection(*flow, localIps)
+			if cache != nil {
+				cache.Put(flow.IpSrc, flow.IpDst, direction, method)
+			}
+		}
+		flow.Direction = direction
+		flowDirectionResolution.With(prometheus.Labels{"method": method}).Inc()
+		srcPrivate, dstPrivate := isPrivate(flow.IpSrc), isPrivate(flow.IpDst)
+		flow.Private = srcPrivate && dstPrivate
+		flow.PrivateRaw = privacy(srcPrivate, dstPrivate)
+		return true, nil
+	}
+}
+
+// relabelStage maps the exporter through -host-labels
+func relabelStage(flow *Flow) (bool, error) {
+	// nfacctd/sfacctd: the device the flow was exported by
+	if flow.ExporterRaw != "" {
+		flow.Exporter = flow.ExporterRaw
+		if ip, err := netaddr.ParseIP(flow.ExporterRaw); err == nil {
+			flow.Exporter = HostLabel(ip)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/patte/go-pmacct/flow"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestFilterStageExcludedProto(t *testing.T) {
+	defer func(saved stringList) { excludeProtos = saved }(excludeProtos)
+	excludeProtos = stringList{"udp", "1"}
+
+	tests := []struct {
+		proto string
+		keep  bool
+	}{
+		{"udp", false},
+		{"UDP", false},
+		{"17", false},
+		{"icmp", false},
+		{"tcp", true},
+		{"6", true},
+		{"", true},
+	}
+	for _, test := range tests {
+		keep, err := filterStage(&Flow{Proto: test.proto})
+		if err != nil {
+			t.Fatalf("%q: %v", test.proto, err)
+		}
+		if keep != test.keep {
+			t.Errorf("%q: keep %v, want %v", test.proto, keep, test.keep)
+		}
+	}
+}
+
+func TestFilterStageCountsExcluded(t *testing.T) {
+	defer func(saved stringList) { excludeProtos = saved }(excludeProtos)
+	excludeProtos = stringList{"gre"}
+
+	excluded := flowsExcluded.With(prometheus.Labels{"proto": "gre"})
+	excludedBytes := flowsExcludedBytes.With(prometheus.Labels{"proto": "gre"})
+	before, beforeBytes := testutil.ToFloat64(excluded), testutil.ToFloat64(excludedBytes)
+	filterStage(&Flow{Proto: "47", Bytes: 1400})
+	filterStage(&Flow{Proto: "gre", Bytes: 600})
+	filterStage(&Flow{Proto: "tcp", Bytes: 9000})
+	if got := testutil.ToFloat64(excluded) - before; got != 2 {
+		t.Errorf("flows_excluded_total{proto=gre} grew by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(excludedBytes) - beforeBytes; got != 2000 {
+		t.Errorf("flows_excluded_bytes_total{proto=gre} grew by %v, want 2000", got)
+	}
+}
+
+func TestFilterStageNothingExcluded(t *testing.T) {
+	defer func(saved stringList) { excludeProtos = saved }(excludeProtos)
+	excludeProtos = nil
+
+	for _, proto := range []string{"udp", "tcp", "icmp", ""} {
+		if keep, _ := filterStage(&Flow{Proto: proto}); !keep {
+			t.Errorf("%q dropped without -exclude-proto", proto)
+		}
+	}
+}
+
+func TestClassifyStageResolutionMethod(t *testing.T) {
+	defer func(saved []netaddr.IP) { hairpinIps = saved }(hairpinIps)
+	defer func(saved []netaddr.IPPrefix) { localNetworks = saved }(localNetworks)
+	defer func(saved func(Flow, []netaddr.IP, []netaddr.IPPrefix) (string, string)) {
+		resolveDirection = saved
+	}(resolveDirection)
+	hairpinIps = []netaddr.IP{netaddr.MustParseIP("203.0.113.7")}
+	localNetworks = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.0/24")}
+	localIps := []netaddr.IP{netaddr.MustParseIP("198.51.100.1")}
+
+	tests := []struct {
+		mode      string
+		src, dst  string
+		direction string
+		method    string
+	}{
+		{"host", "8.8.8.8", "198.51.100.1", "in", "ip"},
+		{"host", "198.51.100.1", "8.8.8.8", "out", "ip"},
+		{"host", "8.8.8.8", "100.64.0.5", "in", "network"},
+		{"host", "100.64.0.5", "8.8.8.8", "out", "network"},
+		{"host", "8.8.8.8", "1.1.1.1", "unknown", "default-unknown"},
+		{"host", "8.8.8.8", "203.0.113.7", "in", "hairpin"},
+		{"host", "192.168.1.20", "203.0.113.7", "unknown", "hairpin"},
+		{"gateway", "8.8.8.8", "100.64.0.5", "in", "gateway"},
+		{"gateway", "100.64.0.5", "198.51.100.1", "unknown", "internal"},
+		{"gateway", "8.8.8.8", "1.1.1.1", "unknown", "transit"},
+	}
+	for _, test := range tests {
+		resolveDirection = flow.ResolveDirection
+		if test.mode == "gateway" {
+			resolveDirection = flow.ResolveGatewayDirection
+		}
+		counter := flowDirectionResolution.With(prometheus.Labels{"method": test.method})
+		before := testutil.ToFloat64(counter)
+
+		f := &Flow{IpSrc: netaddr.MustParseIP(test.src), IpDst: netaddr.MustParseIP(test.dst)}
+		classifyStage(localIps, nil)(f)
+		if f.Direction != test.direction {
+			t.Errorf("%s %s -> %s: direction %q, want %q", test.mode, test.src, test.dst, f.Direction, test.direction)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s %s -> %s: method %q counted %v times, want 1", test.mode, test.src, test.dst, test.method, got)
+		}
+	}
+}
+
+func TestClassifyStageCachedMethod(t *testing.T) {
+	localIps := []netaddr.IP{netaddr.MustParseIP("198.51.100.1")}
+	cache := NewDirectionCache(16)
+	classify := classifyStage(localIps, cache)
+
+	counter := flowDirectionResolution.With(prometheus.Labels{"method": "ip"})
+	before := testutil.ToFloat64(counter)
+	for i := 0; i < 3; i++ {
+		classify(&Flow{IpSrc: netaddr.MustParseIP("198.51.100.1"), IpDst: netaddr.MustParseIP("8.8.8.8")})
+	}
+	// a cache hit is still counted by the method that decided it
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Errorf("method ip counted %v times, want 3", got)
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	var ran []string
+	stage := func(name string, keep bool) Stage {
+		return Stage{name, func(flow *Flow) (bool, error) {
+			ran = append(ran, name)
+			flow.Label += name
+			return keep, nil
+		}}
+	}
+
+	f := &Flow{}
+	keep, err := Pipeline{stage("a", true), stage("b", true), stage("c", true)}.Run(f)
+	if !keep || err != nil {
+		t.Fatalf("kept %v, err %v", keep, err)
+	}
+	if f.Label != "abc" {
+		t.Errorf("stages ran as %q, want abc", f.Label)
+	}
+
+	// a dropping stage ends the run
+	ran = nil
+	keep, err = Pipeline{stage("a", true), stage("drop", false), stage("c", true)}.Run(&Flow{})
+	if keep || err != nil {
+		t.Errorf("kept %v, err %v after a drop", keep, err)
+	}
+	if strings.Join(ran, ",") != "a,drop" {
+		t.Errorf("ran %v, want a,drop", ran)
+	}
+}
+
+func TestPipelineError(t *testing.T) {
+	ran := false
+	p := Pipeline{
+		{"enrich", func(*Flow) (bool, error) { return true, errors.New("bad address") }},
+		{"classify", func(*Flow) (bool, error) { ran = true; return true, nil }},
+	}
+	keep, err := p.Run(&Flow{})
+	if keep || err == nil || err.Error() != "enrich: bad address" {
+		t.Errorf("kept %v, err %v", keep, err)
+	}
+	if ran {
+		t.Error("stage after the failing one ran")
+	}
+}
+
+func TestBuildPipeline(t *testing.T) {
+	tests := []struct {
+		flags map[string]string
+		want  string
+	}{
+		{map[string]string{}, "sanity -> filter -> enrich -> classify -> relabel"},
+		{map[string]string{"self-flows": "drop"}, "sanity -> filter -> self -> enrich -> classify -> relabel"},
+	}
+	for _, test := range tests {
+		setFlags(t, test.flags)
+		if got := BuildPipeline(nil, nil).String(); got != test.want {
+			t.Errorf("%v: %s, want %s", test.flags, got, test.want)
+		}
+	}
+}
+
+func TestBuildPipelineDropsBeforeLookup(t *testing.T) {
+	setFlags(t, map[string]string{"self-flows": "drop"})
+	// without a GeoDB the enrich stage would panic if it ran
+	p := BuildPipeline(nil, nil)
+	if keep, err := p.Run(&Flow{IpSrcRaw: "10.0.0.1", IpDstRaw: "10.0.0.1"}); keep || err != nil {
+		t.Errorf("self flow: kept %v, err %v", keep, err)
+	}
+	if keep, err := p.Run(&Flow{IpSrcRaw: "10.0.0.1", IpDstRaw: "8.8.8.8", Bytes: -1}); keep || err != nil {
+		t.Errorf("negative bytes: kept %v, err %v", keep, err)
+	}
+}
+
+func TestSelfStage(t *testing.T) {
+	self := func() *Flow {
+		return &Flow{IpSrcRaw: "192.0.2.1", IpDstRaw: "192.0.2.1", Bytes: 400}
+	}
+	other := &Flow{IpSrcRaw: "192.0.2.1", IpDstRaw: "8.8.8.8", Bytes: 400}
+
+	tests := []struct {
+		policy  string
+		counted float64
+	}{
+		{"drop", 0},
+		{"count", 400},
+	}
+	for _, test := range tests {
+		stage := selfStage(test.policy)
+		before := testutil.ToFloat64(flowSelfBytes)
+		if keep, _ := stage(self()); keep {
+			t.Errorf("%s: kept the self flow", test.policy)
+		}
+		if keep, _ := stage(other); !keep {
+			t.Errorf("%s: dropped a regular flow", test.policy)
+		}
+		if got := testutil.ToFloat64(flowSelfBytes) - before; got != test.counted {
+			t.Errorf("%s: flow_self_bytes grew by %v, want %v", test.policy, got, test.counted)
+		}
+	}
+}
+
+func TestSanityStage(t *testing.T) {
+	tests := []struct {
+		bytes, packets int
+		maxBytes       int
+		reason         string
+	}{
+		{1500, 1, 0, ""},
+		{1 << 40, 1, 0, ""},
+		{1 << 40, 1, 1 << 30, "too_large"},
+		{1 << 30, 1, 1 << 30, ""},
+		{-1, 1, 0, "negative"},
+		{100, -1, 1 << 30, "negative"},
+	}
+	for _, test := range tests {
+		counters := map[string]float64{}
+		for _, reason := range []string{"negative", "too_large"} {
+			counters[reason] = testutil.ToFloat64(flowImplausible.With(prometheus.Labels{"reason": reason}))
+		}
+		keep, err := sanityStage(test.maxBytes)(&Flow{Bytes: test.bytes, Packages: test.packets})
+		if err != nil || keep != (test.reason == "") {
+			t.Errorf("%d bytes, %d packets, max %d: kept %v, err %v", test.bytes, test.packets, test.maxBytes, keep, err)
+		}
+		for reason, before := range counters {
+			want := 0.0
+			if reason == test.reason {
+				want = 1
+			}
+			if got := testutil.ToFloat64(flowImplausible.With(prometheus.Labels{"reason": reason})) - before; got != want {
+				t.Errorf("%d bytes, max %d: flow_implausible_total{reason=%q} grew by %v, want %v",
+					test.bytes, test.maxBytes, reason, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	portBytes = flag.Bool("port-bytes", false, "Count bytes per service port in flow_port_bytes_total")
+	portMax   = flag.Int("port-max", 1024, "Ports from this up are labelled ephemeral in flow_port_bytes_total")
+)
+
+var flowPortBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flow_port_bytes_total",
+		Help: "Bytes by the service port of the flow, with -port-bytes",
+	},
+	[]string{"port", "direction"},
+)
+
+// ServicePort labels the service end of a flow: the lower of both ports
+// if it is below max, ephemeral if both are at or above, none for portless
+// protocols like icmp
+func ServicePort(src, dst, max int) string {
+	port := src
+	if port == 0 || (dst != 0 && dst < port) {
+		port = dst
+	}
+	switch {
+	case port == 0:
+		return "none"
+	case port >= max:
+		return "ephemeral"
+	}
+	return strconv.Itoa(port)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clock ticks per second of the times in /proc/<pid>/stat, 100 on every
+// Linux architecture in practice
+const userHZ = 100
+
+// procStat is what PmacctProcessCollector reads of /proc/<pid>/stat
+type procStat struct {
+	pgrp int
+	// user and system time, in ticks
+	cpuTicks uint64
+	// since boot, in ticks
+	startTicks uint64
+	rssPages   uint64
+}
+
+// parseProcStat parses /proc/<pid>/stat. The command in parentheses may
+// contain spaces, the fields are counted from the last ")".
+func parseProcStat(data []byte) (procStat, error) {
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return procStat{}, fmt.Errorf("no command in stat")
+	}
+	// fields[0] is the state, field 3 of proc(5)
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("stat has %d fields after the command", len(fields))
+	}
+	field := func(n int) (uint64, error) {
+		return strconv.ParseUint(fields[n-3], 10, 64)
+	}
+
+	var s procStat
+	pgrp, err := field(5)
+	if err != nil {
+		return s, err
+	}
+	s.pgrp = int(pgrp)
+	utime, err := field(14)
+	if err != nil {
+		return s, err
+	}
+	stime, err := field(15)
+	if err != nil {
+		return s, err
+	}
+	s.cpuTicks = utime + stime
+	if s.startTicks, err = field(22); err != nil {
+		return s, err
+	}
+	if s.rssPages, err = field(24); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// bootTime reads the boot time in unix seconds from the btime line of
+// /proc/stat
+func bootTime(proc string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(proc, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "btime" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no btime in %s/stat", proc)
+}
+
+// PmacctProcessCollector exposes the resource usage of pmacctd when
+// scraped, summed over its process group: the core process and the plugin
+// processes it forks, which hold the flow cache
+type PmacctProcessCollector struct {
+	proc string
+	// the pid of pmacctd, 0 while it is not running
+	pid func() int
+
+	cpuDesc       *prometheus.Desc
+	rssDesc       *prometheus.Desc
+	startDesc     *prometheus.Desc
+	processesDesc *prometheus.Desc
+}
+
+// NewPmacctProcessCollector returns nil if there is no /proc to read, e.g.
+// on macOS
+func NewPmacctProcessCollector(proc string, pid func() int) *PmacctProcessCollector {
+	if _, err := os.Stat(filepath.Join(proc, "self", "stat")); err != nil {
+		return nil
+	}
+	return &PmacctProcessCollector{
+		proc: proc,
+		pid:  pid,
+		cpuDesc: prometheus.NewDesc(
+			"pmacct_process_cpu_seconds_total",
+			"User and system CPU time of the pmacct processes",
+			nil, nil,
+		),
+		rssDesc: prometheus.NewDesc(
+			"pmacct_process_resident_memory_bytes",
+			"Resident memory of the pmacct processes",
+			nil, nil,
+		),
+		startDesc: prometheus.NewDesc(
+			"pmacct_process_start_time_seconds",
+			"Unix time the running pmacct was started",
+			nil, nil,
+		),
+		processesDesc: prometheus.NewDesc(
+			"pmacct_processes",
+			"Processes in the process group of pmacct, the core and its plugins",
+			nil, nil,
+		),
+	}
+}
+
+func (c *PmacctProcessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuDesc
+	ch <- c.rssDesc
+	ch <- c.startDesc
+	ch <- c.processesDesc
+}
+
+// Collect exposes nothing while pmacctd is down, its counters restart with
+// the next process anyway
+func (c *PmacctProcessCollector) Collect(ch chan<- prometheus.Metric) {
+	pid := c.pid()
+	if pid == 0 {
+		return
+	}
+	leader, err := c.stat(pid)
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(c.proc)
+	if err != nil {
+		return
+	}
+	var cpuTicks, rssPages uint64
+	processes := 0
+	for _, entry := range entries {
+		other, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// gone since the listing, or not ours
+		s, err := c.stat(other)
+		if err != nil || s.pgrp != pid {
+			continue
+		}
+		cpuTicks += s.cpuTicks
+		rssPages += s.rssPages
+		processes++
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.cpuDesc, prometheus.CounterValue, float64(cpuTicks)/userHZ)
+	ch <- prometheus.MustNewConstMetric(c.rssDesc, prometheus.GaugeValue, float64(rssPages)*float64(os.Getpagesize()))
+	ch <- prometheus.MustNewConstMetric(c.processesDesc, prometheus.GaugeValue, float64(processes))
+	if boot, err := bootTime(c.proc); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.startDesc, prometheus.GaugeValue, float64(boot)+float64(leader.startTicks)/userHZ)
+	}
+}
+
+func (c *PmacctProcessCollector) stat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join(c.proc, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(data)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+var (
+	resolvePTR   = flag.Bool("resolve-ptr", false, "Look up the PTR record of public addresses, available as src_hostname and dst_hostname in -json-out")
+	ptrTimeout   = flag.Duration("ptr-timeout", 500*time.Millisecond, "Max time a -resolve-ptr lookup may hold up the flow")
+	ptrCacheTTL  = flag.Duration("ptr-cache-ttl", time.Hour, "Time a PTR answer, or its absence, is cached")
+	ptrCacheSize = flag.Int("ptr-cache-size", 10000, "Max addresses in the PTR cache")
+)
+
+// set in main with -resolve-ptr
+var ptrCache *PTRCache
+
+type ptrEntry struct {
+	name    string
+	expires time.Time
+}
+
+// PTRCache resolves addresses to host names, remembering answers and
+// failures for ttl so repeated peers cost one lookup.
+type PTRCache struct {
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	timeout time.Duration
+	ttl     time.Duration
+	max     int
+
+	mu      sync.Mutex
+	entries map[netaddr.IP]ptrEntry
+}
+
+func NewPTRCache(lookup func(ctx context.Context, addr string) ([]string, error), timeout, ttl time.Duration, max int) *PTRCache {
+	return &PTRCache{
+		lookup:  lookup,
+		timeout: timeout,
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[netaddr.IP]ptrEntry),
+	}
+}
+
+// Hostname returns the PTR name of ip without the trailing dot, empty if
+// there is none or the lookup timed out
+func (c *PTRCache) Hostname(ip netaddr.IP, now time.Time) string {
+	c.mu.Lock()
+	entry, ok := c.entries[ip]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var name string
+	if names, err := c.lookup(ctx, ip.String()); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[ip]; !ok && len(c.entries) >= c.max {
+		c.expire(now)
+		// still full of live entries, make room for the newest
+		for old := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, old)
+		}
+	}
+	c.entries[ip] = ptrEntry{name, now.Add(c.ttl)}
+	return name
+}
+
+// expire drops entries past their ttl, c.mu held
+func (c *PTRCache) expire(now time.Time) {
+	for ip, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, ip)
+		}
+	}
+}
+
+// Len returns the number of cached addresses
+func (c *PTRCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func defaultPTRLookup(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var logRate = flag.Float64("log-rate", 0, "Max log messages per second, excess is dropped and summarized, 0 is unlimited")
+
+// RateLimiter is a token bucket counting what it turned away
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func NewRateLimiter(rate float64, now time.Time) *RateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (l *RateLimiter) Allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		l.suppressed++
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Suppressed returns and resets the number of messages turned away
+func (l *RateLimiter) Suppressed() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.suppressed
+	l.suppressed = 0
+	return n
+}
+
+// Writer returns a writer passing each write to out only if the bucket allows
+func (l *RateLimiter) Writer(out io.Writer) io.Writer {
+	return &limitedWriter{l, out}
+}
+
+// Report logs a summary of suppressed messages every interval to logger,
+// which should not write through the limiter
+func (l *RateLimiter) Report(logger *slog.Logger, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := l.Suppressed(); n > 0 {
+				logger.Warn("messages suppressed by -log-rate", "count", n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+type limitedWriter struct {
+	limiter *RateLimiter
+	out     io.Writer
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if !w.limiter.Allow(time.Now()) {
+		// pretend success, a short write would make callers retry or fail
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(5, now)
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if l.Allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("burst allowed %d, want 5", allowed)
+	}
+	if n := l.Suppressed(); n != 15 {
+		t.Errorf("suppressed %d, want 15", n)
+	}
+	if n := l.Suppressed(); n != 0 {
+		t.Errorf("suppressed %d after reading, want 0", n)
+	}
+
+	// refills at the rate
+	now = now.Add(400 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 10; i++ {
+		if l.Allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d after 400ms at 5/s, want 2", allowed)
+	}
+}
+
+func TestRateLimiterBelowOnePerSecond(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(0.5, now)
+	if !l.Allow(now) || l.Allow(now.Add(time.Second)) || !l.Allow(now.Add(2*time.Second)) {
+		t.Error("0.5/s doesn't allow one message every 2s")
+	}
+}
+
+// lineWriter hands every write to a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestRateLimiterSuppressesAndSummarizes(t *testing.T) {
+	l := NewRateLimiter(3, time.Now())
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(l.Writer(&out), nil))
+	for i := 0; i < 100; i++ {
+		logger.Info("flood", "i", i)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 3 {
+		t.Errorf("%d lines written, want the burst of 3:\n%s", lines, out.String())
+	}
+
+	summary := make(lineWriter, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.Report(slog.New(slog.NewTextHandler(summary, nil)), 10*time.Millisecond, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	select {
+	case line := <-summary:
+		if !strings.Contains(line, "messages suppressed by -log-rate") || !strings.Contains(line, "count=97") {
+			t.Errorf("summary %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no summary")
+	}
+}
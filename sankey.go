@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var (
+	sankeyEnabled = flag.Bool("sankey", false, "Serve country to country bytes of the current -top-window as Sankey JSON on /sankey")
+	sankeyLinks   = flag.Int("sankey-links", 30, "Max links in /sankey, the rest is rolled into other")
+)
+
+type SankeyNode struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// source or target, a country can appear on both sides
+	Side string `json:"side"`
+}
+
+type SankeyLink struct {
+	Source int     `json:"source"`
+	Target int     `json:"target"`
+	Value  float64 `json:"value"`
+}
+
+type SankeyData struct {
+	Nodes []SankeyNode `json:"nodes"`
+	Links []SankeyLink `json:"links"`
+}
+
+// CountryPairs sums bytes per source and destination country
+type CountryPairs struct {
+	store *TopN
+	links int
+}
+
+func NewCountryPairs(store *TopN, links int) *CountryPairs {
+	return &CountryPairs{store: store, links: links}
+}
+
+func (c *CountryPairs) Observe(flow *Flow) {
+	c.store.Add(geoLabel(flow.Source.Country)+"\x00"+geoLabel(flow.Destination.Country), float64(flow.Bytes))
+}
+
+// Sankey returns the largest links, everything else becomes a link from
+// the source node other to the target node other
+func (c *CountryPairs) Sankey() SankeyData {
+	top, other := c.store.Top(c.links)
+
+	data := SankeyData{Nodes: []SankeyNode{}, Links: []SankeyLink{}}
+	ids := make(map[string]int)
+	node := func(name, side string) int {
+		key := side + "\x00" + name
+		if id, ok := ids[key]; ok {
+			return id
+		}
+		id := len(data.Nodes)
+		ids[key] = id
+		data.Nodes = append(data.Nodes, SankeyNode{ID: id, Name: name, Side: side})
+		return id
+	}
+
+	for _, e := range top {
+		pair := strings.SplitN(e.Key, "\x00", 2)
+		data.Links = append(data.Links, SankeyLink{
+			Source: node(pair[0], "source"),
+			Target: node(pair[1], "target"),
+			Value:  e.Value,
+		})
+	}
+	if other > 0 {
+		data.Links = append(data.Links, SankeyLink{
+			Source: node("other", "source"),
+			Target: node("other", "target"),
+			Value:  other,
+		})
+	}
+	return data
+}
+
+func (c *CountryPairs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Sankey())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func countryFlow(src, dst string, bytes int) *Flow {
+	return &Flow{
+		Bytes:       bytes,
+		Source:      &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: src},
+		Destination: &Peer{Ip: netaddr.MustParseIP("1.1.1.1"), Country: dst},
+	}
+}
+
+func TestSankeyJSON(t *testing.T) {
+	pairs := NewCountryPairs(NewTopN(100), 2)
+	pairs.Observe(countryFlow("Germany", "France", 500))
+	pairs.Observe(countryFlow("Germany", "France", 500))
+	pairs.Observe(countryFlow("France", "Germany", 300))
+	pairs.Observe(countryFlow("Germany", "Italy", 100))
+	pairs.Observe(countryFlow("Spain", "Italy", 50))
+
+	recorder := httptest.NewRecorder()
+	pairs.ServeHTTP(recorder, httptest.NewRequest("GET", "/sankey", nil))
+	if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("content type %q", got)
+	}
+	var got SankeyData
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := SankeyData{
+		Nodes: []SankeyNode{
+			{0, "Germany", "source"},
+			{1, "France", "target"},
+			{2, "France", "source"},
+			{3, "Germany", "target"},
+			{4, "other", "source"},
+			{5, "other", "target"},
+		},
+		Links: []SankeyLink{
+			{0, 1, 1000},
+			{2, 3, 300},
+			// Germany to Italy and Spain to Italy
+			{4, 5, 150},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSankeyEmpty(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewCountryPairs(NewTopN(100), 2).ServeHTTP(recorder, httptest.NewRequest("GET", "/sankey", nil))
+	if got := recorder.Body.String(); got != "{\"nodes\":[],\"links\":[]}\n" {
+		t.Errorf("empty window: %s", got)
+	}
+}
+
+func TestSankeyConcurrent(t *testing.T) {
+	pairs := NewCountryPairs(NewTopN(100), 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				pairs.Observe(countryFlow("Germany", "France", 1))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				pairs.Sankey()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := pairs.Sankey().Links[0].Value; got != 400 {
+		t.Errorf("Germany to France %v, want 400", got)
+	}
+}
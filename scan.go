@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	scanDetect     = flag.Bool("scan-detect", false, "Flag sources talking to many destinations with few bytes each (flow_scan_suspects)")
+	scanWindow     = flag.Duration("scan-window", time.Minute, "Window in which -scan-detect counts destinations per source")
+	scanMinDsts    = flag.Int("scan-min-dsts", 100, "Distinct destination ip:port pairs in a window for a source to be a scan suspect")
+	scanMaxAvg     = flag.Int("scan-max-bytes-per-flow", 200, "Average bytes per flow below which a source with many destinations is a scan suspect")
+	scanMaxSources = flag.Int("scan-max-sources", 10000, "Max sources tracked per window by -scan-detect")
+	scanLog        = flag.Bool("scan-log", false, "Log every scan suspect at the end of a window")
+)
+
+var flowScanSuspects = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "flow_scan_suspects",
+		Help: "Sources that looked like a scan in the last -scan-window",
+	},
+)
+
+type scanDst struct {
+	ip   netaddr.IP
+	port int
+}
+
+type scanSource struct {
+	peer  *Peer
+	flows int
+	bytes int
+	// only filled up to the suspect threshold, more isn't needed to decide
+	dsts map[scanDst]struct{}
+}
+
+// ScanDetector tracks per source destination counts and bytes per flow in
+// tumbling windows.
+type ScanDetector struct {
+	minDsts    int
+	maxAvg     int
+	maxSources int
+
+	mu      sync.Mutex
+	sources map[netaddr.IP]*scanSource
+}
+
+func NewScanDetector(minDsts, maxAvg, maxSources int) *ScanDetector {
+	return &ScanDetector{
+		minDsts:    minDsts,
+		maxAvg:     maxAvg,
+		maxSources: maxSources,
+		sources:    make(map[netaddr.IP]*scanSource),
+	}
+}
+
+func (d *ScanDetector) Observe(flow *Flow) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	src, ok := d.sources[flow.IpSrc]
+	if !ok {
+		if len(d.sources) >= d.maxSources {
+			return
+		}
+		src = &scanSource{peer: flow.Source, dsts: make(map[scanDst]struct{})}
+		d.sources[flow.IpSrc] = src
+	}
+	src.flows++
+	src.bytes += flow.Bytes
+	if len(src.dsts) < d.minDsts {
+		src.dsts[scanDst{flow.IpDst, flow.DstPort}] = struct{}{}
+	}
+}
+
+// Rotate ends the current window and returns its suspects
+func (d *ScanDetector) Rotate() []*Peer {
+	d.mu.Lock()
+	sources := d.sources
+	d.sources = make(map[netaddr.IP]*scanSource)
+	d.mu.Unlock()
+
+	var suspects []*Peer
+	for _, src := range sources {
+		if len(src.dsts) >= d.minDsts && src.bytes/src.flows <= d.maxAvg {
+			suspects = append(suspects, src.peer)
+		}
+	}
+	return suspects
+}
+
+// Run rotates the window every interval until stop is closed
+func (d *ScanDetector) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			suspects := d.Rotate()
+			flowScanSuspects.Set(float64(len(suspects)))
+			if *scanLog {
+				for _, peer := range suspects {
+					slog.Info("scan suspect", "ip", peer.Ip, "asn", peer.Asn, "asn_org", peer.AsnOrg, "country", peer.Country)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
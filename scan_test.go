@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func scanFlow(src, dst netaddr.IP, dstPort, bytes int) *Flow {
+	return &Flow{IpSrc: src, IpDst: dst, DstPort: dstPort, Bytes: bytes, Source: &Peer{Ip: src}}
+}
+
+func TestScanDetector(t *testing.T) {
+	d := NewScanDetector(100, 200, 1000)
+	scanner := netaddr.MustParseIP("198.51.100.66")
+	backup := netaddr.MustParseIP("10.0.0.5")
+
+	// one SYN sized flow to each of 500 hosts
+	for i := 0; i < 500; i++ {
+		d.Observe(scanFlow(scanner, netaddr.IPv4(10, 1, byte(i>>8), byte(i)), 22, 60))
+	}
+	// many more flows and bytes, but to a handful of destinations
+	for i := 0; i < 5000; i++ {
+		d.Observe(scanFlow(backup, netaddr.IPv4(10, 2, 0, byte(i%5)), 443, 1400))
+	}
+
+	suspects := d.Rotate()
+	if len(suspects) != 1 || suspects[0].Ip != scanner {
+		t.Fatalf("suspects %v, want only the scanner", suspects)
+	}
+	if suspects := d.Rotate(); len(suspects) != 0 {
+		t.Errorf("next window starts with %d suspects", len(suspects))
+	}
+}
+
+func TestScanDetectorHeavyFanOut(t *testing.T) {
+	// a CDN edge talking to many clients moves real data
+	d := NewScanDetector(100, 200, 1000)
+	server := netaddr.MustParseIP("10.0.0.80")
+	for i := 0; i < 500; i++ {
+		d.Observe(scanFlow(server, netaddr.IPv4(11, 1, byte(i>>8), byte(i)), 50000+i, 90000))
+	}
+	if suspects := d.Rotate(); len(suspects) != 0 {
+		t.Errorf("high volume host flagged: %v", suspects)
+	}
+}
+
+func TestScanDetectorPortScan(t *testing.T) {
+	// destinations are ip:port pairs, a port scan of one host counts
+	d := NewScanDetector(100, 200, 1000)
+	scanner := netaddr.MustParseIP("198.51.100.66")
+	target := netaddr.MustParseIP("10.0.0.1")
+	for port := 1; port <= 1024; port++ {
+		d.Observe(scanFlow(scanner, target, port, 44))
+	}
+	if suspects := d.Rotate(); len(suspects) != 1 {
+		t.Errorf("%d suspects, want the port scanner", len(suspects))
+	}
+}
+
+func TestScanDetectorMaxSources(t *testing.T) {
+	d := NewScanDetector(1, 200, 2)
+	for i := 0; i < 5; i++ {
+		d.Observe(scanFlow(netaddr.IPv4(10, 0, 0, byte(i)), netaddr.MustParseIP("10.9.9.9"), 80, 40))
+	}
+	if len(d.sources) != 2 {
+		t.Errorf("tracking %d sources, want -scan-max-sources 2", len(d.sources))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	sessionsEnabled   = flag.Bool("sessions", false, "Pair both directions of a connection into sessions (flow_session_bytes)")
+	sessionWindow     = flag.Duration("session-window", 30*time.Second, "How long a flow waits for its reverse direction before it is dropped as orphaned")
+	sessionMaxPending = flag.Int("session-max-pending", 10000, "Max unmatched flows kept while waiting for their reverse direction, oldest are evicted first")
+)
+
+var (
+	flowSessionBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_session_bytes",
+			Help: "Bytes of both directions of assembled sessions",
+		},
+		[]string{"proto"},
+	)
+	flowSessions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_sessions_total",
+			Help: "Session halves by outcome: matched or orphaned",
+		},
+		[]string{"state"},
+	)
+)
+
+// sessionKey is the canonical 5-tuple of a flow, the lower endpoint first,
+// so that both directions of a connection map to the same key
+type sessionKey struct {
+	Proto    string
+	LowIp    netaddr.IP
+	LowPort  int
+	HighIp   netaddr.IP
+	HighPort int
+}
+
+func makeSessionKey(f *Flow) sessionKey {
+	proto := NormalizeProto(f.Proto)
+	if f.IpSrc.Less(f.IpDst) || (f.IpSrc == f.IpDst && f.SrcPort <= f.DstPort) {
+		return sessionKey{proto, f.IpSrc, f.SrcPort, f.IpDst, f.DstPort}
+	}
+	return sessionKey{proto, f.IpDst, f.DstPort, f.IpSrc, f.SrcPort}
+}
+
+// Session is a connection with both of its directions
+type Session struct {
+	Proto          string
+	Initiator      *Peer
+	Responder      *Peer
+	SrcPort        int
+	DstPort        int
+	BytesForward   int
+	BytesReverse   int
+	PacketsForward int
+	PacketsReverse int
+}
+
+func (s *Session) Bytes() int {
+	return s.BytesForward + s.BytesReverse
+}
+
+// Record returns the session as written to -json-out and
+// -session-webhook, type tells it apart from flow records
+func (s *Session) Record() map[string]interface{} {
+	return map[string]interface{}{
+		"type":            "session",
+		"proto":           s.Proto,
+		"ip_src":          s.Initiator.Ip.String(),
+		"ip_dst":          s.Responder.Ip.String(),
+		"port_src":        s.SrcPort,
+		"port_dst":        s.DstPort,
+		"src_country":     s.Initiator.Country,
+		"dst_country":     s.Responder.Country,
+		"src_asn":         s.Initiator.Asn,
+		"dst_asn":         s.Responder.Asn,
+		"bytes_forward":   s.BytesForward,
+		"bytes_reverse":   s.BytesReverse,
+		"packets_forward": s.PacketsForward,
+		"packets_reverse": s.PacketsReverse,
+		"bytes":           s.Bytes(),
+	}
+}
+
+// pendingHalf is a flow waiting for its reverse direction. Later purges of
+// the same direction add up in bytes and packets, the flow itself is shared
+// with the other outputs and never written to.
+type pendingHalf struct {
+	key     sessionKey
+	flow    *Flow
+	bytes   int
+	packets int
+	seen    time.Time
+}
+
+// SessionTable holds flows waiting for their reverse direction. Entries are
+// kept in arrival order, which is also their expiry order, so expiring and
+// evicting only ever look at the front of the list.
+type SessionTable struct {
+	window     time.Duration
+	maxPending int
+
+	mu      sync.Mutex
+	order   *list.List
+	pending map[sessionKey]*list.Element
+}
+
+func NewSessionTable(window time.Duration, maxPending int) *SessionTable {
+	return &SessionTable{
+		window:     window,
+		maxPending: maxPending,
+		order:      list.New(),
+		pending:    make(map[sessionKey]*list.Element),
+	}
+}
+
+// Add pairs the flow with a waiting reverse half and returns the assembled
+// session, or stores it as pending and returns nil.
+func (t *SessionTable) Add(f *Flow, now time.Time) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+
+	key := makeSessionKey(f)
+	if e, ok := t.pending[key]; ok {
+		half := e.Value.(*pendingHalf)
+		// same direction twice, i.e. a later purge of the same half
+		if half.flow.IpSrc == f.IpSrc && half.flow.SrcPort == f.SrcPort {
+			half.bytes += f.Bytes
+			half.packets += f.Packages
+			return nil
+		}
+		t.order.Remove(e)
+		delete(t.pending, key)
+		flowSessions.With(prometheus.Labels{"state": "matched"}).Add(2)
+		first := half.flow
+		return &Session{
+			Proto:          key.Proto,
+			Initiator:      first.Source,
+			Responder:      first.Destination,
+			SrcPort:        first.SrcPort,
+			DstPort:        first.DstPort,
+			BytesForward:   half.bytes,
+			BytesReverse:   f.Bytes,
+			PacketsForward: half.packets,
+			PacketsReverse: f.Packages,
+		}
+	}
+
+	for t.order.Len() >= t.maxPending && t.order.Len() > 0 {
+		t.drop(t.order.Front())
+	}
+	t.pending[key] = t.order.PushBack(&pendingHalf{key: key, flow: f, bytes: f.Bytes, packets: f.Packages, seen: now})
+	return nil
+}
+
+// expire drops halves whose reverse direction didn't show up within the window
+func (t *SessionTable) expire(now time.Time) {
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		if now.Sub(e.Value.(*pendingHalf).seen) < t.window {
+			return
+		}
+		t.drop(e)
+	}
+}
+
+func (t *SessionTable) drop(e *list.Element) {
+	t.order.Remove(e)
+	delete(t.pending, e.Value.(*pendingHalf).key)
+	flowSessions.With(prometheus.Labels{"state": "orphaned"}).Inc()
+}
+
+func LogSession(s *Session) {
+	flowSessionBytes.With(prometheus.Labels{"proto": s.Proto}).Add(float64(s.Bytes()))
+	slog.Debug("session", "proto", s.Proto, "initiator", s.Initiator.Ip, "src_port", s.SrcPort,
+		"responder", s.Responder.Ip, "dst_port", s.DstPort, "bytes_forward", s.BytesForward, "bytes_reverse", s.BytesReverse)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func sessionFlow(src string, srcPort int, dst string, dstPort int, bytes, packets int) *Flow {
+	srcIp, dstIp := netaddr.MustParseIP(src), netaddr.MustParseIP(dst)
+	return &Flow{
+		IpSrcRaw: src, IpDstRaw: dst, IpSrc: srcIp, IpDst: dstIp,
+		SrcPort: srcPort, DstPort: dstPort, Proto: "tcp",
+		Bytes: bytes, Packages: packets,
+		Source: &Peer{Ip: srcIp}, Destination: &Peer{Ip: dstIp},
+	}
+}
+
+func TestSessionTableMatched(t *testing.T) {
+	table := NewSessionTable(time.Minute, 10)
+	matched := flowSessions.With(prometheus.Labels{"state": "matched"})
+	before := testutil.ToFloat64(matched)
+	now := time.Unix(1000, 0)
+
+	if s := table.Add(sessionFlow("10.0.0.1", 50000, "1.1.1.1", 443, 100, 2), now); s != nil {
+		t.Fatalf("first half assembled a session: %+v", s)
+	}
+	s := table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 50000, 900, 3), now.Add(time.Second))
+	if s == nil {
+		t.Fatal("reverse half didn't assemble a session")
+	}
+
+	if s.Initiator.Ip != netaddr.MustParseIP("10.0.0.1") || s.SrcPort != 50000 || s.DstPort != 443 {
+		t.Errorf("initiator %v:%d -> %d, want the first half's 10.0.0.1:50000 -> 443", s.Initiator.Ip, s.SrcPort, s.DstPort)
+	}
+	if s.BytesForward != 100 || s.BytesReverse != 900 || s.Bytes() != 1000 {
+		t.Errorf("bytes %d + %d = %d, want 100 + 900 = 1000", s.BytesForward, s.BytesReverse, s.Bytes())
+	}
+	if s.PacketsForward != 2 || s.PacketsReverse != 3 {
+		t.Errorf("packets %d + %d, want 2 + 3", s.PacketsForward, s.PacketsReverse)
+	}
+	if got := testutil.ToFloat64(matched) - before; got != 2 {
+		t.Errorf("matched halves grew by %v, want 2", got)
+	}
+	if table.order.Len() != 0 || len(table.pending) != 0 {
+		t.Errorf("%d halves still pending after the match", table.order.Len())
+	}
+}
+
+func TestSessionTableMergesRepeatedHalf(t *testing.T) {
+	table := NewSessionTable(time.Minute, 10)
+	now := time.Unix(1000, 0)
+
+	first := sessionFlow("10.0.0.1", 50000, "1.1.1.1", 443, 100, 1)
+	later := sessionFlow("10.0.0.1", 50000, "1.1.1.1", 443, 50, 1)
+	table.Add(first, now)
+	if s := table.Add(later, now.Add(time.Second)); s != nil {
+		t.Fatalf("a second purge of the same direction assembled a session: %+v", s)
+	}
+	s := table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 50000, 10, 1), now.Add(2*time.Second))
+	if s == nil {
+		t.Fatal("reverse half didn't assemble a session")
+	}
+	if s.BytesForward != 150 || s.PacketsForward != 2 {
+		t.Errorf("forward %d bytes %d packets, want both purges: 150 and 2", s.BytesForward, s.PacketsForward)
+	}
+	// the other outputs still hold the flow
+	if first.Bytes != 100 || first.Packages != 1 {
+		t.Errorf("pending flow changed to %d bytes %d packets", first.Bytes, first.Packages)
+	}
+}
+
+func TestSessionTableOrphaned(t *testing.T) {
+	table := NewSessionTable(30*time.Second, 10)
+	orphaned := flowSessions.With(prometheus.Labels{"state": "orphaned"})
+	before := testutil.ToFloat64(orphaned)
+	now := time.Unix(1000, 0)
+
+	table.Add(sessionFlow("10.0.0.1", 50000, "1.1.1.1", 443, 100, 1), now)
+	// the reverse shows up too late, it waits as a half of its own
+	if s := table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 50000, 900, 1), now.Add(31*time.Second)); s != nil {
+		t.Fatalf("expired half assembled a session: %+v", s)
+	}
+	if got := testutil.ToFloat64(orphaned) - before; got != 1 {
+		t.Errorf("orphaned halves grew by %v, want 1", got)
+	}
+	if table.order.Len() != 1 {
+		t.Errorf("%d halves pending, want the late one", table.order.Len())
+	}
+}
+
+func TestSessionTableEvictsOldest(t *testing.T) {
+	table := NewSessionTable(time.Minute, 2)
+	orphaned := flowSessions.With(prometheus.Labels{"state": "orphaned"})
+	before := testutil.ToFloat64(orphaned)
+	now := time.Unix(1000, 0)
+
+	table.Add(sessionFlow("10.0.0.1", 1, "1.1.1.1", 443, 1, 1), now)
+	table.Add(sessionFlow("10.0.0.1", 2, "1.1.1.1", 443, 1, 1), now)
+	table.Add(sessionFlow("10.0.0.1", 3, "1.1.1.1", 443, 1, 1), now)
+
+	if got := testutil.ToFloat64(orphaned) - before; got != 1 {
+		t.Errorf("orphaned halves grew by %v, want 1", got)
+	}
+	if s := table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 1, 1, 1), now); s != nil {
+		t.Errorf("evicted half assembled a session: %+v", s)
+	}
+	if s := table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 3, 1, 1), now); s == nil {
+		t.Error("newest half was evicted")
+	}
+}
+
+func testSession() *Session {
+	table := NewSessionTable(time.Minute, 10)
+	now := time.Unix(1000, 0)
+	table.Add(sessionFlow("10.0.0.1", 50000, "1.1.1.1", 443, 100, 2), now)
+	return table.Add(sessionFlow("1.1.1.1", 443, "10.0.0.1", 50000, 900, 3), now)
+}
+
+func TestJSONWriterWriteSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.json")
+	w, err := NewJSONWriter(path, []string{"bytes"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteSession(testSession()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var record map[string]interface{}
+	if err := json.NewDecoder(bufio.NewReader(file)).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record["type"] != "session" || record["ip_src"] != "10.0.0.1" || record["bytes"] != 1000.0 ||
+		record["bytes_forward"] != 100.0 || record["bytes_reverse"] != 900.0 {
+		t.Errorf("record %v", record)
+	}
+}
+
+func TestWebhookWriter(t *testing.T) {
+	records := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var record map[string]interface{}
+			if err := dec.Decode(&record); err != nil {
+				t.Error(err)
+				return
+			}
+			records <- record
+		}
+	}))
+	defer server.Close()
+
+	w := NewWebhookWriter(server.URL, EmitterConfig{Queue: 10, Batch: 10, Flush: time.Hour})
+	w.Write(testSession())
+	w.Write(testSession())
+	w.Close()
+
+	if len(records) != 2 {
+		t.Fatalf("webhook got %d records, want 2", len(records))
+	}
+	record := <-records
+	if record["type"] != "session" || record["proto"] != "tcp" || record["port_dst"] != 443.0 {
+		t.Errorf("record %v", record)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sinkName  = flag.String("sink", "prometheus", "Where flow counts go: prometheus, influx-udp (line protocol) or statsd, both over UDP to -sink-addr")
+	sinkAddr  = flag.String("sink-addr", "", "host:port of the UDP listener of -sink influx-udp or statsd")
+	sinkBatch = flag.Int("sink-batch", 500, "Flows per flush of -sink influx-udp or statsd")
+	sinkFlush = flag.Duration("sink-flush", time.Second, "Max time a flow waits before -sink influx-udp or statsd sends it")
+)
+
+// a datagram stays below the usual MTU, bigger ones may be fragmented or
+// dropped on the way
+const maxDatagram = 1432
+
+// FlowSink takes the counts of every flow that made it through the pipeline
+type FlowSink interface {
+	Write(flow *Flow)
+	Close()
+}
+
+// NewFlowSink returns the sink of -sink
+func NewFlowSink(name, addr string, config EmitterConfig) (FlowSink, error) {
+	var format func(flow *Flow, at time.Time) string
+	switch name {
+	case "prometheus":
+		return prometheusSink{}, nil
+	case "influx-udp":
+		format = FormatLineProtocol
+	case "statsd":
+		format = FormatStatsd
+	default:
+		return nil, fmt.Errorf("unknown sink %q", name)
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("-sink %s needs -sink-addr", name)
+	}
+	return NewUDPSink(name, addr, format, config)
+}
+
+// AccountFlow applies -zero-byte and -sampling-rate to a flow on its way to
+// the sink and counts it in flow_events_total. It returns nil for a flow the
+// sink doesn't get, else the flow with its bytes and packets scaled.
+func AccountFlow(flow *Flow) *Flow {
+	if flow.Bytes == 0 {
+		flowsZeroByte.Inc()
+		if *zeroBytePolicy == "drop" {
+			flowEvents.With(prometheus.Labels{"status": "filtered"}).Inc()
+			return nil
+		}
+	}
+
+	if flow.RemotePeer() != nil {
+		flowEvents.With(prometheus.Labels{"status": "counted"}).Inc()
+	} else {
+		flowEvents.With(prometheus.Labels{"status": "unknown_direction"}).Inc()
+	}
+
+	if *samplingRate == 1 {
+		return flow
+	}
+	// the other outputs keep what pmacct reported
+	scaled := *flow
+	scaled.Bytes *= *samplingRate
+	scaled.Packages *= *samplingRate
+	return &scaled
+}
+
+// prometheusSink counts flows in the metrics served on -metrics-path
+type prometheusSink struct{}
+
+func (prometheusSink) Write(flow *Flow) {
+	LogPrometheus(flow)
+}
+
+func (prometheusSink) Close() {}
+
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", ":", "_")
+
+// FormatStatsd renders a flow as the counters flow.bytes and flow.packets,
+// with DogStatsD tags. Statsd keeps no timestamps, at is not used.
+func FormatStatsd(flow *Flow, at time.Time) string {
+	tags := [][2]string{
+		{"direction", flow.Direction},
+		{"private", flow.PrivateRaw},
+		{"proto", NormalizeProto(flow.Proto)},
+	}
+	if peer := flow.RemotePeer(); peer != nil {
+		tags = append(tags,
+			[2]string{"country", geoLabel(peer.Country)},
+			[2]string{"asn", geoLabel(peer.Asn)},
+			[2]string{"asn_org", geoLabel(peer.AsnOrg)},
+		)
+	}
+	var joined []string
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		joined = append(joined, tag[0]+":"+statsdTagEscaper.Replace(tag[1]))
+	}
+	suffix := ""
+	if len(joined) > 0 {
+		suffix = "|#" + strings.Join(joined, ",")
+	}
+	return fmt.Sprintf("flow.bytes:%d|c%s\nflow.packets:%d|c%s\n", flow.Bytes, suffix, flow.Packages, suffix)
+}
+
+// UDPSink sends formatted flows to a UDP listener like Telegraf or statsd
+// through an AsyncEmitter, packing as many lines per datagram as fit
+type UDPSink struct {
+	format func(flow *Flow, at time.Time) string
+	conn   net.Conn
+
+	emitter *AsyncEmitter
+}
+
+func NewUDPSink(name, addr string, format func(flow *Flow, at time.Time) string, config EmitterConfig) (*UDPSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &UDPSink{format: format, conn: conn}
+	s.emitter = NewAsyncEmitter(name, config, s.send)
+	return s, nil
+}
+
+// Write queues the flow, dropping it if the queue is full
+func (s *UDPSink) Write(flow *Flow) {
+	s.emitter.Enqueue(s.format(flow, time.Now()))
+}
+
+// Close sends what is still queued and closes the socket
+func (s *UDPSink) Close() {
+	s.emitter.Close()
+	s.conn.Close()
+}
+
+// send writes the batch in datagrams of whole lines. A flow longer than
+// maxDatagram goes alone.
+func (s *UDPSink) send(batch []interface{}) error {
+	var datagram []byte
+	for _, item := range batch {
+		lines := item.(string)
+		if len(datagram) > 0 && len(datagram)+len(lines) > maxDatagram {
+			if _, err := s.conn.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		datagram = append(datagram, lines...)
+	}
+	if len(datagram) > 0 {
+		_, err := s.conn.Write(datagram)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"inet.af/netaddr"
+)
+
+func TestAccountFlow(t *testing.T) {
+	setFlags(t, map[string]string{"sampling-rate": "10", "zero-byte": "drop"})
+	events := func(status string) float64 {
+		return testutil.ToFloat64(flowEvents.With(prometheus.Labels{"status": status}))
+	}
+	counted, unknown, filtered := events("counted"), events("unknown_direction"), events("filtered")
+
+	f := influxFlow()
+	scaled := AccountFlow(f)
+	if scaled == nil || scaled.Bytes != 15000 || scaled.Packages != 30 {
+		t.Fatalf("scaled to %+v", scaled)
+	}
+	// the other outputs get the flow as reported
+	if f.Bytes != 1500 || f.Packages != 3 {
+		t.Errorf("flow changed to %d bytes %d packets", f.Bytes, f.Packages)
+	}
+
+	transit := influxFlow()
+	transit.Direction = "unknown"
+	if AccountFlow(transit) == nil {
+		t.Error("unknown direction flow not passed on")
+	}
+
+	empty := influxFlow()
+	empty.Bytes = 0
+	if got := AccountFlow(empty); got != nil {
+		t.Errorf("zero byte flow passed on as %+v", got)
+	}
+
+	for status, want := range map[string]float64{
+		"counted":           counted + 1,
+		"unknown_direction": unknown + 1,
+		"filtered":          filtered + 1,
+	} {
+		if got := events(status); got != want {
+			t.Errorf("flow_events_total{status=%q} = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestAccountFlowDefaults(t *testing.T) {
+	f := influxFlow()
+	if got := AccountFlow(f); got != f {
+		t.Errorf("unsampled flow copied")
+	}
+	f.Bytes = 0
+	if AccountFlow(f) == nil {
+		t.Error("zero byte flow dropped with -zero-byte count")
+	}
+}
+
+func TestStatsdSinkSampled(t *testing.T) {
+	setFlags(t, map[string]string{"sampling-rate": "10", "zero-byte": "drop"})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewFlowSink("statsd", conn.LocalAddr().String(), NewEmitterConfig(10, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := influxFlow()
+	empty.Bytes = 0
+	for _, f := range []*Flow{influxFlow(), empty} {
+		if counted := AccountFlow(f); counted != nil {
+			sink.Write(counted)
+		}
+	}
+	sink.Close()
+
+	buf := make([]byte, maxDatagram)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	if !strings.HasPrefix(got, "flow.bytes:15000|c|#") || !strings.Contains(got, "flow.packets:30|c|#") {
+		t.Errorf("datagram %q, want the sampled counts", got)
+	}
+	if lines := strings.Count(got, "\n"); lines != 2 {
+		t.Errorf("%d lines, want the zero byte flow dropped: %q", lines, got)
+	}
+}
+
+func TestLogPrometheusSampled(t *testing.T) {
+	setFlags(t, map[string]string{"sampling-rate": "100", "labels": "direction"})
+	registry := setupTestMetrics(t)
+
+	remote := &Peer{Ip: netaddr.MustParseIP("8.8.8.8")}
+	prometheusSink{}.Write(AccountFlow(&Flow{Direction: "out", IpDst: remote.Ip, Bytes: 3, Packages: 1,
+		Source: &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}, Destination: remote}))
+
+	got := gatheredFrom(t, registry)
+	if got[`flow_direction_bytes{direction="out"}`] != 300 || got[`flow_direction_packets{direction="out"}`] != 100 {
+		t.Errorf("bytes %v packets %v, want 300 and 100", got[`flow_direction_bytes{direction="out"}`], got[`flow_direction_packets{direction="out"}`])
+	}
+}
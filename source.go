@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	unixgramPath = flag.String("unixgram", "", "Read JSON flows from datagrams on this unix socket instead of running pmacctd")
+	listenFlow   = flag.String("listen-flow", "", "Accept connections streaming JSON flows instead of running pmacctd, unix:///path/to.sock or tcp://host:port")
+	stdinInput   = flag.Bool("stdin", false, "Read JSON flows from stdin instead of running pmacctd, exits at EOF")
+
+	pmacctBin  = flag.String("pmacct-bin", "pmacctd", "pmacct daemon to run, e.g. nfacctd or sfacctd for NetFlow or sFlow")
+	pmacctArgs = flag.String("pmacct-args", "-r 1 -c src_host,dst_host,src_port,dst_port,proto -P print -O json", "Space separated arguments of -pmacct-bin, it has to print JSON to stdout")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Time -pmacct-bin gets to purge and exit on shutdown before it and its helper processes are killed")
+
+	maxLineBytes = flag.Int("max-line-bytes", 1<<20, "Longest line or datagram read from the input, longer JSON lines are an error")
+)
+
+var (
+	pmacctOutputLines = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pmacct_output_lines_total",
+			Help: "Lines read from the input, JSON flows or not",
+		},
+	)
+	pmacctLastOutput = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pmacct_last_output_timestamp",
+			Help: "Unix time of the last line read from the input, startup time until the first",
+		},
+	)
+	pmacctStatusLines = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmacct_status_lines_total",
+			Help: "Lines read from the input that aren't JSON flows, by kind: purge, exit or other",
+		},
+		[]string{"kind"},
+	)
+)
+
+// countLines wraps handle to count every line a source delivers, before any
+// filtering, so a silent pmacctd is told apart from traffic nobody wants
+func countLines(handle func(text string), now func() time.Time) func(text string) {
+	pmacctLastOutput.Set(float64(now().Unix()))
+	return func(text string) {
+		pmacctOutputLines.Inc()
+		pmacctLastOutput.Set(float64(now().Unix()))
+		handle(text)
+	}
+}
+
+// PmacctLineKind classifies a line that isn't a JSON flow. pmacct logs
+// "*** Purging cache - START ..." and "- END" around each purge of the print
+// plugin and "OK, Exiting ..." once a daemon or plugin is done.
+func PmacctLineKind(text string) string {
+	switch {
+	case strings.Contains(text, "OK, Exiting"):
+		return "exit"
+	case strings.Contains(text, "Purging cache"):
+		return "purge"
+	}
+	return "other"
+}
+
+// watchStatus wraps handle to count the status lines of pmacct and call
+// onExit, if set, when pmacct says it is exiting. It has to run before the
+// workers, so the shutdown begins before the source sees pmacctd gone and
+// starts it again.
+func watchStatus(handle func(text string), onExit func()) func(text string) {
+	return func(text string) {
+		if !strings.HasPrefix(text, "{") {
+			kind := PmacctLineKind(text)
+			pmacctStatusLines.With(prometheus.Labels{"kind": kind}).Inc()
+			if kind == "exit" && onExit != nil {
+				onExit()
+			}
+		}
+		handle(text)
+	}
+}
+
+// newLineScanner scans lines of up to -max-line-bytes, the default 64KB of
+// bufio is too short for flows with many primitives
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	// the larger of the two bounds a token
+	size := 64 << 10
+	if *maxLineBytes < size {
+		size = *maxLineBytes
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, size), *maxLineBytes)
+	return scanner
+}
+
+// scanErr returns the error that ended scanner, with a hint for lines
+// longer than -max-line-bytes
+func scanErr(scanner *bufio.Scanner) error {
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w, raise -max-line-bytes (%d)", err, *maxLineBytes)
+	}
+	return err
+}
+
+// gzipMagic starts every gzip stream, never a JSON line
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeGunzip decompresses r if it starts like a gzip stream and reads it
+// as it is otherwise, e.g. for a .json.gz dump piped to -stdin
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// FlowSource delivers pmacct output lines
+type FlowSource interface {
+	// Run hands every line to handle and returns once the source is done.
+	// Cancelling ctx stops the source, Run returns after handling the line
+	// in progress, or for pmacctd the lines it prints while exiting.
+	Run(ctx context.Context, handle func(text string)) error
+}
+
+// OpenFlowSource opens the input chosen by the flags, pmacctd by default
+func OpenFlowSource() (FlowSource, error) {
+	switch {
+	case *stdinInput:
+		return NewStdinSource(), nil
+	case *unixgramPath != "":
+		return ListenUnixgram(*unixgramPath)
+	case *listenFlow != "":
+		return ListenFlowStream(*listenFlow)
+	}
+	return StartPmacctd(*pmacctBin, *pmacctArgs)
+}
+
+// backoff between restarts of a pmacctd that exited on its own, reset once
+// it ran for pmacctRestartMax
+const (
+	pmacctRestartMin = time.Second
+	pmacctRestartMax = time.Minute
+)
+
+var pmacctRestarts = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pmacct_restarts_total",
+		Help: "Times pmacctd exited unexpectedly and was started again",
+	},
+)
+
+// PmacctdSource runs pmacctd, or another pmacct daemon, and reads its stdout.
+// If it exits before Stop it is started again with exponential backoff.
+type PmacctdSource struct {
+	bin  string
+	args []string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdout  io.Reader
+	stopped bool
+	running bool
+}
+
+// StartPmacctd runs bin with args split on whitespace. Commas are kept, they
+// separate the primitives of -c.
+func StartPmacctd(bin string, args string) (*PmacctdSource, error) {
+	s := &PmacctdSource{bin: bin, args: strings.Fields(args)}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PmacctdSource) start() error {
+	// exec command: pmacctd
+	// https://github.com/pmacct/pmacct/blob/master/QUICKSTART
+	// https://github.com/pmacct/pmacct/blob/6579ebeccdd0dd33e013a20a0b12a89c1bd65e94/sql/pmacct-create-table_v9.pgsql
+	//
+	cmd := exec.Command(s.bin, s.args...)
+	// own process group, signals reach the plugin processes pmacctd forks
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return errors.New("stopped")
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start() failed with '%s'", err)
+	}
+	s.cmd, s.stdout = cmd, stdout
+	s.running = true
+	return nil
+}
+
+// Running reports whether the process is up, false while waiting to restart
+func (s *PmacctdSource) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Pid returns the process id of pmacctd, 0 while waiting to restart
+func (s *PmacctdSource) Pid() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return 0
+	}
+	return s.cmd.Process.Pid
+}
+
+func (s *PmacctdSource) exited() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+}
+
+// scan reads the running process until its stdout closes and waits for it
+func (s *PmacctdSource) scan(handle func(text string)) error {
+	s.mu.Lock()
+	cmd, stdout := s.cmd, s.stdout
+	s.mu.Unlock()
+
+	defer s.exited()
+
+	scanner := newLineScanner(stdout)
+	for scanner.Scan() {
+		handle(scanner.Text())
+	}
+	if err := scanErr(scanner); err != nil {
+		// nobody reads its output anymore, a restart is all that helps
+		killGroup(cmd)
+		cmd.Wait()
+		return err
+	}
+	err := cmd.Wait()
+	// helpers outliving pmacctd would keep capturing on the interface
+	killGroup(cmd)
+	return err
+}
+
+// killGroup sends SIGKILL to the process group of cmd, one already gone is
+// no error
+func killGroup(cmd *exec.Cmd) error {
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+func (s *PmacctdSource) Run(ctx context.Context, handle func(text string)) error {
+	release := context.AfterFunc(ctx, func() {
+		if err := s.interrupt(); err != nil {
+			slog.Error("stopping pmacct", "bin", s.bin, "err", err)
+		}
+	})
+	defer release()
+
+	backoff := pmacctRestartMin
+	for {
+		started := time.Now()
+		err := s.scan(handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if time.Since(started) >= pmacctRestartMax {
+			backoff = pmacctRestartMin
+		}
+		slog.Error("pmacct exited, restarting", "bin", s.bin, "err", err, "backoff", backoff)
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+			if backoff *= 2; backoff > pmacctRestartMax {
+				backoff = pmacctRestartMax
+			}
+			if err := s.start(); err != nil {
+				slog.Error("restarting pmacct", "bin", s.bin, "err", err, "backoff", backoff)
+				continue
+			}
+			pmacctRestarts.Inc()
+			break
+		}
+	}
+}
+
+// interrupt sends SIGINT to the process group of pmacctd, which purges its
+// cache and exits. If it still runs after -shutdown-timeout it is killed.
+func (s *PmacctdSource) interrupt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	// exited on its own, Run is waiting out the backoff
+	if !s.running {
+		return nil
+	}
+	err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGINT)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	time.AfterFunc(*shutdownTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.running {
+			return
+		}
+		slog.Warn("pmacct didn't exit in time, killing it", "bin", s.bin, "timeout", *shutdownTimeout)
+		if err := killGroup(s.cmd); err != nil {
+			slog.Error("killing pmacct", "bin", s.bin, "err", err)
+		}
+	})
+	return nil
+}
+
+// StdinSource reads lines piped in by a pmacctd or nfacctd run elsewhere
+type StdinSource struct {
+	file *os.File
+}
+
+// NewStdinSource switches stdin to non-blocking mode, os.Stdin blocks in
+// read(2) where closing it does not end a Run waiting for input
+func NewStdinSource() *StdinSource {
+	syscall.SetNonblock(0, true)
+	return &StdinSource{file: os.NewFile(0, "/dev/stdin")}
+}
+
+func (s *StdinSource) Run(ctx context.Context, handle func(text string)) error {
+	// the shell gets stdin back as it was
+	defer syscall.SetNonblock(0, false)
+	release := context.AfterFunc(ctx, func() { s.file.Close() })
+	defer release()
+
+	in, err := maybeGunzip(s.file)
+	if err != nil {
+		return err
+	}
+	scanner := newLineScanner(in)
+	for scanner.Scan() && ctx.Err() == nil {
+		handle(scanner.Text())
+	}
+	if err := scanErr(scanner); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// UnixgramSource reads datagrams of one or more newline separated lines
+// from a unix socket
+type UnixgramSource struct {
+	path string
+	conn *net.UnixConn
+}
+
+func ListenUnixgram(path string) (*UnixgramSource, error) {
+	// a socket left over by an unclean exit
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &UnixgramSource{path: path, conn: conn}, nil
+}
+
+func (s *UnixgramSource) Run(ctx context.Context, handle func(text string)) error {
+	defer os.Remove(s.path)
+	release := context.AfterFunc(ctx, func() { s.conn.Close() })
+	defer release()
+
+	buf := make([]byte, *maxLineBytes)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			// closed on cancellation
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				handle(string(line))
+			}
+		}
+	}
+}
+
+// StreamSource accepts connections on a unix or TCP socket and reads lines
+// from each, e.g. from a pmacct print plugin writing to a socket elsewhere
+type StreamSource struct {
+	listener net.Listener
+	// unix socket file, removed on exit
+	path string
+}
+
+// ListenFlowStream listens on a unix:///path or tcp://host:port address
+func ListenFlowStream(address string) (*StreamSource, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		// a socket left over by an unclean exit
+		if info, err := os.Stat(u.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(u.Path)
+		}
+		listener, err := net.Listen("unix", u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &StreamSource{listener: listener, path: u.Path}, nil
+	case "tcp":
+		listener, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &StreamSource{listener: listener}, nil
+	}
+	return nil, fmt.Errorf("-listen-flow %q: scheme has to be unix or tcp", address)
+}
+
+// Run reads every accepted connection until it closes. Lines of concurrent
+// connections are handed to handle one at a time.
+func (s *StreamSource) Run(ctx context.Context, handle func(text string)) error {
+	if s.path != "" {
+		defer os.Remove(s.path)
+	}
+
+	// guards conns, closed on cancellation
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	var handleMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	release := context.AfterFunc(ctx, func() {
+		s.listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+	defer release()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// closed on cancellation
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		// accepted just before the listener closed
+		if ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+			slog.Info("flow stream connected", "remote", conn.RemoteAddr())
+			in, err := maybeGunzip(conn)
+			if err != nil {
+				slog.Error("flow stream", "remote", conn.RemoteAddr(), "err", err)
+				return
+			}
+			scanner := newLineScanner(in)
+			for scanner.Scan() && ctx.Err() == nil {
+				handleMu.Lock()
+				handle(scanner.Text())
+				handleMu.Unlock()
+			}
+			if err := scanErr(scanner); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("flow stream", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
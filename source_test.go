@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// shortSocketPath returns a socket path within the length limit of unix
+// sockets, which t.TempDir can exceed
+func shortSocketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "pmacct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "flows.sock")
+}
+
+func TestUnixgramSource(t *testing.T) {
+	path := shortSocketPath(t)
+	// left over by an unclean exit
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+
+	source, err := ListenUnixgram(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- source.Run(ctx, func(text string) { lines <- text }) }()
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, datagram := range []string{
+		`{"bytes": 1}`,
+		"{\"bytes\": 2}\n{\"bytes\": 3}\n\n",
+	} {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{`{"bytes": 1}`, `{"bytes": 2}`, `{"bytes": 3}`} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("line %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no line %q", want)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run after cancel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
+
+func TestCountLinesSilentCommand(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	clock := func() time.Time { return now }
+
+	var handled int
+	handle := countLines(func(string) { handled++ }, clock)
+	if got := testutil.ToFloat64(pmacctLastOutput); got != float64(start.Unix()) {
+		t.Errorf("pmacct_last_output_timestamp at startup %v, want %d", got, start.Unix())
+	}
+
+	// runs and exits without printing anything, like pmacctd with the wrong plugin
+	lines := testutil.ToFloat64(pmacctOutputLines)
+	now = start.Add(time.Minute)
+	silent, err := StartPmacctd("sh", "-c true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := silent.scan(handle); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(pmacctOutputLines) - lines; got != 0 || handled != 0 {
+		t.Errorf("silent command counted %v lines, handled %d", got, handled)
+	}
+	if got := testutil.ToFloat64(pmacctLastOutput); got != float64(start.Unix()) {
+		t.Errorf("pmacct_last_output_timestamp moved to %v without output", got)
+	}
+
+	// JSON or not, every line counts
+	noisy, err := StartPmacctd("printf", `INFO\n{"bytes":1}\n\n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := noisy.scan(handle); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(pmacctOutputLines) - lines; got != 3 || handled != 3 {
+		t.Errorf("counted %v lines, handled %d, want 3", got, handled)
+	}
+	if got := testutil.ToFloat64(pmacctLastOutput); got != float64(now.Unix()) {
+		t.Errorf("pmacct_last_output_timestamp %v, want %d", got, now.Unix())
+	}
+}
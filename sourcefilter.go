@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sourceFilterFlag = flag.String("source-filter", "", "Only process flows whose JSON field has one of the given values, e.g. tag=1,2")
+
+var flowsSourceFiltered = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "flows_source_filtered_total",
+		Help: "Flows skipped by -source-filter",
+	},
+)
+
+// SourceFilter keeps flows whose field has one of the allowed values
+type SourceFilter struct {
+	field  string
+	values map[string]bool
+}
+
+func ParseSourceFilter(spec string) (*SourceFilter, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("-source-filter must look like field=value[,value...], got %q", spec)
+	}
+	f := &SourceFilter{field: parts[0], values: make(map[string]bool)}
+	for _, value := range strings.Split(parts[1], ",") {
+		f.values[strings.TrimSpace(value)] = true
+	}
+	return f, nil
+}
+
+// Match only decodes the filtered field, so dropped lines stay cheap
+func (f *SourceFilter) Match(text string) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		// let MakeFlow report it
+		return true
+	}
+	raw, ok := fields[f.field]
+	if !ok {
+		return false
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return false
+	}
+	return f.values[fmt.Sprint(value)]
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSourceFilterMatch(t *testing.T) {
+	filter, err := ParseSourceFilter("tag=1, 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line  string
+		match bool
+	}{
+		{`{"tag": 1, "ip_src": "10.0.0.1"}`, true},
+		{`{"tag": 2}`, true},
+		{`{"tag": "2"}`, true},
+		{`{"tag": 3, "ip_src": "10.0.0.1"}`, false},
+		{`{"tag": "12"}`, false},
+		{`{"ip_src": "10.0.0.1"}`, false},
+		{`{"tag": null}`, false},
+		// broken lines pass to be reported by MakeFlow
+		{`{"tag": 3`, true},
+	}
+	for _, test := range tests {
+		if got := filter.Match(test.line); got != test.match {
+			t.Errorf("%s: match %v, want %v", test.line, got, test.match)
+		}
+	}
+}
+
+func TestParseSourceFilterInvalid(t *testing.T) {
+	for _, spec := range []string{"tag", "tag=", "=1", ""} {
+		if _, err := ParseSourceFilter(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
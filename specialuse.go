@@ -0,0 +1,5 @@
+package main
+
+import "flag"
+
+var specialUseLabel = flag.Bool("label-special-use", false, "Add the special-use class of the remote address (documentation, benchmarking, ...) as special_use label")
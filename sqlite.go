@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	sqlitePath  = flag.String("sqlite-path", "", "SQLite file enriched flows are written to (needs a build with -tags sqlite)")
+	sqliteBatch = flag.Int("sqlite-batch", 1000, "Flows per SQLite transaction")
+	sqliteFlush = flag.Duration("sqlite-flush", 5*time.Second, "Max time a flow waits before being written to SQLite")
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS flows (
+	time        INTEGER NOT NULL, -- unix seconds
+	ip_src      TEXT NOT NULL,
+	port_src    INTEGER,
+	ip_dst      TEXT NOT NULL,
+	port_dst    INTEGER,
+	proto       TEXT,
+	packets     INTEGER,
+	bytes       INTEGER,
+	direction   TEXT,
+	private     INTEGER,
+	exporter    TEXT,
+	src_country TEXT,
+	src_asn     TEXT,
+	src_asn_org TEXT,
+	dst_country TEXT,
+	dst_asn     TEXT,
+	dst_asn_org TEXT
+);
+CREATE INDEX IF NOT EXISTS flows_time ON flows (time);
+`
+
+const sqliteInsert = `INSERT INTO flows VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+type sqliteRow struct {
+	flow *Flow
+	at   time.Time
+}
+
+// SQLiteWriter inserts flows in batched transactions through an
+// AsyncEmitter, like InfluxWriter it drops flows rather than blocking the
+// scanner
+type SQLiteWriter struct {
+	db      *sql.DB
+	emitter *AsyncEmitter
+}
+
+func NewSQLiteWriter(path string, config EmitterConfig) (*SQLiteWriter, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w, was the binary built with -tags sqlite?", err)
+	}
+	// one writer, sqlite serializes them anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite %s: %w", path, err)
+	}
+
+	w := &SQLiteWriter{db: db}
+	w.emitter = NewAsyncEmitter("sqlite", config, w.insert)
+	return w, nil
+}
+
+// Write queues the flow, dropping it if the queue is full
+func (w *SQLiteWriter) Write(flow *Flow) {
+	at := flow.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	w.emitter.Enqueue(sqliteRow{flow, at})
+}
+
+// Close writes what is still queued and closes the database
+func (w *SQLiteWriter) Close() error {
+	w.emitter.Close()
+	return w.db.Close()
+}
+
+func (w *SQLiteWriter) insert(rows []interface{}) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(sqliteInsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, item := range rows {
+		row := item.(sqliteRow)
+		f := row.flow
+		src, dst := f.Source, f.Destination
+		if src == nil {
+			src = &Peer{}
+		}
+		if dst == nil {
+			dst = &Peer{}
+		}
+		_, err := stmt.Exec(
+			row.at.Unix(),
+			f.IpSrcRaw, f.SrcPort, f.IpDstRaw, f.DstPort, NormalizeProto(f.Proto),
+			f.Packages, f.Bytes, f.Direction, f.Private, f.Exporter,
+			src.Country, src.Asn, src.AsnOrg,
+			dst.Country, dst.Asn, dst.AsnOrg,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// cgo, so only in builds that ask for -sqlite-path support
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,65 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestSQLiteWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.db")
+	w, err := NewSQLiteWriter(path, EmitterConfig{Queue: 10, Batch: 2, Flush: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Unix(1614834367, 0)
+	w.Write(&Flow{
+		IpSrcRaw: "10.0.0.1", SrcPort: 50000, IpDstRaw: "8.8.8.8", DstPort: 53, Proto: "17",
+		Packages: 2, Bytes: 140, Direction: "out", Timestamp: at,
+		Source:      &Peer{Ip: netaddr.MustParseIP("10.0.0.1")},
+		Destination: &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States", Asn: "15169", AsnOrg: "Google LLC"},
+	})
+	w.Write(&Flow{IpSrcRaw: "8.8.8.8", IpDstRaw: "10.0.0.1", Bytes: 300, Direction: "in", Timestamp: at})
+	// less than a batch, written by Close
+	w.Write(&Flow{IpSrcRaw: "10.0.0.1", IpDstRaw: "10.0.0.2", Bytes: 5, Private: true, Timestamp: at})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count, bytes int
+	if err := db.QueryRow(`SELECT count(*), sum(bytes) FROM flows WHERE time = ?`, at.Unix()).Scan(&count, &bytes); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || bytes != 445 {
+		t.Errorf("%d flows with %d bytes, want 3 with 445", count, bytes)
+	}
+
+	var proto, direction, country, asnOrg string
+	var port int
+	err = db.QueryRow(`SELECT proto, port_dst, direction, dst_country, dst_asn_org FROM flows WHERE ip_dst = '8.8.8.8'`).
+		Scan(&proto, &port, &direction, &country, &asnOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "udp" || port != 53 || direction != "out" || country != "United States" || asnOrg != "Google LLC" {
+		t.Errorf("read back %s %d %s %s %s", proto, port, direction, country, asnOrg)
+	}
+
+	var private bool
+	if err := db.QueryRow(`SELECT private FROM flows WHERE ip_dst = '10.0.0.2'`).Scan(&private); err != nil || !private {
+		t.Errorf("private %v, err %v", private, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	counterState         = flag.String("counter-state", "", "File the byte counters are snapshotted to and restored from on startup")
+	counterStateInterval = flag.Duration("counter-state-interval", time.Minute, "How often -counter-state is written")
+)
+
+// persistentCounters are the counters saved to and restored from -counter-state
+var persistentCounters = map[string]*prometheus.CounterVec{}
+
+type counterSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+type counterSnapshot struct {
+	Saved    time.Time       `json:"saved"`
+	Counters []counterSample `json:"counters"`
+}
+
+// SaveCounters writes the current value of every persistent counter series
+func SaveCounters(path string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	snapshot := counterSnapshot{Saved: time.Now()}
+	for _, family := range families {
+		if _, ok := persistentCounters[family.GetName()]; !ok || family.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			snapshot.Counters = append(snapshot.Counters, counterSample{
+				Name:   family.GetName(),
+				Labels: labels,
+				Value:  metric.GetCounter().GetValue(),
+			})
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// LoadCounters adds the saved values to the persistent counters. Series
+// whose labels don't fit the current flags are skipped.
+func LoadCounters(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot counterSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	skipped := 0
+	for _, sample := range snapshot.Counters {
+		vec, ok := persistentCounters[sample.Name]
+		if !ok {
+			skipped++
+			continue
+		}
+		counter, err := vec.GetMetricWith(sample.Labels)
+		if err != nil {
+			skipped++
+			continue
+		}
+		counter.Add(sample.Value)
+	}
+	if skipped > 0 {
+		slog.Warn("counter state: skipped series not matching the current flags", "series", skipped)
+	}
+	return nil
+}
+
+// SaveCountersEvery snapshots the counters every interval until stop is closed
+func SaveCountersEvery(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := SaveCounters(path, prometheus.DefaultGatherer); err != nil {
+				slog.Error("saving counter state", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func countedFlow(direction string, bytes int) *Flow {
+	local := &Peer{Ip: netaddr.MustParseIP("10.0.0.1")}
+	remote := &Peer{Ip: netaddr.MustParseIP("8.8.8.8"), Country: "United States"}
+	f := &Flow{Direction: direction, Bytes: bytes, Packages: 1, Source: local, Destination: remote}
+	if direction == "in" {
+		f.Source, f.Destination = remote, local
+	}
+	f.IpSrc, f.IpDst = f.Source.Ip, f.Destination.Ip
+	return f
+}
+
+func TestCounterStateRestart(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction,country"})
+	path := filepath.Join(t.TempDir(), "counters.json")
+	out := `flow_direction_bytes{country="United States",direction="out"}`
+
+	registry := setupTestMetrics(t)
+	LogPrometheus(countedFlow("out", 1000))
+	LogPrometheus(countedFlow("in", 20))
+	if err := SaveCounters(path, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new process starts over with fresh counters
+	restarted := setupTestMetrics(t)
+	if got := gatheredFrom(t, restarted)[out]; got != 0 {
+		t.Fatalf("fresh counter at %v", got)
+	}
+	if err := LoadCounters(path); err != nil {
+		t.Fatal(err)
+	}
+	LogPrometheus(countedFlow("out", 1))
+
+	got := gatheredFrom(t, restarted)
+	for key, want := range map[string]float64{
+		out: 1001,
+		`flow_direction_bytes{country="United States",direction="in"}`:    20,
+		`flow_direction_packets{country="United States",direction="out"}`: 2,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v after the restart, want %v", key, got[key], want)
+		}
+	}
+}
+
+func TestCounterStateChangedLabels(t *testing.T) {
+	setFlags(t, map[string]string{"labels": "direction,country"})
+	path := filepath.Join(t.TempDir(), "counters.json")
+	registry := setupTestMetrics(t)
+	LogPrometheus(countedFlow("out", 1000))
+	if err := SaveCounters(path, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	setFlags(t, map[string]string{"labels": "direction"})
+	restarted := setupTestMetrics(t)
+	if err := LoadCounters(path); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range gatheredFrom(t, restarted) {
+		if value != 0 {
+			t.Errorf("%s = %v restored into a different label set", key, value)
+		}
+	}
+}
+
+func TestLoadCountersMissingFile(t *testing.T) {
+	if err := LoadCounters(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	timestampField = flag.String("timestamp-field", "auto", "JSON field holding the flow time, auto tries timestamp_end, timestamp_start, stamp_updated and stamp_inserted")
+	timestampUnit  = flag.String("timestamp-unit", "auto", "Unit of -timestamp-field: auto, s, ms, us, ns, rfc3339 or pmacct (2006-01-02 15:04:05), flows not parsing are dropped")
+	maxClockSkew   = flag.Duration("max-clock-skew", 0, "Flow timestamps further than this in the future or past are replaced by now, 0 disables")
+)
+
+var (
+	flowBadTimestamp = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flow_bad_timestamp_total",
+			Help: "Flow timestamps replaced by now, by reason: future or too_old, see -max-clock-skew",
+		},
+		[]string{"reason"},
+	)
+	flowTimestampLag = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flow_timestamp_lag_seconds",
+			Help: "Seconds from timestamp_end of the last flow to its processing, buffering in pmacct or clock skew",
+		},
+	)
+)
+
+func validTimestampUnit(unit string) bool {
+	switch unit {
+	case "auto", "s", "ms", "us", "ns", "rfc3339", "pmacct":
+		return true
+	}
+	return false
+}
+
+// ObserveTimestampLag sets flow_timestamp_lag_seconds from timestamp_end of
+// f, flows without one leave the gauge alone
+func ObserveTimestampLag(f *Flow, now time.Time) {
+	if f.TimestampEndRaw == "" {
+		return
+	}
+	end, err := ParseTimestamp(string(f.TimestampEndRaw), *timestampUnit)
+	if err != nil {
+		return
+	}
+	flowTimestampLag.Set(now.Sub(end).Seconds())
+}
+
+// ClampTimestamp replaces t by now if it is more than skew away from it and
+// returns why, a zero t or skew is left alone
+func ClampTimestamp(t time.Time, now time.Time, skew time.Duration) (time.Time, string) {
+	switch {
+	case t.IsZero() || skew <= 0:
+		return t, ""
+	case t.After(now.Add(skew)):
+		return now, "future"
+	case t.Before(now.Add(-skew)):
+		return now, "too_old"
+	}
+	return t, ""
+}
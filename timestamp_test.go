@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2021, 3, 4, 5, 6, 7, 250000000, time.UTC)
+	tests := []struct {
+		value string
+		unit  string
+	}{
+		{"1614834367.25", "s"},
+		{"1614834367250", "ms"},
+		{"1614834367250000", "us"},
+		{"1614834367250000000", "ns"},
+		{"2021-03-04T05:06:07.25Z", "rfc3339"},
+		{"2021-03-04T06:06:07.25+01:00", "rfc3339"},
+		{"1614834367.25", "auto"},
+		{"1614834367250", "auto"},
+		{"1614834367250000", "auto"},
+		{"1614834367250000000", "auto"},
+		{" 1614834367.25 ", "auto"},
+		{"2021-03-04T05:06:07.25Z", "auto"},
+	}
+	for _, test := range tests {
+		got, err := ParseTimestamp(test.value, test.unit)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.unit, test.value, err)
+			continue
+		}
+		// float seconds lose nanoseconds
+		if d := got.Sub(want); d < -time.Microsecond || d > time.Microsecond {
+			t.Errorf("%s %q: %v, want %v", test.unit, test.value, got.UTC(), want)
+		}
+	}
+}
+
+func TestParseTimestampPmacct(t *testing.T) {
+	want := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+	for _, unit := range []string{"pmacct", "auto"} {
+		got, err := ParseTimestamp("2021-03-04 05:06:07", unit)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("%s: %v %v, want %v", unit, got, err, want)
+		}
+	}
+}
+
+func TestParseTimestampInvalid(t *testing.T) {
+	tests := []struct {
+		value string
+		unit  string
+	}{
+		{"", "auto"},
+		{"yesterday", "auto"},
+		{"1614834367", "rfc3339"},
+		{"2021-03-04T05:06:07Z", "s"},
+		{"1614834367", "minutes"},
+	}
+	for _, test := range tests {
+		if got, err := ParseTimestamp(test.value, test.unit); err == nil {
+			t.Errorf("%s %q: %v, want an error", test.unit, test.value, got)
+		}
+	}
+}
+
+func TestMakeFlowBadTimestamp(t *testing.T) {
+	setFlags(t, map[string]string{"timestamp-field": "timestamp_end", "timestamp-unit": "s"})
+	defer func(saved slog.Level) { logLevel.Set(saved) }(logLevel.Level())
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		logLevel.Set(level)
+		flow, err := MakeFlow(`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "timestamp_end": "soon"}`, nil)
+		if err == nil || flow != nil {
+			t.Errorf("log level %s: kept the flow %v", level, flow)
+		}
+	}
+
+	flow, err := MakeFlow(`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "timestamp_end": "1614834367"}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1614834367, 0); !flow.Timestamp.Equal(want) {
+		t.Errorf("timestamp %v, want %v", flow.Timestamp, want)
+	}
+}
+
+func TestClampTimestamp(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t      time.Time
+		skew   time.Duration
+		want   time.Time
+		reason string
+	}{
+		{now.Add(time.Minute), time.Hour, now.Add(time.Minute), ""},
+		{now.Add(2 * time.Hour), time.Hour, now, "future"},
+		{now.Add(-2 * time.Hour), time.Hour, now, "too_old"},
+		{now.Add(-2 * time.Hour), 0, now.Add(-2 * time.Hour), ""},
+		{time.Time{}, time.Hour, time.Time{}, ""},
+	}
+	for _, test := range tests {
+		got, reason := ClampTimestamp(test.t, now, test.skew)
+		if !got.Equal(test.want) || reason != test.reason {
+			t.Errorf("%v skew %v: %v %q, want %v %q", test.t, test.skew, got, reason, test.want, test.reason)
+		}
+	}
+}
+
+func TestMakeFlowClockSkew(t *testing.T) {
+	setFlags(t, map[string]string{"timestamp-field": "timestamp_end", "timestamp-unit": "s", "max-clock-skew": "1h"})
+	now := time.Now()
+	tests := []struct {
+		at     time.Time
+		reason string
+	}{
+		{now.Add(-time.Minute), ""},
+		{now.Add(3 * time.Hour), "future"},
+		{now.Add(-48 * time.Hour), "too_old"},
+	}
+	for _, test := range tests {
+		counters := map[string]float64{}
+		for _, reason := range []string{"future", "too_old"} {
+			counters[reason] = testutil.ToFloat64(flowBadTimestamp.With(prometheus.Labels{"reason": reason}))
+		}
+		line := fmt.Sprintf(`{"ip_src": "10.0.0.1", "ip_dst": "8.8.8.8", "timestamp_end": "%d"}`, test.at.Unix())
+		flow, err := MakeFlow(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.reason == "" {
+			if flow.Timestamp.Unix() != test.at.Unix() {
+				t.Errorf("%v: timestamp changed to %v", test.at, flow.Timestamp)
+			}
+		} else if flow.Timestamp.Before(now) || flow.Timestamp.After(time.Now()) {
+			t.Errorf("%s %v: timestamp %v, want now", test.reason, test.at, flow.Timestamp)
+		}
+		for reason, before := range counters {
+			want := 0.0
+			if reason == test.reason {
+				want = 1
+			}
+			if got := testutil.ToFloat64(flowBadTimestamp.With(prometheus.Labels{"reason": reason})) - before; got != want {
+				t.Errorf("%v: flow_bad_timestamp_total{reason=%q} grew by %v, want %v", test.at, reason, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+var (
+	topTalkers      = flag.Int("top-talkers", 0, "Expose the N remote ips with the most bytes as flow_top_talker_bytes, 0 disables")
+	topPorts        = flag.Int("top-ports", 0, "Expose the N destination ports with the most flows as flow_top_dst_ports, 0 disables")
+	topCountryProto = flag.Int("top-country-proto", 0, "Expose the N country and proto pairs with the most bytes as flow_country_proto_bytes, 0 disables")
+	v6AggLen        = flag.Int("v6-agg-len", 128, "Prefix length remote IPv6 addresses are aggregated to in ip labels, e.g. 48 or 56")
+	topMaxTracked   = flag.Int("top-max-tracked", 10000, "Max keys tracked by top-N aggregations, traffic of further keys counts as other")
+	topWindow       = flag.Duration("top-window", 5*time.Minute, "Window after which top-N aggregations start over")
+)
+
+// TopEntry is a key of a TopN with its total
+type TopEntry struct {
+	Key   string  `json:"key"`
+	Value float64 `json:"value"`
+}
+
+// TopN sums values per key for a bounded number of keys. Values of keys
+// seen after the bound is reached go into an overflow total instead.
+type TopN struct {
+	maxKeys int
+
+	mu       sync.Mutex
+	values   map[string]float64
+	overflow float64
+}
+
+func NewTopN(maxKeys int) *TopN {
+	return &TopN{
+		maxKeys: maxKeys,
+		values:  make(map[string]float64),
+	}
+}
+
+func (t *TopN) Add(key string, value float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.values[key]; !ok && len(t.values) >= t.maxKeys {
+		t.overflow += value
+		return
+	}
+	t.values[key] += value
+}
+
+// Top returns the n largest keys and the sum of everything else
+func (t *TopN) Top(n int) (top []TopEntry, other float64) {
+	t.mu.Lock()
+	entries := make([]TopEntry, 0, len(t.values))
+	for key, value := range t.values {
+		entries = append(entries, TopEntry{key, value})
+	}
+	other = t.overflow
+	t.mu.Unlock()
+
+	return largest(entries, other, n)
+}
+
+// Take is Top followed by Reset, without losing values added in between
+func (t *TopN) Take(n int) (top []TopEntry, other float64) {
+	t.mu.Lock()
+	values, other := t.values, t.overflow
+	t.values = make(map[string]float64)
+	t.overflow = 0
+	t.mu.Unlock()
+
+	entries := make([]TopEntry, 0, len(values))
+	for key, value := range values {
+		entries = append(entries, TopEntry{key, value})
+	}
+	return largest(entries, other, n)
+}
+
+// largest sorts entries by value and folds all but the first n into other
+func largest(entries []TopEntry, other float64, n int) ([]TopEntry, float64) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		for _, e := range entries[n:] {
+			other += e.Value
+		}
+		entries = entries[:n]
+	}
+	return entries, other
+}
+
+// Len returns the number of distinct keys tracked
+func (t *TopN) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.values)
+}
+
+func (t *TopN) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.values = make(map[string]float64)
+	t.overflow = 0
+}
+
+// ResetEvery starts the aggregation over every interval until stop is closed
+func (t *TopN) ResetEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Reset()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// TopTalkersCollector computes the top talkers and the distinct peer count
+// only when scraped, from the bytes per remote ip kept in a TopN.
+type TopTalkersCollector struct {
+	store *TopN
+	n     int
+
+	bytesDesc    *prometheus.Desc
+	distinctDesc *prometheus.Desc
+}
+
+func NewTopTalkersCollector(store *TopN, n int) *TopTalkersCollector {
+	return &TopTalkersCollector{
+		store: store,
+		n:     n,
+		bytesDesc: prometheus.NewDesc(
+			"flow_top_talker_bytes",
+			"Bytes of the remote ips, or IPv6 prefixes with -v6-agg-len, with the most traffic in the current -top-window, the rest as other",
+			[]string{"ip"}, nil,
+		),
+		distinctDesc: prometheus.NewDesc(
+			"flow_distinct_peers",
+			"Distinct remote ips in the current -top-window",
+			nil, nil,
+		),
+	}
+}
+
+func (c *TopTalkersCollector) Observe(flow *Flow) {
+	if peer := flow.RemotePeer(); peer != nil {
+		c.store.Add(AggregateIP(peer.Ip, *v6AggLen), float64(flow.Bytes))
+	}
+}
+
+// AggregateIP labels an IPv6 address by its prefix of length bits, IPv4
+// addresses and bits of 128 are left as they are
+func AggregateIP(ip netaddr.IP, bits int) string {
+	if !ip.Is6() || ip.Is4in6() || bits >= 128 {
+		return ip.String()
+	}
+	prefix, err := ip.Prefix(uint8(bits))
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.String()
+}
+
+func (c *TopTalkersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesDesc
+	ch <- c.distinctDesc
+}
+
+func (c *TopTalkersCollector) Collect(ch chan<- prometheus.Metric) {
+	top, other := c.store.Top(c.n)
+	for _, e := range top {
+		ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, e.Value, e.Key)
+	}
+	ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, other, "other")
+	ch <- prometheus.MustNewConstMetric(c.distinctDesc, prometheus.GaugeValue, float64(c.store.Len()))
+}
+
+// TopPortsCollector counts flows per destination port, exposed like
+// TopTalkersCollector when scraped
+type TopPortsCollector struct {
+	store *TopN
+	n     int
+
+	desc *prometheus.Desc
+}
+
+func NewTopPortsCollector(store *TopN, n int) *TopPortsCollector {
+	return &TopPortsCollector{
+		store: store,
+		n:     n,
+		desc: prometheus.NewDesc(
+			"flow_top_dst_ports",
+			"Flows to the destination ports with the most flows in the current -top-window, the rest as other",
+			[]string{"port"}, nil,
+		),
+	}
+}
+
+func (c *TopPortsCollector) Observe(flow *Flow) {
+	// portless protocols like icmp
+	if flow.DstPort == 0 {
+		return
+	}
+	c.store.Add(strconv.Itoa(flow.DstPort), 1)
+}
+
+func (c *TopPortsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *TopPortsCollector) Collect(ch chan<- prometheus.Metric) {
+	top, other := c.store.Top(c.n)
+	for _, e := range top {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, e.Value, e.Key)
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, other, "other")
+}
+
+// CountryProtoCollector sums bytes per remote country and protocol
+type CountryProtoCollector struct {
+	store *TopN
+	n     int
+
+	desc *prometheus.Desc
+}
+
+func NewCountryProtoCollector(store *TopN, n int) *CountryProtoCollector {
+	return &CountryProtoCollector{
+		store: store,
+		n:     n,
+		desc: prometheus.NewDesc(
+			"flow_country_proto_bytes",
+			"Bytes of the remote country and proto pairs with the most traffic in the current -top-window, the rest as other",
+			[]string{"country", "proto"}, nil,
+		),
+	}
+}
+
+func (c *CountryProtoCollector) Observe(flow *Flow) {
+	if peer := flow.RemotePeer(); peer != nil {
+		c.store.Add(geoLabel(peer.Country)+"\x00"+NormalizeProto(flow.Proto), float64(flow.Bytes))
+	}
+}
+
+func (c *CountryProtoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *CountryProtoCollector) Collect(ch chan<- prometheus.Metric) {
+	top, other := c.store.Top(c.n)
+	for _, e := range top {
+		pair := strings.SplitN(e.Key, "\x00", 2)
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, e.Value, pair[0], pair[1])
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, other, "other", "other")
+}
+
+type topList struct {
+	Top   []TopEntry `json:"top"`
+	Other float64    `json:"other"`
+}
+
+// TopView serves the enabled top-N aggregations as JSON on /top
+type TopView struct {
+	Talkers *TopTalkersCollector
+	Ports   *TopPortsCollector
+}
+
+func (v *TopView) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	view := make(map[string]topList)
+	if v.Talkers != nil {
+		top, other := v.Talkers.store.Top(v.Talkers.n)
+		view["talkers"] = topList{top, other}
+	}
+	if v.Ports != nil {
+		top, other := v.Ports.store.Top(v.Ports.n)
+		view["dst_ports"] = topList{top, other}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
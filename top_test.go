@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+// gathered registers c on its own registry and returns what a scrape sees,
+// keyed like flow_top_dst_ports{port="443"}
+func gathered(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	return gatheredFrom(t, registry)
+}
+
+// gatheredFrom returns the values of every metric in g like gathered
+func gatheredFrom(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, pair.GetName()+`="`+pair.GetValue()+`"`)
+			}
+			sort.Strings(labels)
+			key := family.GetName()
+			if len(labels) > 0 {
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+			value := m.GetGauge().GetValue()
+			if m.GetCounter() != nil {
+				value = m.GetCounter().GetValue()
+			}
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func assertGathered(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for key, value := range want {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("%s = %v (present %v), want %v", key, v, ok, value)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected %s = %v", key, got[key])
+		}
+	}
+}
+
+func outFlow(dst string, dstPort, bytes int) *Flow {
+	ip := netaddr.MustParseIP(dst)
+	return &Flow{
+		Direction:   "out",
+		IpSrc:       netaddr.MustParseIP("10.0.0.1"),
+		IpDst:       ip,
+		DstPort:     dstPort,
+		Bytes:       bytes,
+		Source:      &Peer{Ip: netaddr.MustParseIP("10.0.0.1")},
+		Destination: &Peer{Ip: ip},
+	}
+}
+
+func TestTopTalkersCollector(t *testing.T) {
+	c := NewTopTalkersCollector(NewTopN(100), 2)
+	c.Observe(outFlow("1.1.1.1", 443, 500))
+	c.Observe(outFlow("1.1.1.1", 443, 500))
+	c.Observe(outFlow("8.8.8.8", 53, 300))
+	c.Observe(outFlow("9.9.9.9", 53, 100))
+	// no remote peer
+	c.Observe(&Flow{Direction: "unknown", Bytes: 1 << 20})
+
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_talker_bytes{ip="1.1.1.1"}`: 1000,
+		`flow_top_talker_bytes{ip="8.8.8.8"}`: 300,
+		`flow_top_talker_bytes{ip="other"}`:   100,
+		`flow_distinct_peers`:                 3,
+	})
+}
+
+func TestTopTalkersCollectorComputesAtScrape(t *testing.T) {
+	c := NewTopTalkersCollector(NewTopN(100), 5)
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_talker_bytes{ip="other"}`: 0,
+		`flow_distinct_peers`:               0,
+	})
+	c.Observe(outFlow("1.1.1.1", 443, 42))
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_talker_bytes{ip="1.1.1.1"}`: 42,
+		`flow_top_talker_bytes{ip="other"}`:   0,
+		`flow_distinct_peers`:                 1,
+	})
+}
+
+func TestTopPortsCollector(t *testing.T) {
+	c := NewTopPortsCollector(NewTopN(100), 1)
+	c.Observe(outFlow("1.1.1.1", 443, 1))
+	c.Observe(outFlow("1.1.1.2", 443, 1))
+	c.Observe(outFlow("8.8.8.8", 53, 1))
+	// icmp has no port
+	c.Observe(outFlow("8.8.8.8", 0, 1))
+
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_dst_ports{port="443"}`:   2,
+		`flow_top_dst_ports{port="other"}`: 1,
+	})
+}
+
+func TestTopNOverflow(t *testing.T) {
+	top := NewTopN(2)
+	top.Add("a", 1)
+	top.Add("b", 2)
+	top.Add("c", 4)
+	top.Add("a", 1)
+
+	entries, other := top.Top(10)
+	if len(entries) != 2 || entries[0] != (TopEntry{"a", 2}) || entries[1] != (TopEntry{"b", 2}) || other != 4 {
+		t.Errorf("top %v other %v", entries, other)
+	}
+}
+
+func TestTopNTake(t *testing.T) {
+	top := NewTopN(2)
+	top.Add("a", 1)
+	top.Add("b", 2)
+	top.Add("c", 4)
+
+	entries, other := top.Take(1)
+	if len(entries) != 1 || entries[0] != (TopEntry{"b", 2}) || other != 5 {
+		t.Errorf("take %v other %v", entries, other)
+	}
+	// the next window starts empty, with room for new keys
+	top.Add("c", 3)
+	if entries, other := top.Top(10); len(entries) != 1 || entries[0] != (TopEntry{"c", 3}) || other != 0 {
+		t.Errorf("after take %v other %v", entries, other)
+	}
+}
+
+func TestTopPortsSkewed(t *testing.T) {
+	c := NewTopPortsCollector(NewTopN(100), 3)
+	for i := 0; i < 50; i++ {
+		c.Observe(outFlow("1.1.1.1", 443, 1000))
+	}
+	for i := 0; i < 20; i++ {
+		c.Observe(outFlow("8.8.8.8", 53, 80))
+	}
+	for i := 0; i < 5; i++ {
+		c.Observe(outFlow("1.1.1.1", 80, 1000))
+	}
+	// a long tail of ephemeral ports, one flow each
+	for port := 40000; port < 40030; port++ {
+		c.Observe(outFlow("9.9.9.9", port, 1<<20))
+	}
+
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_dst_ports{port="443"}`:   50,
+		`flow_top_dst_ports{port="53"}`:    20,
+		`flow_top_dst_ports{port="80"}`:    5,
+		`flow_top_dst_ports{port="other"}`: 30,
+	})
+}
+
+func TestTopView(t *testing.T) {
+	talkers := NewTopTalkersCollector(NewTopN(100), 1)
+	ports := NewTopPortsCollector(NewTopN(100), 1)
+	for _, f := range []*Flow{outFlow("1.1.1.1", 443, 500), outFlow("1.1.1.1", 443, 500), outFlow("8.8.8.8", 53, 100)} {
+		talkers.Observe(f)
+		ports.Observe(f)
+	}
+
+	recorder := httptest.NewRecorder()
+	(&TopView{Talkers: talkers, Ports: ports}).ServeHTTP(recorder, httptest.NewRequest("GET", "/top", nil))
+	var got map[string]topList
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]topList{
+		"talkers":   {[]TopEntry{{"1.1.1.1", 1000}}, 100},
+		"dst_ports": {[]TopEntry{{"443", 2}}, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// disabled aggregations are left out
+	recorder = httptest.NewRecorder()
+	(&TopView{Ports: ports}).ServeHTTP(recorder, httptest.NewRequest("GET", "/top", nil))
+	if strings.Contains(recorder.Body.String(), "talkers") {
+		t.Errorf("talkers in %s", recorder.Body.String())
+	}
+}
+
+func TestAggregateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		bits int
+		want string
+	}{
+		{"2001:db8:1234:5678::1", 48, "2001:db8:1234::/48"},
+		{"2001:db8:1234:ffff::2", 48, "2001:db8:1234::/48"},
+		{"2001:db8:1235::1", 48, "2001:db8:1235::/48"},
+		{"2001:db8:1234:56ff::1", 56, "2001:db8:1234:5600::/56"},
+		{"2001:db8:1234:5700::1", 56, "2001:db8:1234:5700::/56"},
+		{"2001:db8::1", 128, "2001:db8::1"},
+		// IPv4 is never aggregated
+		{"8.8.8.8", 48, "8.8.8.8"},
+		{"::ffff:8.8.8.8", 48, "::ffff:8.8.8.8"},
+	}
+	for _, test := range tests {
+		if got := AggregateIP(netaddr.MustParseIP(test.ip), test.bits); got != test.want {
+			t.Errorf("%s /%d: %s, want %s", test.ip, test.bits, got, test.want)
+		}
+	}
+}
+
+func TestTopTalkersAggregateV6(t *testing.T) {
+	setFlags(t, map[string]string{"v6-agg-len": "48"})
+	c := NewTopTalkersCollector(NewTopN(100), 5)
+	c.Observe(outFlow("2001:db8:1::1", 443, 100))
+	c.Observe(outFlow("2001:db8:1:ff::2", 443, 200))
+	c.Observe(outFlow("2001:db8:2::1", 443, 50))
+
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_top_talker_bytes{ip="2001:db8:1::/48"}`: 300,
+		`flow_top_talker_bytes{ip="2001:db8:2::/48"}`: 50,
+		`flow_top_talker_bytes{ip="other"}`:           0,
+		`flow_distinct_peers`:                         2,
+	})
+}
+
+func TestCountryProtoCollector(t *testing.T) {
+	c := NewCountryProtoCollector(NewTopN(100), 2)
+	observe := func(country, proto string, bytes int) {
+		f := outFlow("192.0.2.1", 0, bytes)
+		f.Destination.Country, f.Proto = country, proto
+		c.Observe(f)
+	}
+	observe("Germany", "tcp", 5000)
+	observe("Germany", "6", 5000)
+	observe("Russia", "udp", 3000)
+	// rolled into other beyond the cap
+	observe("Germany", "udp", 100)
+	observe("Russia", "tcp", 20)
+	observe("", "icmp", 3)
+	// no remote peer
+	c.Observe(&Flow{Direction: "unknown", Proto: "udp", Bytes: 1 << 20})
+
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_country_proto_bytes{country="Germany",proto="tcp"}`: 10000,
+		`flow_country_proto_bytes{country="Russia",proto="udp"}`:  3000,
+		`flow_country_proto_bytes{country="other",proto="other"}`: 123,
+	})
+}
+
+func TestCountryProtoCollectorTrackedCap(t *testing.T) {
+	// at most 2 combinations tracked, later ones go straight to other
+	c := NewCountryProtoCollector(NewTopN(2), 5)
+	for _, country := range []string{"Germany", "France", "Spain", "Italy"} {
+		f := outFlow("192.0.2.1", 0, 10)
+		f.Destination.Country, f.Proto = country, "tcp"
+		c.Observe(f)
+	}
+	assertGathered(t, gathered(t, c), map[string]float64{
+		`flow_country_proto_bytes{country="Germany",proto="tcp"}`: 10,
+		`flow_country_proto_bytes{country="France",proto="tcp"}`:  10,
+		`flow_country_proto_bytes{country="other",proto="other"}`: 20,
+	})
+}
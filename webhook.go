@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	sessionWebhook      = flag.String("session-webhook", "", "URL assembled -sessions are POSTed to as JSON lines")
+	sessionWebhookBatch = flag.Int("session-webhook-batch", 100, "Sessions per -session-webhook request")
+	sessionWebhookFlush = flag.Duration("session-webhook-flush", 5*time.Second, "Max time a session waits before being POSTed to -session-webhook")
+)
+
+// WebhookWriter POSTs session records to a URL through an AsyncEmitter, one
+// JSON object per line
+type WebhookWriter struct {
+	url    string
+	client *http.Client
+
+	emitter *AsyncEmitter
+}
+
+func NewWebhookWriter(url string, config EmitterConfig) *WebhookWriter {
+	w := &WebhookWriter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	w.emitter = NewAsyncEmitter("session-webhook", config, w.send)
+	return w
+}
+
+// Write queues the session, dropping it if the queue is full
+func (w *WebhookWriter) Write(s *Session) {
+	w.emitter.Enqueue(s.Record())
+}
+
+// Close sends what is still queued and stops the writer
+func (w *WebhookWriter) Close() {
+	w.emitter.Close()
+}
+
+func (w *WebhookWriter) send(batch []interface{}) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, record := range batch {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	resp, err := w.client.Post(w.url, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
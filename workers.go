@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	workers = flag.Int("workers", 1, "Goroutines parsing, enriching and handling flows in parallel")
+	shardBy = flag.String("shard-by", "none", "How flows are assigned to -workers: none (round robin), src (by ip_src) or asn (by the ASN of ip_src)")
+
+	queueSize     = flag.Int("queue-size", 256, "Lines buffered for each of -workers between reading the input and handling it")
+	queueOverflow = flag.String("queue-overflow", "block", "What happens to a line when its worker's queue is full: block reading the input, or drop and count it")
+)
+
+var (
+	flowQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "flow_queue_depth",
+		Help: "Lines read and waiting for a worker",
+	})
+	flowDroppedOverflow = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "flow_dropped_overflow_total",
+		Help: "Lines dropped because the queue of their worker was full",
+	})
+)
+
+// Dispatcher hands lines to a fixed set of workers. With a key function the
+// lines of one key always go to the same worker, otherwise round robin.
+type Dispatcher struct {
+	queues []chan string
+	key    func(text string) string
+	next   int
+	// drop lines for a full queue instead of waiting
+	drop bool
+
+	wg sync.WaitGroup
+}
+
+func NewDispatcher(n, size int, drop bool, key func(text string) string, work func(text string)) *Dispatcher {
+	d := &Dispatcher{queues: make([]chan string, n), key: key, drop: drop}
+	for i := range d.queues {
+		queue := make(chan string, size)
+		d.queues[i] = queue
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for text := range queue {
+				flowQueueDepth.Dec()
+				work(text)
+			}
+		}()
+	}
+	return d
+}
+
+// Worker returns the index of the worker text goes to
+func (d *Dispatcher) Worker(text string) int {
+	if d.key == nil {
+		i := d.next
+		d.next = (d.next + 1) % len(d.queues)
+		return i
+	}
+	return shardIndex(d.key(text), len(d.queues))
+}
+
+// Dispatch queues text. If the queue of its worker is full it is dropped,
+// or without drop it blocks until the worker catches up. Not safe for
+// concurrent use, there is one reader of the input.
+func (d *Dispatcher) Dispatch(text string) {
+	queue := d.queues[d.Worker(text)]
+	// counted before the worker can take it, the gauge never goes negative
+	flowQueueDepth.Inc()
+	if !d.drop {
+		queue <- text
+		return
+	}
+	select {
+	case queue <- text:
+	default:
+		flowQueueDepth.Dec()
+		flowDroppedOverflow.Inc()
+		flowEvents.With(prometheus.Labels{"status": "dropped"}).Inc()
+	}
+}
+
+// Close waits for the workers to finish what is queued
+func (d *Dispatcher) Close() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+func shardIndex(key string, n int) int {
+	hash := fnv.New64a()
+	io.WriteString(hash, key)
+	return int(mix64(hash.Sum64()) % uint64(n))
+}
+
+// ShardKey returns the key function of a -shard-by mode, nil for round robin
+func ShardKey(by string, geo *GeoDB) (func(text string) string, error) {
+	src := func(text string) string {
+		var line map[string]json.RawMessage
+		json.Unmarshal([]byte(text), &line)
+		var ip string
+		json.Unmarshal(line[inputField("ip_src")], &ip)
+		return ip
+	}
+
+	switch by {
+	case "none":
+		return nil, nil
+	case "src":
+		return src, nil
+	case "asn":
+		return func(text string) string {
+			ip, err := netaddr.ParseIP(src(text))
+			if err != nil || geo == nil {
+				return ""
+			}
+			var key string
+			geo.View(func(dbs GeoReaders) {
+				if dbs.ASN == nil {
+					return
+				}
+				record, err := dbs.ASN.ASN(ip.Unmap().IPAddr().IP)
+				if err == nil && record != nil {
+					key = strconv.FormatUint(uint64(record.AutonomousSystemNumber), 10)
+				}
+			})
+			return key
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown -shard-by %q", by)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func srcLine(ip string, port int) string {
+	return fmt.Sprintf(`{"ip_src": %q, "ip_dst": "8.8.8.8", "port_src": %d}`, ip, port)
+}
+
+func TestDispatcherShardBySrc(t *testing.T) {
+	key, err := ShardKey("src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(4, 16, false, key, func(string) {})
+	defer d.Close()
+
+	used := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		worker := d.Worker(srcLine(ip, 1))
+		for port := 2; port < 10; port++ {
+			if got := d.Worker(srcLine(ip, port)); got != worker {
+				t.Fatalf("%s went to workers %d and %d", ip, worker, got)
+			}
+		}
+		used[worker] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("50 sources spread over %d of 4 workers", len(used))
+	}
+}
+
+func TestDispatcherRoundRobin(t *testing.T) {
+	key, err := ShardKey("none", nil)
+	if err != nil || key != nil {
+		t.Fatalf("none: %v, %v", key != nil, err)
+	}
+	d := NewDispatcher(3, 16, false, nil, func(string) {})
+	defer d.Close()
+	for i := 0; i < 9; i++ {
+		if got := d.Worker(srcLine("10.0.0.1", 1)); got != i%3 {
+			t.Errorf("line %d to worker %d, want %d", i, got, i%3)
+		}
+	}
+}
+
+func TestDispatcherHandlesAll(t *testing.T) {
+	key, _ := ShardKey("src", nil)
+	var mu sync.Mutex
+	seen := map[string]int{}
+	d := NewDispatcher(4, 2, false, key, func(text string) {
+		mu.Lock()
+		seen[text]++
+		mu.Unlock()
+	})
+	for i := 0; i < 100; i++ {
+		d.Dispatch(srcLine(fmt.Sprintf("10.0.0.%d", i%10), i))
+	}
+	d.Close()
+	if len(seen) != 100 {
+		t.Errorf("handled %d of 100 lines", len(seen))
+	}
+}
+
+func TestShardKeyUnknown(t *testing.T) {
+	if _, err := ShardKey("dst", nil); err == nil {
+		t.Error("unknown -shard-by accepted")
+	}
+}